@@ -0,0 +1,136 @@
+package virtualbox
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type BandwidthGroupType string
+
+const (
+	DiskBandwidth    = BandwidthGroupType("disk")
+	NetworkBandwidth = BandwidthGroupType("network")
+)
+
+// BandwidthGroup limits the i/o of the disks or the traffic of the nics of a vm assigned to it
+type BandwidthGroup struct {
+	Name string
+	Type BandwidthGroupType
+	// MaxBytesPerSec is the limit shared by all members of the group
+	MaxBytesPerSec int64
+}
+
+const (
+	kilobyte = 1024
+	megabyte = 1024 * kilobyte
+	gigabyte = 1024 * megabyte
+)
+
+// limitArg formats the limit for --limit, upper case suffixes are bytes while lower case ones would be bits
+func limitArg(bytesPerSec int64) string {
+	switch {
+	case bytesPerSec%gigabyte == 0 && bytesPerSec != 0:
+		return fmt.Sprintf("%dG", bytesPerSec/gigabyte)
+	case bytesPerSec%megabyte == 0:
+		return fmt.Sprintf("%dM", bytesPerSec/megabyte)
+	}
+	return fmt.Sprintf("%dK", (bytesPerSec+kilobyte-1)/kilobyte)
+}
+
+// parses lines like the following
+//
+//	Name: 'slowdisk', Type: Disk, Limit: 20 Mbytes/sec
+var reBandwidthGroup = regexp.MustCompile(`(?i)Name:\s+'([^']*)',\s+Type:\s+(\w+),\s+Limit:\s+(\d+)\s*([KMG]?)bytes/sec`)
+
+func parseBandwidthGroups(out string) []BandwidthGroup {
+	var groups []BandwidthGroup
+	for _, m := range reBandwidthGroup.FindAllStringSubmatch(out, -1) {
+		limit, err := strconv.ParseInt(m[3], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch strings.ToUpper(m[4]) {
+		case "K":
+			limit *= kilobyte
+		case "M":
+			limit *= megabyte
+		case "G":
+			limit *= gigabyte
+		}
+		groups = append(groups, BandwidthGroup{
+			Name:           m[1],
+			Type:           BandwidthGroupType(strings.ToLower(m[2])),
+			MaxBytesPerSec: limit,
+		})
+	}
+	return groups
+}
+
+// AddBandwidthGroup creates the bandwidth group on the vm, disks and nics are assigned to it by name
+func (vb *VBox) AddBandwidthGroup(vm *VirtualMachine, group BandwidthGroup) error {
+	if group.Type != DiskBandwidth && group.Type != NetworkBandwidth {
+		return fmt.Errorf("unknown bandwidth group type %q", group.Type)
+	}
+
+	_, err := vb.manage("bandwidthctl", vm.UUIDOrName(), "add", group.Name,
+		"--type", string(group.Type), "--limit", limitArg(group.MaxBytesPerSec))
+	if err != nil && isAlreadyExistErrorMessage(err.Error()) {
+		return AlreadyExists(group.Name)
+	}
+	return err
+}
+
+// ListBandwidthGroups returns the bandwidth groups of the vm
+func (vb *VBox) ListBandwidthGroups(vm *VirtualMachine) ([]BandwidthGroup, error) {
+	out, err := vb.manage("bandwidthctl", vm.UUIDOrName(), "list")
+	if err != nil {
+		return nil, err
+	}
+	return parseBandwidthGroups(out), nil
+}
+
+// SetBandwidthLimit changes the limit of the group, this also works while the vm is running
+func (vb *VBox) SetBandwidthLimit(vm *VirtualMachine, name string, maxBytesPerSec int64) error {
+	_, err := vb.manage("bandwidthctl", vm.UUIDOrName(), "set", name, "--limit", limitArg(maxBytesPerSec))
+	return err
+}
+
+// RemoveBandwidthGroup deletes the group, it must not have disks or nics assigned anymore
+func (vb *VBox) RemoveBandwidthGroup(vm *VirtualMachine, name string) error {
+	_, err := vb.manage("bandwidthctl", vm.UUIDOrName(), "remove", name)
+	return err
+}
+
+// SetDiskBandwidthGroup assigns the disk attachment to the group, an empty group removes the assignment
+func (vb *VBox) SetDiskBandwidthGroup(vm *VirtualMachine, disk *Disk, group string) error {
+	_, err := vb.manage(
+		"storageattach", vm.UUIDOrName(),
+		"--storagectl", disk.Controller.Name,
+		"--port", strconv.Itoa(disk.Controller.Port),
+		"--device", strconv.Itoa(disk.Controller.Device),
+		"--bandwidthgroup", groupOrNone(group))
+	if err != nil {
+		return err
+	}
+	disk.BandwidthGroup = group
+	return nil
+}
+
+// SetNICBandwidthGroup assigns the nic to the group, an empty group removes the assignment. The vm must be
+// powered off
+func (vb *VBox) SetNICBandwidthGroup(vm *VirtualMachine, nic *NIC, group string) error {
+	if _, err := vb.modify(vm, fmt.Sprintf("--nicbandwidthgroup%d", nic.Index), groupOrNone(group)); err != nil {
+		return err
+	}
+	nic.BandwidthGroup = group
+	return nil
+}
+
+func groupOrNone(group string) string {
+	if group == "" {
+		return "none"
+	}
+	return group
+}
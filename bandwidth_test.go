@@ -0,0 +1,80 @@
+package virtualbox
+
+import (
+	"encoding/xml"
+	"reflect"
+	"testing"
+)
+
+func TestLimitArg(t *testing.T) {
+	for bytes, expected := range map[int64]string{
+		0:                 "0M",
+		512:               "1K",
+		100 * kilobyte:    "100K",
+		20 * megabyte:     "20M",
+		1536 * kilobyte:   "1536K",
+		2 * gigabyte:      "2G",
+		1025 * megabyte:   "1025M",
+		kilobyte + 1:      "2K",
+		10 * gigabyte / 8: "1280M",
+	} {
+		if arg := limitArg(bytes); arg != expected {
+			t.Errorf("expected %d to be %s, got %s", bytes, expected, arg)
+		}
+	}
+}
+
+func TestParseBandwidthGroups(t *testing.T) {
+	out := `Name: 'slowdisk', Type: Disk, Limit: 20 Mbytes/sec
+Name: 'wan', Type: Network, Limit: 512 Kbytes/sec
+Name: 'fast', Type: Disk, Limit: 1 Gbytes/sec
+`
+	expected := []BandwidthGroup{
+		{Name: "slowdisk", Type: DiskBandwidth, MaxBytesPerSec: 20 * megabyte},
+		{Name: "wan", Type: NetworkBandwidth, MaxBytesPerSec: 512 * kilobyte},
+		{Name: "fast", Type: DiskBandwidth, MaxBytesPerSec: gigabyte},
+	}
+	if groups := parseBandwidthGroups(out); !reflect.DeepEqual(groups, expected) {
+		t.Errorf("expected %+v, got %+v", expected, groups)
+	}
+}
+
+func TestSettingsBandwidthGroups(t *testing.T) {
+	var settings settingsFile
+	if err := xml.Unmarshal([]byte(`<VirtualBox>
+  <Machine uuid="{6aa44e71-71c6-4e68-a61f-f69e133ecffa}" name="testvm1">
+    <Hardware>
+      <Network>
+        <Adapter slot="0" enabled="true" type="82540EM" bandwidthGroup="wan">
+          <NAT/>
+        </Adapter>
+        <Adapter slot="1" enabled="true" type="82540EM">
+          <NAT/>
+        </Adapter>
+      </Network>
+      <IO>
+        <BandwidthGroups>
+          <BandwidthGroup name="slowdisk" type="Disk" maxBytesPerSec="20971520"/>
+          <BandwidthGroup name="wan" type="Network" maxMbPerSec="2"/>
+        </BandwidthGroups>
+      </IO>
+    </Hardware>
+  </Machine>
+</VirtualBox>`), &settings); err != nil {
+		t.Fatalf("unmarshal failed %v", err)
+	}
+
+	spec := VirtualMachineSpec{NICs: []NIC{{Index: 1}, {Index: 2}}}
+	settings.Machine.applySettings("/vms/testvm1/testvm1.vbox", &spec)
+
+	expected := []BandwidthGroup{
+		{Name: "slowdisk", Type: DiskBandwidth, MaxBytesPerSec: 20 * megabyte},
+		{Name: "wan", Type: NetworkBandwidth, MaxBytesPerSec: 2 * megabyte},
+	}
+	if !reflect.DeepEqual(spec.BandwidthGroups, expected) {
+		t.Errorf("expected %+v, got %+v", expected, spec.BandwidthGroups)
+	}
+	if spec.NICs[0].BandwidthGroup != "wan" || spec.NICs[1].BandwidthGroup != "" {
+		t.Errorf("unexpected nic bandwidth groups %+v", spec.NICs)
+	}
+}
@@ -0,0 +1,180 @@
+package virtualbox
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// BaseImage is a golden disk shared by many vms. It is registered once as immutable or multiattach and every vm
+// it is attached to writes into its own differencing image on top of it
+type BaseImage struct {
+	Disk
+	// Children are the differencing images directly based on the image, one per attachment
+	Children []Disk
+	// VMs are the uuids of the vms using the image or any image derived from it
+	VMs []string
+}
+
+func isBaseImageType(t MediumType) bool {
+	return t == ImmutableMedium || t == MultiattachMedium
+}
+
+// baseImageOf collects the children of base and the vms that depend on it out of the registry media
+func baseImageOf(base Disk, media []Disk) *BaseImage {
+	img := &BaseImage{Disk: base}
+
+	byParent := map[string][]Disk{}
+	for _, d := range media {
+		if d.ParentUUID != "" {
+			byParent[d.ParentUUID] = append(byParent[d.ParentUUID], d)
+		}
+	}
+	img.Children = byParent[base.UUID]
+
+	vms := map[string]bool{}
+	var walk func(d Disk)
+	walk = func(d Disk) {
+		for _, uuid := range d.AttachedVMs {
+			vms[uuid] = true
+		}
+		for _, c := range byParent[d.UUID] {
+			walk(c)
+		}
+	}
+	walk(base)
+
+	for uuid := range vms {
+		img.VMs = append(img.VMs, uuid)
+	}
+	sort.Strings(img.VMs)
+	return img
+}
+
+// RegisterBaseImage registers the disk, if not yet known, and marks it immutable or multiattach
+func (vb *VBox) RegisterBaseImage(ctx context.Context, disk *Disk, mediumType MediumType) (*BaseImage, error) {
+	if !isBaseImageType(mediumType) {
+		return nil, fmt.Errorf("base images must be %s or %s, got %s", ImmutableMedium, MultiattachMedium, mediumType)
+	}
+
+	// showmediuminfo on a path registers the medium as a side effect
+	d, err := vb.DiskInfo(disk)
+	if err != nil {
+		return nil, err
+	}
+	if d.ParentUUID != "" {
+		return nil, fmt.Errorf("disk %s is a differencing image and cannot be a base image", d.UUIDorPath())
+	}
+
+	if d.MediumType != mediumType {
+		if d, err = vb.SetDiskType(d, mediumType); err != nil {
+			return nil, err
+		}
+	}
+	return vb.BaseImageInfo(ctx, d)
+}
+
+// BaseImageInfo returns the base image with its children and the vms depending on it
+func (vb *VBox) BaseImageInfo(ctx context.Context, disk *Disk) (*BaseImage, error) {
+	d, err := vb.DiskInfo(disk)
+	if err != nil {
+		return nil, err
+	}
+	if !isBaseImageType(d.MediumType) {
+		return nil, fmt.Errorf("disk %s is %s and not a base image", d.UUIDorPath(), d.MediumType)
+	}
+
+	media, err := vb.ListMedia(ctx, HDDrive)
+	if err != nil {
+		return nil, err
+	}
+	return baseImageOf(*d, media), nil
+}
+
+// ListBaseImages returns every immutable or multiattach disk of the registry
+func (vb *VBox) ListBaseImages(ctx context.Context) ([]BaseImage, error) {
+	media, err := vb.ListMedia(ctx, HDDrive)
+	if err != nil {
+		return nil, err
+	}
+
+	var images []BaseImage
+	for _, d := range media {
+		if d.ParentUUID == "" && isBaseImageType(d.MediumType) {
+			images = append(images, *baseImageOf(d, media))
+		}
+	}
+	return images, nil
+}
+
+// AttachBaseImage attaches the base image at the given slot of the vm, VirtualBox creates the differencing image
+// the vm writes to
+func (vb *VBox) AttachBaseImage(vm *VirtualMachine, base *BaseImage, slot StorageControllerAttachment) error {
+	disk := Disk{
+		Path:       base.Path,
+		UUID:       base.UUID,
+		Type:       HDDrive,
+		Controller: slot,
+	}
+	return vb.AttachStorage(vm, &disk)
+}
+
+// ResetBaseImageChild throws away everything the vm wrote on top of the base image by replacing its differencing
+// image with a fresh one. The vm must be powered off and must not have snapshots on top of the child
+func (vb *VBox) ResetBaseImageChild(ctx context.Context, vm *VirtualMachine, base *BaseImage) error {
+	img, err := vb.BaseImageInfo(ctx, &base.Disk)
+	if err != nil {
+		return err
+	}
+
+	machine, err := vb.VMInfo(vm.UUIDOrName())
+	if err != nil {
+		return err
+	}
+	switch machine.Spec.State {
+	case Running, Paused, Stuck:
+		return DiskInUseError(fmt.Sprintf("vm %s must be powered off to reset its base image children, it is %s", machine.Spec.Name, machine.Spec.State))
+	}
+
+	children := map[string]bool{}
+	for _, c := range img.Children {
+		children[c.UUID] = true
+	}
+
+	reset := 0
+	for i := range machine.Spec.Disks {
+		slot := &machine.Spec.Disks[i]
+		if !children[slot.UUID] {
+			continue
+		}
+
+		if err := vb.DetachStorage(machine, slot); err != nil {
+			return OperationError{Path: diskSlot(*slot), Op: "detach", Err: err}
+		}
+		if err := vb.DeleteDisk(slot.UUID); err != nil {
+			return OperationError{Path: diskSlot(*slot), Op: "delete", Err: err}
+		}
+		if err := vb.AttachBaseImage(machine, img, slot.Controller); err != nil {
+			return OperationError{Path: diskSlot(*slot), Op: "attach", Err: err}
+		}
+		reset++
+	}
+
+	if reset == 0 {
+		return NotFoundError(fmt.Sprintf("vm %s has no child of base image %s attached", machine.Spec.Name, base.UUIDorPath()))
+	}
+	return nil
+}
+
+// DeleteBaseImage closes and deletes the base image, it refuses to as long as differencing images depend on it
+func (vb *VBox) DeleteBaseImage(ctx context.Context, base *BaseImage) error {
+	img, err := vb.BaseImageInfo(ctx, &base.Disk)
+	if err != nil {
+		return err
+	}
+
+	if len(img.Children) > 0 || len(img.VMs) > 0 {
+		return DiskInUseError(fmt.Sprintf("base image %s still has %d children used by vms %v", img.UUIDorPath(), len(img.Children), img.VMs))
+	}
+	return vb.DeleteDisk(img.UUID)
+}
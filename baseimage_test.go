@@ -0,0 +1,32 @@
+package virtualbox
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBaseImageOf(t *testing.T) {
+	media := []Disk{
+		{UUID: "golden", MediumType: ImmutableMedium},
+		{UUID: "child1", ParentUUID: "golden", AttachedVMs: []string{"vm1"}},
+		{UUID: "child2", ParentUUID: "golden"},
+		{UUID: "snap1", ParentUUID: "child2", AttachedVMs: []string{"vm2"}},
+		{UUID: "other", AttachedVMs: []string{"vm3"}},
+	}
+
+	img := baseImageOf(media[0], media)
+
+	if len(img.Children) != 2 || img.Children[0].UUID != "child1" || img.Children[1].UUID != "child2" {
+		t.Errorf("expected the direct children, got %+v", img.Children)
+	}
+
+	if !reflect.DeepEqual(img.VMs, []string{"vm1", "vm2"}) {
+		t.Errorf("expected vms of all descendants, got %v", img.VMs)
+	}
+}
+
+func TestIsBaseImageType(t *testing.T) {
+	if !isBaseImageType(ImmutableMedium) || !isBaseImageType(MultiattachMedium) || isBaseImageType(NormalMedium) {
+		t.Errorf("only immutable and multiattach media can be base images")
+	}
+}
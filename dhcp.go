@@ -70,34 +70,12 @@ func (vb *VBox) StopDHCPServer(netName string) error {
 }
 
 func (vb *VBox) DHCPInfo(netName string) (*DHCPServer, error) {
-	out, err := vb.manage("list", "dhcpservers")
+	servers, err := vb.ListDHCPServers()
 	if err != nil {
 		return nil, err
 	}
-
-	optionList := make([]([2]string), 0, 20)
-	_ = parseKeyValues(out, reColonLine, func(key, val string) error {
-		optionList = append(optionList, [2]string{key, val})
-		return nil
-	})
-
-	dhcp := &DHCPServer{}
-
-	for i := 0; i < len(optionList); i++ {
-		if optionList[i][0] == "NetworkName" && optionList[i][1] == netName {
-
-			dhcp.NetworkName = (optionList[i][1])
-			dhcp.IPAddress = (optionList[i+1][1])
-			dhcp.LowerIPAddress = (optionList[i+2][1])
-			dhcp.UpperIPAddress = (optionList[i+3][1])
-			dhcp.NetworkMask = (optionList[i+4][1])
-
-			if (optionList[i+5][1]) == "Yes" {
-				dhcp.Enabled = true
-			} else {
-				dhcp.Enabled = false
-			}
-		}
+	if dhcp, ok := servers[netName]; ok {
+		return dhcp, nil
 	}
-	return dhcp, nil
+	return &DHCPServer{}, nil
 }
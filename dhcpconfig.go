@@ -0,0 +1,365 @@
+package virtualbox
+
+import (
+	"bufio"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DHCPOption is the number of a dhcp option, see RFC 2132
+type DHCPOption int
+
+const (
+	DHCPSubnetMask   = DHCPOption(1)
+	DHCPRouters      = DHCPOption(3)
+	DHCPDNSServers   = DHCPOption(6)
+	DHCPDomainName   = DHCPOption(15)
+	DHCPNTPServers   = DHCPOption(42)
+	DHCPDomainSearch = DHCPOption(119)
+)
+
+// DHCPConfig is the configuration the dhcp server hands out to the guests of a scope
+type DHCPConfig struct {
+	// Options are the values of the options by number, lists like DNS servers are comma separated
+	Options map[DHCPOption]string
+	// lease times left at zero keep the default of the enclosing scope
+	MinLeaseTime     time.Duration
+	DefaultLeaseTime time.Duration
+	MaxLeaseTime     time.Duration
+	// FixedAddress is only supported for vm and mac address scopes
+	FixedAddress string
+}
+
+// DHCPConditionType selects what a group condition matches the requests of a guest on
+type DHCPConditionType string
+
+const (
+	DHCPConditionMAC            = DHCPConditionType("mac")
+	DHCPConditionMACWildcard    = DHCPConditionType("mac-wild")
+	DHCPConditionVendor         = DHCPConditionType("vendor")
+	DHCPConditionVendorWildcard = DHCPConditionType("vendor-wild")
+	DHCPConditionUser           = DHCPConditionType("user")
+	DHCPConditionUserWildcard   = DHCPConditionType("user-wild")
+)
+
+// DHCPGroupCondition puts the guests matching it into the group, or keeps them out when Exclude is set
+type DHCPGroupCondition struct {
+	Exclude bool
+	Type    DHCPConditionType
+	Value   string
+}
+
+// DHCPGroupConfig is the configuration of the guests matching the conditions of the group
+type DHCPGroupConfig struct {
+	Name       string
+	Conditions []DHCPGroupCondition
+	DHCPConfig
+}
+
+// DHCPVMConfig is the configuration of a nic of a vm
+type DHCPVMConfig struct {
+	VM  string
+	NIC int
+	DHCPConfig
+}
+
+// DHCPMACConfig is the configuration of the guest with the mac address
+type DHCPMACConfig struct {
+	MAC string
+	DHCPConfig
+}
+
+// DHCPServerConfig holds the scoped configurations of the dhcp server of the network, apart from DHCPServer so
+// that the latter stays comparable
+type DHCPServerConfig struct {
+	NetworkName string
+	Global      DHCPConfig
+	Groups      []DHCPGroupConfig
+	VMConfigs   []DHCPVMConfig
+	MACConfigs  []DHCPMACConfig
+}
+
+// DHCPScope selects the configuration dhcpserver modify changes, see GlobalDHCPScope and the others
+type DHCPScope []string
+
+// GlobalDHCPScope is the configuration of every guest of the dhcp server
+func GlobalDHCPScope() DHCPScope {
+	return DHCPScope{"--global"}
+}
+
+// GroupDHCPScope is the configuration of the guests matching the conditions of the group
+func GroupDHCPScope(group string) DHCPScope {
+	return DHCPScope{"--group=" + group}
+}
+
+// VMDHCPScope is the configuration of the nic with the given index of the vm
+func VMDHCPScope(vm *VirtualMachine, nic int) DHCPScope {
+	return DHCPScope{"--vm=" + vm.UUIDOrName(), fmt.Sprintf("--nic=%d", nic)}
+}
+
+// MACDHCPScope is the configuration of the guest with the mac address, which may be given the way showvminfo
+// reports it, without colons
+func MACDHCPScope(mac string) DHCPScope {
+	return DHCPScope{"--mac-address=" + colonMAC(mac)}
+}
+
+func colonMAC(mac string) string {
+	if len(mac) != 12 || strings.Contains(mac, ":") {
+		return strings.ToLower(mac)
+	}
+	var parts []string
+	for i := 0; i < 12; i += 2 {
+		parts = append(parts, mac[i:i+2])
+	}
+	return strings.ToLower(strings.Join(parts, ":"))
+}
+
+var dhcpConditionArgs = map[DHCPConditionType]string{
+	DHCPConditionMAC:            "mac",
+	DHCPConditionMACWildcard:    "mac-wild",
+	DHCPConditionVendor:         "vendor",
+	DHCPConditionVendorWildcard: "vendor-wild",
+	DHCPConditionUser:           "user",
+	DHCPConditionUserWildcard:   "user-wild",
+}
+
+// dhcpConfigArgs returns the dhcpserver modify options setting the configuration of the current scope
+func dhcpConfigArgs(c DHCPConfig) []string {
+	var args []string
+
+	var options []int
+	for o := range c.Options {
+		options = append(options, int(o))
+	}
+	sort.Ints(options)
+	for _, o := range options {
+		args = append(args, fmt.Sprintf("--set-opt=%d", o), c.Options[DHCPOption(o)])
+	}
+
+	for _, lease := range []struct {
+		option string
+		d      time.Duration
+	}{
+		{"min-lease-time", c.MinLeaseTime},
+		{"default-lease-time", c.DefaultLeaseTime},
+		{"max-lease-time", c.MaxLeaseTime},
+	} {
+		if lease.d != 0 {
+			args = append(args, fmt.Sprintf("--%s=%d", lease.option, int(lease.d/time.Second)))
+		}
+	}
+
+	if c.FixedAddress != "" {
+		args = append(args, "--fixed-address="+c.FixedAddress)
+	}
+	return args
+}
+
+// dhcpConditionsArgs returns the options replacing the conditions of the current group scope
+func dhcpConditionsArgs(conditions []DHCPGroupCondition) ([]string, error) {
+	args := []string{"--zap-conditions"}
+	for _, c := range conditions {
+		arg, ok := dhcpConditionArgs[c.Type]
+		if !ok {
+			return nil, fmt.Errorf("unknown dhcp group condition type %s", c.Type)
+		}
+		prefix := "--incl-"
+		if c.Exclude {
+			prefix = "--excl-"
+		}
+		args = append(args, prefix+arg+"="+c.Value)
+	}
+	return args, nil
+}
+
+func (vb *VBox) modifyDHCPServer(netName string, scope DHCPScope, args ...string) error {
+	cmd := append([]string{"dhcpserver", "modify", "--netname", netName}, scope...)
+	_, err := vb.manage(append(cmd, args...)...)
+	return err
+}
+
+// SetDHCPConfig sets the options, lease times and fixed address of the scope of the dhcp server of the network.
+// Options not mentioned are left as they are
+func (vb *VBox) SetDHCPConfig(netName string, scope DHCPScope, config DHCPConfig) error {
+	args := dhcpConfigArgs(config)
+	if len(args) == 0 {
+		return nil
+	}
+	return vb.modifyDHCPServer(netName, scope, args...)
+}
+
+// DeleteDHCPOptions removes the options from the scope of the dhcp server of the network
+func (vb *VBox) DeleteDHCPOptions(netName string, scope DHCPScope, options ...DHCPOption) error {
+	if len(options) == 0 {
+		return nil
+	}
+	var args []string
+	for _, o := range options {
+		args = append(args, fmt.Sprintf("--del-opt=%d", o))
+	}
+	return vb.modifyDHCPServer(netName, scope, args...)
+}
+
+// SetDHCPGroup replaces the conditions of the group and sets its configuration, creating the group as needed
+func (vb *VBox) SetDHCPGroup(netName string, group DHCPGroupConfig) error {
+	args, err := dhcpConditionsArgs(group.Conditions)
+	if err != nil {
+		return err
+	}
+	return vb.modifyDHCPServer(netName, GroupDHCPScope(group.Name), append(args, dhcpConfigArgs(group.DHCPConfig)...)...)
+}
+
+// RemoveDHCPConfig removes the configuration of the group, vm or mac address scope altogether
+func (vb *VBox) RemoveDHCPConfig(netName string, scope DHCPScope) error {
+	return vb.modifyDHCPServer(netName, scope, "--remove-config")
+}
+
+// parses the option lines of a scope like the following
+//
+//	6/legacy: 8.8.8.8,8.8.4.4
+var reDHCPOptionLine = regexp.MustCompile(`^(\d+)/(\w+):\s*(.*)$`)
+
+// like reColonLine, but scope headers such as "Global Configuration:" have nothing after the colon
+var reDHCPLine = regexp.MustCompile(`^([^:]+):\s*(.*)$`)
+
+// parses the scope headers of individual configs like the following
+//
+//	Individual Config: VM 'vm01' NIC 1
+//	Individual Config: MAC Address 08:00:27:aa:bb:cc
+var reDHCPIndividual = regexp.MustCompile(`^(?:VM '(.*)' NIC (\d+)|MAC Address (\S+))$`)
+
+var dhcpConditionNames = map[string]DHCPConditionType{
+	"MAC":        DHCPConditionMAC,
+	"MAC*":       DHCPConditionMACWildcard,
+	"VendorCID":  DHCPConditionVendor,
+	"VendorCID*": DHCPConditionVendorWildcard,
+	"UserCID":    DHCPConditionUser,
+	"UserCID*":   DHCPConditionUserWildcard,
+}
+
+func parseLeaseTime(val string) time.Duration {
+	secs, err := strconv.Atoi(strings.TrimSuffix(val, " sec"))
+	if err != nil {
+		return 0
+	}
+	return time.Duration(secs) * time.Second
+}
+
+// ListDHCPServerConfigs returns the scoped configurations of the dhcp servers by network name
+func (vb *VBox) ListDHCPServerConfigs() (map[string]*DHCPServerConfig, error) {
+	out, err := vb.manage("list", "dhcpservers")
+	if err != nil {
+		return nil, err
+	}
+	_, configs := parseDHCPServers(out)
+	return configs, nil
+}
+
+// parseDHCPServers parses list dhcpservers, releases since 6.1 follow each server with its global, group and
+// individual configurations, older ones only list the addresses and get empty configurations
+func parseDHCPServers(out string) (map[string]*DHCPServer, map[string]*DHCPServerConfig) {
+	servers := map[string]*DHCPServer{}
+	configs := map[string]*DHCPServerConfig{}
+
+	var server *DHCPServer
+	var scopes *DHCPServerConfig
+	var config *DHCPConfig
+	var group *DHCPGroupConfig
+
+	s := bufio.NewScanner(strings.NewReader(out))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if m := reDHCPOptionLine.FindStringSubmatch(line); m != nil && config != nil {
+			o, _ := strconv.Atoi(m[1])
+			if config.Options == nil {
+				config.Options = map[DHCPOption]string{}
+			}
+			config.Options[DHCPOption(o)] = m[3]
+			continue
+		}
+
+		res := reDHCPLine.FindStringSubmatch(line)
+		if res == nil {
+			continue
+		}
+		key, val := strings.TrimSpace(res[1]), strings.TrimSpace(res[2])
+		if key == "NetworkName" {
+			server = &DHCPServer{NetworkName: val}
+			servers[val] = server
+			scopes = &DHCPServerConfig{NetworkName: val}
+			configs[val] = scopes
+			config, group = nil, nil
+			continue
+		}
+		if server == nil {
+			continue
+		}
+
+		switch key {
+		case "IP", "Dhcpd IP":
+			server.IPAddress = val
+		case "upperIPAddress", "UpperIPAddress":
+			server.UpperIPAddress = val
+		case "lowerIPAddress", "LowerIPAddress":
+			server.LowerIPAddress = val
+		case "NetworkMask":
+			server.NetworkMask = val
+		case "Enabled":
+			server.Enabled = val == "Yes"
+		case "Global Configuration", "Global Config":
+			config, group = &scopes.Global, nil
+		case "Group", "Group Name":
+			scopes.Groups = append(scopes.Groups, DHCPGroupConfig{Name: val})
+			group = &scopes.Groups[len(scopes.Groups)-1]
+			config = &group.DHCPConfig
+		case "Conditions":
+			// include MAC 08:00:27:aa:bb:cc
+			fields := strings.Fields(val)
+			if group == nil || len(fields) < 3 {
+				continue
+			}
+			if t, ok := dhcpConditionNames[fields[1]]; ok {
+				group.Conditions = append(group.Conditions, DHCPGroupCondition{
+					Exclude: fields[0] == "exclude",
+					Type:    t,
+					Value:   strings.Join(fields[2:], " "),
+				})
+			}
+		case "Individual Config":
+			group = nil
+			m := reDHCPIndividual.FindStringSubmatch(val)
+			switch {
+			case m == nil:
+				config = nil
+			case m[3] != "":
+				scopes.MACConfigs = append(scopes.MACConfigs, DHCPMACConfig{MAC: m[3]})
+				config = &scopes.MACConfigs[len(scopes.MACConfigs)-1].DHCPConfig
+			default:
+				nic, _ := strconv.Atoi(m[2])
+				scopes.VMConfigs = append(scopes.VMConfigs, DHCPVMConfig{VM: m[1], NIC: nic})
+				config = &scopes.VMConfigs[len(scopes.VMConfigs)-1].DHCPConfig
+			}
+		case "minLeaseTime":
+			if config != nil {
+				config.MinLeaseTime = parseLeaseTime(val)
+			}
+		case "defaultLeaseTime":
+			if config != nil {
+				config.DefaultLeaseTime = parseLeaseTime(val)
+			}
+		case "maxLeaseTime":
+			if config != nil {
+				config.MaxLeaseTime = parseLeaseTime(val)
+			}
+		case "Fixed Address":
+			if config != nil {
+				config.FixedAddress = val
+			}
+		}
+	}
+	return servers, configs
+}
@@ -0,0 +1,147 @@
+package virtualbox
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+const dhcpServersList = `NetworkName:    HostInterfaceNetworking-vboxnet0
+Dhcpd IP:       192.168.56.2
+LowerIPAddress: 192.168.56.3
+UpperIPAddress: 192.168.56.254
+NetworkMask:    255.255.255.0
+Enabled:        Yes
+Global Configuration:
+    minLeaseTime:     default
+    defaultLeaseTime: 600 sec
+    maxLeaseTime:     default
+    Forced options:   None
+    Suppressed opts.: None
+        1/legacy: 255.255.255.0
+        6/legacy: 8.8.8.8,8.8.4.4
+Group:              pxe
+    Conditions:       include VendorCID* PXEClient*
+    Conditions:       exclude MAC 08:00:27:00:00:01
+    minLeaseTime:     default
+    defaultLeaseTime: default
+    maxLeaseTime:     60 sec
+    Forced options:   None
+    Suppressed opts.: None
+       67/legacy: pxelinux.0
+Individual Config:  VM 'vm01' NIC 1
+    minLeaseTime:     default
+    defaultLeaseTime: default
+    maxLeaseTime:     default
+    Fixed Address:    192.168.56.10
+    Forced options:   None
+    Suppressed opts.: None
+Individual Config:  MAC Address 08:00:27:aa:bb:cc
+    minLeaseTime:     default
+    defaultLeaseTime: default
+    maxLeaseTime:     default
+    Fixed Address:    192.168.56.11
+    Forced options:   None
+    Suppressed opts.: None
+       15/legacy: lab.local
+
+NetworkName:    NatNetwork
+IP:             10.0.2.3
+lowerIPAddress: 10.0.2.4
+upperIPAddress: 10.0.2.254
+NetworkMask:    255.255.255.0
+Enabled:        No
+`
+
+func TestParseDHCPServers(t *testing.T) {
+	servers, configs := parseDHCPServers(dhcpServersList)
+	if len(servers) != 2 {
+		t.Fatalf("expected 2 dhcp servers, got %d", len(servers))
+	}
+
+	expected := DHCPServer{
+		NetworkName:    "HostInterfaceNetworking-vboxnet0",
+		IPAddress:      "192.168.56.2",
+		LowerIPAddress: "192.168.56.3",
+		UpperIPAddress: "192.168.56.254",
+		NetworkMask:    "255.255.255.0",
+		Enabled:        true,
+	}
+	if got := servers[expected.NetworkName]; *got != expected {
+		t.Errorf("expected %+v, got %+v", expected, *got)
+	}
+
+	expectedConfig := DHCPServerConfig{
+		NetworkName: "HostInterfaceNetworking-vboxnet0",
+		Global: DHCPConfig{
+			Options:          map[DHCPOption]string{DHCPSubnetMask: "255.255.255.0", DHCPDNSServers: "8.8.8.8,8.8.4.4"},
+			DefaultLeaseTime: 10 * time.Minute,
+		},
+		Groups: []DHCPGroupConfig{{
+			Name: "pxe",
+			Conditions: []DHCPGroupCondition{
+				{Type: DHCPConditionVendorWildcard, Value: "PXEClient*"},
+				{Exclude: true, Type: DHCPConditionMAC, Value: "08:00:27:00:00:01"},
+			},
+			DHCPConfig: DHCPConfig{Options: map[DHCPOption]string{67: "pxelinux.0"}, MaxLeaseTime: time.Minute},
+		}},
+		VMConfigs: []DHCPVMConfig{{VM: "vm01", NIC: 1, DHCPConfig: DHCPConfig{FixedAddress: "192.168.56.10"}}},
+		MACConfigs: []DHCPMACConfig{{
+			MAC:        "08:00:27:aa:bb:cc",
+			DHCPConfig: DHCPConfig{FixedAddress: "192.168.56.11", Options: map[DHCPOption]string{DHCPDomainName: "lab.local"}},
+		}},
+	}
+	if got := configs[expectedConfig.NetworkName]; !reflect.DeepEqual(*got, expectedConfig) {
+		t.Errorf("expected %+v, got %+v", expectedConfig, *got)
+	}
+
+	nat := servers["NatNetwork"]
+	if nat == nil || nat.IPAddress != "10.0.2.3" || nat.LowerIPAddress != "10.0.2.4" || nat.Enabled {
+		t.Errorf("unexpected nat network dhcp server %+v", nat)
+	}
+}
+
+func TestDHCPConfigArgs(t *testing.T) {
+	args := dhcpConfigArgs(DHCPConfig{
+		Options:      map[DHCPOption]string{DHCPRouters: "192.168.56.1", DHCPDNSServers: "1.1.1.1"},
+		MinLeaseTime: 5 * time.Minute,
+		FixedAddress: "192.168.56.10",
+	})
+	expected := []string{"--set-opt=3", "192.168.56.1", "--set-opt=6", "1.1.1.1", "--min-lease-time=300",
+		"--fixed-address=192.168.56.10"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("expected %v, got %v", expected, args)
+	}
+
+	if args := dhcpConfigArgs(DHCPConfig{}); len(args) != 0 {
+		t.Errorf("expected no args for an empty config, got %v", args)
+	}
+}
+
+func TestDHCPConditionsArgs(t *testing.T) {
+	args, err := dhcpConditionsArgs([]DHCPGroupCondition{
+		{Type: DHCPConditionMAC, Value: "08:00:27:aa:bb:cc"},
+		{Exclude: true, Type: DHCPConditionUserWildcard, Value: "test*"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"--zap-conditions", "--incl-mac=08:00:27:aa:bb:cc", "--excl-user-wild=test*"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("expected %v, got %v", expected, args)
+	}
+
+	if _, err := dhcpConditionsArgs([]DHCPGroupCondition{{Type: "hostname"}}); err == nil {
+		t.Errorf("expected an error for an unknown condition type")
+	}
+}
+
+func TestDHCPScopes(t *testing.T) {
+	if scope := MACDHCPScope("080027AABBCC"); !reflect.DeepEqual(scope, DHCPScope{"--mac-address=08:00:27:aa:bb:cc"}) {
+		t.Errorf("unexpected mac scope %v", scope)
+	}
+	vm := &VirtualMachine{Spec: VirtualMachineSpec{Name: "vm01"}}
+	if scope := VMDHCPScope(vm, 2); !reflect.DeepEqual(scope, DHCPScope{"--vm=vm01", "--nic=2"}) {
+		t.Errorf("unexpected vm scope %v", scope)
+	}
+}
@@ -0,0 +1,300 @@
+package virtualbox
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// dhcpLeasesSuffix follows the network name of the dhcp server in the name of its lease file
+const dhcpLeasesSuffix = "-Dhcpd.leases"
+
+// DHCPLeaseState is the state of a lease as kept by the dhcp server
+type DHCPLeaseState string
+
+const (
+	LeaseFree     = DHCPLeaseState("free")
+	LeaseOffered  = DHCPLeaseState("offered")
+	LeaseAcked    = DHCPLeaseState("acked")
+	LeaseReleased = DHCPLeaseState("released")
+)
+
+// DHCPLease is an address the dhcp server of a network handed out to the guest with the mac address
+type DHCPLease struct {
+	// MAC is in the colon separated form of the lease file, for e.g 08:00:27:aa:bb:cc
+	MAC       string
+	IPAddress string
+	State     DHCPLeaseState
+	Issued    time.Time
+	Expires   time.Time
+}
+
+// Active tells whether the guest holds the address at the given time
+func (l DHCPLease) Active(now time.Time) bool {
+	return l.State == LeaseAcked && now.Before(l.Expires)
+}
+
+type settingsLeases struct {
+	Leases []struct {
+		MAC     string `xml:"mac,attr"`
+		State   string `xml:"state,attr"`
+		Address struct {
+			Value string `xml:"value,attr"`
+		} `xml:"Address"`
+		Time struct {
+			Issued     string `xml:"issued,attr"`
+			Expiration string `xml:"expiration,attr"`
+		} `xml:"Time"`
+	} `xml:"Lease"`
+}
+
+// parseDHCPLeases parses a lease file, the server writes the issue time in seconds since the epoch and the
+// expiration in seconds after it. Files of releases before 6.1 have no state, their leases count as acked
+func parseDHCPLeases(data []byte) ([]DHCPLease, error) {
+	var settings settingsLeases
+	if err := xml.Unmarshal(data, &settings); err != nil {
+		return nil, err
+	}
+
+	var leases []DHCPLease
+	for _, l := range settings.Leases {
+		issued, _ := strconv.ParseInt(l.Time.Issued, 10, 64)
+		expiration, _ := strconv.ParseInt(l.Time.Expiration, 10, 64)
+		state := DHCPLeaseState(l.State)
+		if state == "" {
+			state = LeaseAcked
+		}
+		leases = append(leases, DHCPLease{
+			MAC:       strings.ToLower(l.MAC),
+			IPAddress: l.Address.Value,
+			State:     state,
+			Issued:    time.Unix(issued, 0),
+			Expires:   time.Unix(issued+expiration, 0),
+		})
+	}
+	return leases, nil
+}
+
+// defaultVirtualBoxHome returns where VirtualBox keeps its global settings and the lease files when
+// Config.VirtualBoxHome is empty, $VBOX_USER_HOME if set
+func defaultVirtualBoxHome() string {
+	if home := os.Getenv("VBOX_USER_HOME"); home != "" {
+		return home
+	}
+	u, err := user.Current()
+	if err != nil {
+		return ""
+	}
+
+	switch runtime.GOOS {
+	case "darwin":
+		return filepath.Join(u.HomeDir, "Library", "VirtualBox")
+	case "windows":
+		return filepath.Join(u.HomeDir, ".VirtualBox")
+	}
+	// releases before 4.3 used ~/.VirtualBox on linux as well
+	home := filepath.Join(u.HomeDir, ".config", "VirtualBox")
+	if _, err := os.Stat(home); os.IsNotExist(err) {
+		if _, err := os.Stat(filepath.Join(u.HomeDir, ".VirtualBox")); err == nil {
+			return filepath.Join(u.HomeDir, ".VirtualBox")
+		}
+	}
+	return home
+}
+
+func (vb *VBox) virtualBoxHome() string {
+	if vb.Config.VirtualBoxHome != "" {
+		return vb.Config.VirtualBoxHome
+	}
+	return defaultVirtualBoxHome()
+}
+
+// DHCPLeases returns the leases of the dhcp server of the network, by the NetworkName of its DHCPServer. A server
+// that has not run yet has no leases
+func (vb *VBox) DHCPLeases(netName string) ([]DHCPLease, error) {
+	data, err := ioutil.ReadFile(filepath.Join(vb.virtualBoxHome(), netName+dhcpLeasesSuffix))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	leases, err := parseDHCPLeases(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse leases of %s: %v", netName, err)
+	}
+	return leases, nil
+}
+
+// leaseNetworks returns the names of the networks with a lease file
+func (vb *VBox) leaseNetworks() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(vb.virtualBoxHome(), "*"+dhcpLeasesSuffix))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, strings.TrimSuffix(filepath.Base(f), dhcpLeasesSuffix))
+	}
+	return names, nil
+}
+
+// activeAddresses returns the address of every nic with an active lease, by nic index. When a mac address holds
+// leases on several networks the one issued last wins
+func activeAddresses(nics []NIC, leases []DHCPLease, now time.Time) map[int]string {
+	addrs := map[int]string{}
+	issued := map[int]time.Time{}
+	for _, nic := range nics {
+		if nic.MAC == "" {
+			continue
+		}
+		mac := colonMAC(nic.MAC)
+		for _, l := range leases {
+			if l.MAC == mac && l.Active(now) && !l.Issued.Before(issued[nic.Index]) {
+				addrs[nic.Index], issued[nic.Index] = l.IPAddress, l.Issued
+			}
+		}
+	}
+	return addrs
+}
+
+// NICAddresses looks up the ipv4 addresses the dhcp servers of VirtualBox leased to the nics of the vm, by nic
+// index. Nics on nat, bridged or statically configured networks get no lease and are left out
+func (vb *VBox) NICAddresses(vm *VirtualMachine) (map[int]string, error) {
+	machine, err := vb.VMInfo(vm.UUIDOrName())
+	if err != nil {
+		return nil, err
+	}
+
+	names, err := vb.leaseNetworks()
+	if err != nil {
+		return nil, err
+	}
+	var leases []DHCPLease
+	for _, name := range names {
+		l, err := vb.DHCPLeases(name)
+		if err != nil {
+			return nil, err
+		}
+		leases = append(leases, l...)
+	}
+	return activeAddresses(machine.Spec.NICs, leases, time.Now()), nil
+}
+
+// DHCPLeaseEventType tells how a lease changed between two reads of the lease file
+type DHCPLeaseEventType string
+
+const (
+	LeaseAdded   = DHCPLeaseEventType("added")
+	LeaseChanged = DHCPLeaseEventType("changed")
+	LeaseRemoved = DHCPLeaseEventType("removed")
+)
+
+// DHCPLeaseEvent is sent by WatchDHCPLeases, Lease is the lease as it was before its removal for LeaseRemoved
+type DHCPLeaseEvent struct {
+	Type        DHCPLeaseEventType
+	NetworkName string
+	Lease       DHCPLease
+}
+
+// diffLeases returns the events turning the old leases of the network into the new ones, by mac address
+func diffLeases(netName string, old, new []DHCPLease) []DHCPLeaseEvent {
+	before := map[string]DHCPLease{}
+	for _, l := range old {
+		before[l.MAC] = l
+	}
+
+	var events []DHCPLeaseEvent
+	seen := map[string]bool{}
+	for _, l := range new {
+		seen[l.MAC] = true
+		prev, ok := before[l.MAC]
+		switch {
+		case !ok:
+			events = append(events, DHCPLeaseEvent{Type: LeaseAdded, NetworkName: netName, Lease: l})
+		case prev != l:
+			events = append(events, DHCPLeaseEvent{Type: LeaseChanged, NetworkName: netName, Lease: l})
+		}
+	}
+
+	var removed []string
+	for mac := range before {
+		if !seen[mac] {
+			removed = append(removed, mac)
+		}
+	}
+	sort.Strings(removed)
+	for _, mac := range removed {
+		events = append(events, DHCPLeaseEvent{Type: LeaseRemoved, NetworkName: netName, Lease: before[mac]})
+	}
+	return events
+}
+
+// WatchDHCPLeases reads the lease files of the networks every interval and sends an event for each lease added,
+// changed or removed since the last read, starting with the leases already there. Without network names it
+// watches every network with a lease file, including those that show up later. An interval that is not positive
+// means a second. The channel is closed once the context is done
+func (vb *VBox) WatchDHCPLeases(ctx context.Context, interval time.Duration, netNames ...string) <-chan DHCPLeaseEvent {
+	events := make(chan DHCPLeaseEvent)
+	interval = pollInterval(interval)
+
+	go func() {
+		defer close(events)
+
+		known := map[string][]DHCPLease{}
+		for {
+			names := netNames
+			if len(names) == 0 {
+				var err error
+				if names, err = vb.leaseNetworks(); err != nil {
+					glog.V(4).Infof("failed to list dhcp lease files: %v", err)
+				}
+				// networks whose lease file went away lose their leases
+				listed := map[string]bool{}
+				for _, name := range names {
+					listed[name] = true
+				}
+				for name := range known {
+					if !listed[name] {
+						names = append(names, name)
+					}
+				}
+			}
+
+			for _, name := range names {
+				leases, err := vb.DHCPLeases(name)
+				if err != nil {
+					// the server may be writing the file, try again next time
+					glog.V(4).Infof("failed to read dhcp leases of %s: %v", name, err)
+					continue
+				}
+				for _, e := range diffLeases(name, known[name], leases) {
+					select {
+					case events <- e:
+					case <-ctx.Done():
+						return
+					}
+				}
+				known[name] = leases
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+		}
+	}()
+	return events
+}
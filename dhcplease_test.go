@@ -0,0 +1,146 @@
+package virtualbox
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const dhcpLeasesFile = `<?xml version="1.0"?>
+<Leases version="1.0">
+  <Lease mac="08:00:27:AA:BB:CC" id="01080027aabbcc" network="0.0.0.0" state="acked">
+    <Address value="192.168.56.101"/>
+    <Time issued="1600000000" expiration="600"/>
+  </Lease>
+  <Lease mac="08:00:27:00:00:01" network="0.0.0.0" state="released">
+    <Address value="192.168.56.102"/>
+    <Time issued="1600000100" expiration="600"/>
+  </Lease>
+</Leases>
+`
+
+func TestParseDHCPLeases(t *testing.T) {
+	leases, err := parseDHCPLeases([]byte(dhcpLeasesFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []DHCPLease{
+		{MAC: "08:00:27:aa:bb:cc", IPAddress: "192.168.56.101", State: LeaseAcked,
+			Issued: time.Unix(1600000000, 0), Expires: time.Unix(1600000600, 0)},
+		{MAC: "08:00:27:00:00:01", IPAddress: "192.168.56.102", State: LeaseReleased,
+			Issued: time.Unix(1600000100, 0), Expires: time.Unix(1600000700, 0)},
+	}
+	if !reflect.DeepEqual(leases, expected) {
+		t.Errorf("expected %+v, got %+v", expected, leases)
+	}
+
+	if !leases[0].Active(time.Unix(1600000300, 0)) || leases[0].Active(time.Unix(1600000600, 0)) {
+		t.Errorf("expected the lease to be active until it expires")
+	}
+	if leases[1].Active(time.Unix(1600000300, 0)) {
+		t.Errorf("expected a released lease to be inactive")
+	}
+
+	if _, err := parseDHCPLeases([]byte("<Leases>")); err == nil {
+		t.Errorf("expected an error for a truncated lease file")
+	}
+}
+
+func TestActiveAddresses(t *testing.T) {
+	now := time.Unix(1600000300, 0)
+	leases := []DHCPLease{
+		{MAC: "08:00:27:aa:bb:cc", IPAddress: "192.168.56.101", State: LeaseAcked, Issued: time.Unix(1600000000, 0), Expires: time.Unix(1600000600, 0)},
+		{MAC: "08:00:27:aa:bb:cc", IPAddress: "10.0.0.5", State: LeaseAcked, Issued: time.Unix(1600000200, 0), Expires: time.Unix(1600000800, 0)},
+		{MAC: "08:00:27:00:00:01", IPAddress: "192.168.56.102", State: LeaseAcked, Issued: time.Unix(1500000000, 0), Expires: time.Unix(1500000600, 0)},
+	}
+	nics := []NIC{{Index: 1, MAC: "080027AABBCC"}, {Index: 2, MAC: "080027000001"}, {Index: 3}}
+
+	addrs := activeAddresses(nics, leases, now)
+	if !reflect.DeepEqual(addrs, map[int]string{1: "10.0.0.5"}) {
+		t.Errorf("unexpected addresses %v", addrs)
+	}
+}
+
+func TestDiffLeases(t *testing.T) {
+	a := DHCPLease{MAC: "08:00:27:aa:bb:cc", IPAddress: "192.168.56.101", State: LeaseOffered}
+	b := DHCPLease{MAC: "08:00:27:00:00:01", IPAddress: "192.168.56.102", State: LeaseAcked}
+	acked := a
+	acked.State = LeaseAcked
+	c := DHCPLease{MAC: "08:00:27:00:00:02", IPAddress: "192.168.56.103", State: LeaseAcked}
+
+	events := diffLeases("net", []DHCPLease{a, b}, []DHCPLease{acked, c})
+	expected := []DHCPLeaseEvent{
+		{Type: LeaseChanged, NetworkName: "net", Lease: acked},
+		{Type: LeaseAdded, NetworkName: "net", Lease: c},
+		{Type: LeaseRemoved, NetworkName: "net", Lease: b},
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("expected %+v, got %+v", expected, events)
+	}
+
+	if events := diffLeases("net", []DHCPLease{a}, []DHCPLease{a}); len(events) != 0 {
+		t.Errorf("expected no events for unchanged leases, got %+v", events)
+	}
+}
+
+func TestPollInterval(t *testing.T) {
+	for interval, expected := range map[time.Duration]time.Duration{
+		-time.Second:          defaultPollInterval,
+		0:                     defaultPollInterval,
+		10 * time.Millisecond: 10 * time.Millisecond,
+	} {
+		if got := pollInterval(interval); got != expected {
+			t.Errorf("expected %s for %s, got %s", expected, interval, got)
+		}
+	}
+}
+
+func TestWatchDHCPLeases(t *testing.T) {
+	dir, err := ioutil.TempDir("", "leases")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	vb := NewVBox(Config{BasePath: dir, VirtualBoxHome: dir})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := vb.WatchDHCPLeases(ctx, 10*time.Millisecond)
+
+	file := filepath.Join(dir, "HostInterfaceNetworking-vboxnet0"+dhcpLeasesSuffix)
+	if err := ioutil.WriteFile(file, []byte(dhcpLeasesFile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, mac := range []string{"08:00:27:aa:bb:cc", "08:00:27:00:00:01"} {
+		select {
+		case e := <-events:
+			if e.Type != LeaseAdded || e.NetworkName != "HostInterfaceNetworking-vboxnet0" || e.Lease.MAC != mac {
+				t.Errorf("unexpected event %+v", e)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no event for %s", mac)
+		}
+	}
+
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case e := <-events:
+			if e.Type != LeaseRemoved {
+				t.Errorf("unexpected event %+v", e)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no removal event")
+		}
+	}
+
+	cancel()
+	for range events {
+	}
+}
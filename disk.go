@@ -1,8 +1,11 @@
 package virtualbox
 
 import (
+	"bufio"
 	"context"
 	"fmt"
+	"regexp"
+	"strconv"
 	"strings"
 )
 
@@ -12,8 +15,47 @@ const (
 	VDI  = DiskFormat("VDI")
 	VMDK = DiskFormat("VMDK")
 	VHD  = DiskFormat("VHD")
+	// QCOW and RAW are only read when importing images, VirtualBox does not create them
+	QCOW = DiskFormat("QCOW")
+	RAW  = DiskFormat("RAW")
 )
 
+// DiskVariant selects how the image file is laid out, variants can be combined where the format allows it
+type DiskVariant string
+
+const (
+	Standard = DiskVariant("Standard")
+	Fixed    = DiskVariant("Fixed")
+	Split2G  = DiskVariant("Split2G")
+	Stream   = DiskVariant("Stream")
+	ESX      = DiskVariant("ESX")
+)
+
+// MediumType controls how a medium behaves when attached to vms and when snapshots are taken
+type MediumType string
+
+const (
+	NormalMedium       = MediumType("normal")
+	ImmutableMedium    = MediumType("immutable")
+	WritethroughMedium = MediumType("writethrough")
+	ShareableMedium    = MediumType("shareable")
+	ReadonlyMedium     = MediumType("readonly")
+	MultiattachMedium  = MediumType("multiattach")
+)
+
+// MediumState is the state of a medium in the VirtualBox media registry
+type MediumState string
+
+const (
+	MediumCreated      = MediumState("created")
+	MediumInaccessible = MediumState("inaccessible")
+	MediumLockedRead   = MediumState("locked read")
+	MediumLockedWrite  = MediumState("locked write")
+)
+
+var reInUseByVM = regexp.MustCompile(`^\s*(?:In use by VMs:)?\s*.+? \(UUID: ([0-9a-fA-F-]+)\)`)
+var reCapacityMB = regexp.MustCompile(`^(\d+) MBytes`)
+
 type DiskNotFoundError string
 
 func (d DiskNotFoundError) Error() string {
@@ -25,6 +67,18 @@ func IsDiskNotFound(err error) bool {
 	return ok
 }
 
+// DiskInUseError is returned for operations that are not safe while a running vm uses the medium
+type DiskInUseError string
+
+func (d DiskInUseError) Error() string {
+	return string(d)
+}
+
+func IsDiskInUse(err error) bool {
+	_, ok := err.(DiskInUseError)
+	return ok
+}
+
 func (vb *VBox) EnsureDisk(context context.Context, disk *Disk) (*Disk, error) {
 	d, err := vb.DiskInfo(disk)
 	if IsDiskNotFound(err) {
@@ -63,6 +117,21 @@ func (vb *VBox) DiskInfo(disk *Disk) (*Disk, error) {
 		return nil, err
 	}
 
+	ndisk := parseMediumInfo(out)
+	ndisk.Type = disk.Type
+	ndisk.Controller = disk.Controller
+	ndisk.NonRotational = disk.NonRotational
+	ndisk.AutoDiscard = disk.AutoDiscard
+
+	if ndisk.UUID == "" {
+		return &ndisk, DiskNotFoundError(disk.UUIDorPath())
+	}
+
+	return &ndisk, nil
+}
+
+// parseMediumInfo reads the medium details out of showmediuminfo output
+func parseMediumInfo(out string) Disk {
 	var ndisk Disk
 	_ = parseKeyValues(out, reColonLine, func(key, val string) error {
 		switch key {
@@ -72,16 +141,186 @@ func (vb *VBox) DiskInfo(disk *Disk) (*Disk, error) {
 			ndisk.Path = val
 		case "Storage format":
 			ndisk.Format = DiskFormat(val)
+		case "Parent UUID":
+			if val != "base" {
+				ndisk.ParentUUID = val
+			}
+		case "State":
+			ndisk.State = MediumState(val)
+		case "Description":
+			ndisk.Comment = val
+		case "Encryption":
+			ndisk.Encrypted = val == "enabled"
+		case "Property":
+			if strings.HasPrefix(val, "CRYPT/KeyId=") {
+				ndisk.EncryptionKeyID = strings.TrimPrefix(val, "CRYPT/KeyId=")
+			}
+		case "Type":
+			if fields := strings.Fields(val); len(fields) > 0 {
+				ndisk.MediumType = MediumType(fields[0])
+			}
+		case "Capacity":
+			if m := reCapacityMB.FindStringSubmatch(val); m != nil {
+				ndisk.SizeMB, _ = strconv.ParseInt(m[1], 10, 64)
+			}
 		}
 
 		return nil
 	})
 
-	if ndisk.UUID == "" {
-		return &ndisk, DiskNotFoundError(disk.UUIDorPath())
+	// vms are listed one per line, only the first one carries the key
+	s := bufio.NewScanner(strings.NewReader(out))
+	inUse := false
+	for s.Scan() {
+		line := s.Text()
+		if strings.HasPrefix(line, "In use by VMs:") {
+			inUse = true
+		} else if !strings.HasPrefix(line, " ") {
+			inUse = false
+		}
+		if !inUse {
+			continue
+		}
+		if m := reInUseByVM.FindStringSubmatch(line); m != nil {
+			ndisk.AttachedVMs = append(ndisk.AttachedVMs, m[1])
+		}
 	}
 
-	return &ndisk, nil
+	return ndisk
+}
+
+// ensureNotInUse refreshes the disk and fails when one of the vms using it is running
+func (vb *VBox) ensureNotInUse(disk *Disk) (*Disk, error) {
+	d, err := vb.DiskInfo(disk)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, uuid := range d.AttachedVMs {
+		state, err := vb.State(&VirtualMachine{UUID: uuid})
+		if err != nil {
+			return nil, err
+		}
+		switch state {
+		case Running, Paused, Stuck:
+			return nil, DiskInUseError(fmt.Sprintf("disk %s is attached to vm %s which is %s", d.UUIDorPath(), uuid, state))
+		}
+	}
+	return d, nil
+}
+
+// ResizeDisk grows the disk to sizeMB, VirtualBox cannot shrink disks
+func (vb *VBox) ResizeDisk(disk *Disk, sizeMB int64) (*Disk, error) {
+	d, err := vb.ensureNotInUse(disk)
+	if err != nil {
+		return nil, err
+	}
+	if sizeMB < d.SizeMB {
+		return nil, fmt.Errorf("cannot shrink disk %s from %dMB to %dMB", d.UUIDorPath(), d.SizeMB, sizeMB)
+	}
+
+	if _, err := vb.manage("modifymedium", "disk", d.UUID, "--resize", strconv.FormatInt(sizeMB, 10)); err != nil {
+		return nil, err
+	}
+	return vb.DiskInfo(disk)
+}
+
+// CompactDisk reclaims the blocks of a dynamically allocated disk that the guest zeroed out
+func (vb *VBox) CompactDisk(disk *Disk) (*Disk, error) {
+	d, err := vb.ensureNotInUse(disk)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := vb.manage("modifymedium", "disk", d.UUID, "--compact"); err != nil {
+		return nil, err
+	}
+	return vb.DiskInfo(disk)
+}
+
+// CloneDisk copies the disk to dst.Path, converting it to dst.Format with the given variants.
+// The format defaults to the one of the source disk, dst is left as it is
+func (vb *VBox) CloneDisk(disk *Disk, dst *Disk, variants ...DiskVariant) (*Disk, error) {
+	d, err := vb.ensureNotInUse(disk)
+	if err != nil {
+		return nil, err
+	}
+
+	format := dst.Format
+	if format == "" {
+		format = d.Format
+	}
+
+	args := []string{"clonemedium", "disk", d.UUID, dst.Path, "--format", string(format)}
+	if len(variants) > 0 {
+		args = append(args, "--variant", joinVariants(variants))
+	}
+
+	if _, err := vb.manage(args...); err != nil {
+		if isAlreadyExistErrorMessage(err.Error()) {
+			return nil, AlreadyExistsErrorr.New(dst.Path)
+		}
+		return nil, err
+	}
+	return vb.DiskInfo(&Disk{Path: dst.Path, Type: dst.Type, Controller: dst.Controller})
+}
+
+// SetDiskType changes how the medium behaves when attached, see MediumType
+func (vb *VBox) SetDiskType(disk *Disk, mediumType MediumType) (*Disk, error) {
+	d, err := vb.ensureNotInUse(disk)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := vb.manage("modifymedium", "disk", d.UUID, "--type", string(mediumType)); err != nil {
+		return nil, err
+	}
+	return vb.DiskInfo(disk)
+}
+
+// SetDiskProperty sets a property of the medium, properties are format specific, for e.g iSCSI targets. The
+// medium must not be in use by a running vm
+func (vb *VBox) SetDiskProperty(disk *Disk, name, value string) (*Disk, error) {
+	d, err := vb.ensureNotInUse(disk)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := vb.manage("mediumproperty", "disk", "set", d.UUID, name, value); err != nil {
+		return nil, err
+	}
+	return vb.DiskInfo(disk)
+}
+
+// DiskProperty returns the value of a property of the medium
+func (vb *VBox) DiskProperty(disk *Disk, name string) (string, error) {
+	out, err := vb.manage("mediumproperty", "disk", "get", disk.UUIDorPath(), name)
+	if err != nil {
+		return "", err
+	}
+	out = strings.TrimSpace(out)
+	return strings.TrimPrefix(out, name+"="), nil
+}
+
+// DeleteDiskProperty removes a property of the medium, which must not be in use by a running vm
+func (vb *VBox) DeleteDiskProperty(disk *Disk, name string) (*Disk, error) {
+	d, err := vb.ensureNotInUse(disk)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := vb.manage("mediumproperty", "disk", "delete", d.UUID, name); err != nil {
+		return nil, err
+	}
+	return vb.DiskInfo(disk)
+}
+
+func joinVariants(variants []DiskVariant) string {
+	elems := make([]string, len(variants))
+	for i, v := range variants {
+		elems[i] = string(v)
+	}
+	return strings.Join(elems, ",")
 }
 
 func (vb *VBox) CreateDisk(disk *Disk) error {
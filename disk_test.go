@@ -1,11 +1,13 @@
 package virtualbox
 
 import (
+	"context"
 	"io/ioutil"
 	"os"
 	"os/user"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -95,3 +97,100 @@ Encryption:     disabled
 	}
 
 }
+
+func TestParseMediumInfo(t *testing.T) {
+	var sampleDiskOut = `UUID:           0e3f0c1b-f523-4a50-b1a8-d1e8c9a508b4
+Parent UUID:    base
+State:          created
+Type:           multiattach (base)
+Location:       /vms/disk1.vdi
+Storage format: VDI
+Format variant: dynamic default
+Capacity:       1000 MBytes
+Size on disk:   2 MBytes
+Encryption:     disabled
+In use by VMs:  vm01 (UUID: 6aa44e71-71c6-4e68-a61f-f69e133ecffa) [base (UUID: 11111111-0000-0000-0000-000000000001)]
+                vm02 (UUID: 6aa44e71-71c6-4e68-a61f-f69e133ecffb)
+Child UUIDs:    22222222-0000-0000-0000-000000000001
+`
+
+	disk := parseMediumInfo(sampleDiskOut)
+
+	expected := Disk{
+		Path:        "/vms/disk1.vdi",
+		Format:      VDI,
+		UUID:        "0e3f0c1b-f523-4a50-b1a8-d1e8c9a508b4",
+		SizeMB:      1000,
+		MediumType:  MultiattachMedium,
+		State:       MediumCreated,
+		AttachedVMs: []string{"6aa44e71-71c6-4e68-a61f-f69e133ecffa", "6aa44e71-71c6-4e68-a61f-f69e133ecffb"},
+	}
+
+	if !reflect.DeepEqual(expected, disk) {
+		t.Errorf("Did not parse showmediuminfo out to disk as expected. Got %+v", disk)
+	}
+}
+
+func TestJoinVariants(t *testing.T) {
+	if v := joinVariants([]DiskVariant{Fixed, Split2G}); v != "Fixed,Split2G" {
+		t.Errorf("expected Fixed,Split2G, got %s", v)
+	}
+}
+
+// inUseDiskVBox reports disk1.vdi as attached to testvm1 of showVmInfoOutput in the given state
+func inUseDiskVBox(state VirtualMachineState, commands *[]string) *VBox {
+	return &VBox{run: func(ctx context.Context, args ...string) (string, error) {
+		*commands = append(*commands, strings.Join(args, " "))
+		switch args[0] {
+		case "showmediuminfo":
+			return `UUID:           0e3f0c1b-f523-4a50-b1a8-d1e8c9a508b4
+Location:       /vms/disk1.vdi
+Storage format: VDI
+In use by VMs:  testvm1 (UUID: 6aa44e71-71c6-4e68-a61f-f69e133ecffa)
+`, nil
+		case "showvminfo":
+			return strings.Replace(showVmInfoOutput, `VMState="poweroff"`, `VMState="`+string(state)+`"`, 1), nil
+		}
+		return "", nil
+	}}
+}
+
+func TestDiskPropertyInUse(t *testing.T) {
+	disk := &Disk{Path: "/vms/disk1.vdi"}
+
+	var commands []string
+	vb := inUseDiskVBox(Running, &commands)
+	if _, err := vb.SetDiskProperty(disk, "TargetAddress", "10.0.0.1"); !IsDiskInUse(err) {
+		t.Errorf("expected setting a property of a disk of a running vm to fail, got %v", err)
+	}
+	if _, err := vb.DeleteDiskProperty(disk, "TargetAddress"); !IsDiskInUse(err) {
+		t.Errorf("expected deleting a property of a disk of a running vm to fail, got %v", err)
+	}
+
+	commands = nil
+	vb = inUseDiskVBox(Poweroff, &commands)
+	if _, err := vb.SetDiskProperty(disk, "TargetAddress", "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	expected := "mediumproperty disk set 0e3f0c1b-f523-4a50-b1a8-d1e8c9a508b4 TargetAddress 10.0.0.1"
+	if !strings.Contains(strings.Join(commands, "\n"), expected) {
+		t.Errorf("expected %s, got %v", expected, commands)
+	}
+}
+
+func TestCloneDiskKeepsDestination(t *testing.T) {
+	var commands []string
+	vb := inUseDiskVBox(Poweroff, &commands)
+
+	dst := &Disk{Path: "/vms/clone.vdi"}
+	if _, err := vb.CloneDisk(&Disk{Path: "/vms/disk1.vdi"}, dst); err != nil {
+		t.Fatal(err)
+	}
+	if dst.Format != "" {
+		t.Errorf("expected the destination to be left alone, got format %s", dst.Format)
+	}
+	expected := "clonemedium disk 0e3f0c1b-f523-4a50-b1a8-d1e8c9a508b4 /vms/clone.vdi --format VDI"
+	if !strings.Contains(strings.Join(commands, "\n"), expected) {
+		t.Errorf("expected %s, got %v", expected, commands)
+	}
+}
@@ -0,0 +1,511 @@
+package virtualbox
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DiskImageInfo describes an image file as read from its own headers, without VirtualBox
+type DiskImageInfo struct {
+	Path   string
+	Format DiskFormat
+	// UUID and ParentUUID are formatted the way VirtualBox prints them, ParentUUID is empty for base images
+	UUID       string
+	ParentUUID string
+	// LogicalSize is the size of the disk in bytes as seen by the guest
+	LogicalSize int64
+	// BlockSize is the allocation unit of dynamic images in bytes, for VMDK the grain size
+	BlockSize       int64
+	TotalBlocks     int64
+	AllocatedBlocks int64
+	// AllocatedSize is the number of bytes of guest data actually stored in the image
+	AllocatedSize int64
+	FileSize      int64
+	Fixed         bool
+	Differencing  bool
+}
+
+// Disk converts the image info into a disk that can be attached
+func (i *DiskImageInfo) Disk() Disk {
+	return Disk{
+		Path:       i.Path,
+		UUID:       i.UUID,
+		ParentUUID: i.ParentUUID,
+		Format:     i.Format,
+		SizeMB:     i.LogicalSize / (1024 * 1024),
+		Type:       HDDrive,
+	}
+}
+
+// UnknownImageFormatError is returned for files none of the image readers recognizes
+type UnknownImageFormatError string
+
+func (u UnknownImageFormatError) Error() string {
+	return string(u)
+}
+
+func IsUnknownImageFormat(err error) bool {
+	_, ok := err.(UnknownImageFormatError)
+	return ok
+}
+
+const (
+	vdiSignature       = 0xbeda107f
+	vdiHeaderOffset    = 72
+	vdiBlockFree       = 0xffffffff
+	vdiBlockZero       = 0xfffffffe
+	vdiTypeFixed       = 2
+	vdiTypeDiff        = 4
+	vhdFooterSize      = 512
+	vhdTypeFixed       = 2
+	vhdTypeDiff        = 4
+	vhdBlockUnused     = 0xffffffff
+	vmdkSparseMagic    = 0x564d444b // KDMV
+	vmdkGDAtEnd        = 0xffffffffffffffff
+	sectorSize         = 512
+	vmdkDescriptorHint = "# Disk DescriptorFile"
+	// descriptors are a few hundred bytes, anything larger is not one
+	vmdkMaxDescriptorSize = 1024 * 1024
+)
+
+var (
+	vhdCookie = []byte("conectix")
+	qcowMagic = []byte("QFI\xfb")
+)
+
+// InspectDiskImage reads the headers of a VDI, VMDK or VHD image, the format is detected from the file contents
+func InspectDiskImage(path string) (*DiskImageInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	var info *DiskImageInfo
+	switch detectImageFormat(f, st.Size()) {
+	case VDI:
+		info, err = inspectVDI(f, st.Size())
+	case VMDK:
+		info, err = inspectVMDK(f, st.Size(), filepath.Dir(path))
+	case VHD:
+		info, err = inspectVHD(f, st.Size())
+	case QCOW:
+		return nil, UnknownImageFormatError(fmt.Sprintf("%s is a qcow image which cannot be inspected", path))
+	default:
+		return nil, UnknownImageFormatError(fmt.Sprintf("%s is not a VDI, VMDK or VHD image", path))
+	}
+	if err != nil {
+		return nil, OperationError{Path: path, Op: "READ", Err: err}
+	}
+
+	info.Path = path
+	info.FileSize = st.Size()
+	return info, nil
+}
+
+// VerifyDiskImage checks that the image file at disk.Path carries disk.UUID, so the expected image gets attached
+func VerifyDiskImage(disk *Disk) error {
+	info, err := InspectDiskImage(disk.Path)
+	if err != nil {
+		return err
+	}
+	if disk.UUID != "" && !strings.EqualFold(disk.UUID, info.UUID) {
+		return fmt.Errorf("image %s has uuid %s, expected %s", disk.Path, info.UUID, disk.UUID)
+	}
+	if disk.Format != "" && disk.Format != info.Format {
+		return fmt.Errorf("image %s is %s, expected %s", disk.Path, info.Format, disk.Format)
+	}
+	return nil
+}
+
+func detectImageFormat(r io.ReaderAt, size int64) DiskFormat {
+	head := make([]byte, vdiHeaderOffset)
+	n, _ := r.ReadAt(head, 0)
+	head = head[:n]
+
+	if len(head) >= 68 && binary.LittleEndian.Uint32(head[64:68]) == vdiSignature {
+		return VDI
+	}
+	if len(head) >= 4 && binary.LittleEndian.Uint32(head[0:4]) == vmdkSparseMagic {
+		return VMDK
+	}
+	if bytes.HasPrefix(head, []byte(vmdkDescriptorHint)) {
+		return VMDK
+	}
+	if bytes.HasPrefix(head, qcowMagic) {
+		return QCOW
+	}
+	if size >= vhdFooterSize {
+		cookie := make([]byte, len(vhdCookie))
+		if _, err := r.ReadAt(cookie, size-vhdFooterSize); err == nil && bytes.Equal(cookie, vhdCookie) {
+			return VHD
+		}
+	}
+	return ""
+}
+
+// checkTable verifies that a table of count entries of entrySize bytes at offset lies within a file of the given
+// size, so that sizes read from a corrupt header are rejected before anything is allocated for them
+func checkTable(what string, offset, count, entrySize, size int64) error {
+	if offset < 0 || count < 0 || offset > size || count > (size-offset)/entrySize {
+		return fmt.Errorf("%s of %d entries at offset %d exceeds the file size %d", what, count, offset, size)
+	}
+	return nil
+}
+
+// sectorOffset converts an offset in sectors to bytes, failing for offsets beyond the end of the file
+func sectorOffset(what string, sectors uint64, size int64) (int64, error) {
+	if sectors > uint64(size/sectorSize) {
+		return 0, fmt.Errorf("%s at sector %d is beyond the end of the file", what, sectors)
+	}
+	return int64(sectors) * sectorSize, nil
+}
+
+func ceilDiv(a, b int64) int64 {
+	if a%b == 0 {
+		return a / b
+	}
+	return a/b + 1
+}
+
+// rtUUID formats 16 bytes the way VirtualBox does, with the first three fields stored little endian
+func rtUUID(b []byte) string {
+	if bytes.Equal(b, make([]byte, 16)) {
+		return ""
+	}
+	return fmt.Sprintf("%08x-%04x-%04x-%x-%x",
+		binary.LittleEndian.Uint32(b[0:4]),
+		binary.LittleEndian.Uint16(b[4:6]),
+		binary.LittleEndian.Uint16(b[6:8]),
+		b[8:10], b[10:16])
+}
+
+func inspectVDI(r io.ReaderAt, size int64) (*DiskImageInfo, error) {
+	h := make([]byte, 472)
+	if _, err := r.ReadAt(h, 0); err != nil {
+		return nil, err
+	}
+
+	if version := binary.LittleEndian.Uint32(h[68:72]); version>>16 != 1 {
+		return nil, fmt.Errorf("unsupported VDI version %d.%d", version>>16, version&0xffff)
+	}
+
+	le := binary.LittleEndian
+	imageType := le.Uint32(h[76:80])
+	offBlocks := int64(le.Uint32(h[340:344]))
+	info := &DiskImageInfo{
+		Format:       VDI,
+		LogicalSize:  int64(le.Uint64(h[368:376])),
+		BlockSize:    int64(le.Uint32(h[376:380])),
+		TotalBlocks:  int64(le.Uint32(h[384:388])),
+		UUID:         rtUUID(h[392:408]),
+		ParentUUID:   rtUUID(h[424:440]),
+		Fixed:        imageType == vdiTypeFixed,
+		Differencing: imageType == vdiTypeDiff,
+	}
+
+	if err := checkTable("block map", offBlocks, info.TotalBlocks, 4, size); err != nil {
+		return nil, err
+	}
+	blocks := make([]byte, 4*info.TotalBlocks)
+	if _, err := r.ReadAt(blocks, offBlocks); err != nil {
+		return nil, fmt.Errorf("reading block map: %v", err)
+	}
+	for i := int64(0); i < info.TotalBlocks; i++ {
+		if b := le.Uint32(blocks[4*i:]); b != vdiBlockFree && b != vdiBlockZero {
+			info.AllocatedBlocks++
+		}
+	}
+	info.AllocatedSize = info.AllocatedBlocks * info.BlockSize
+	return info, nil
+}
+
+func inspectVHD(r io.ReaderAt, size int64) (*DiskImageInfo, error) {
+	footer := make([]byte, vhdFooterSize)
+	if _, err := r.ReadAt(footer, size-vhdFooterSize); err != nil {
+		return nil, err
+	}
+
+	be := binary.BigEndian
+	diskType := be.Uint32(footer[60:64])
+	info := &DiskImageInfo{
+		Format:       VHD,
+		LogicalSize:  int64(be.Uint64(footer[48:56])),
+		UUID:         rtUUID(footer[68:84]),
+		Fixed:        diskType == vhdTypeFixed,
+		Differencing: diskType == vhdTypeDiff,
+	}
+
+	if info.Fixed {
+		info.AllocatedSize = info.LogicalSize
+		return info, nil
+	}
+
+	dynOffset := int64(be.Uint64(footer[16:24]))
+	if err := checkTable("dynamic header", dynOffset, 1024, 1, size); err != nil {
+		return nil, err
+	}
+	dyn := make([]byte, 1024)
+	if _, err := r.ReadAt(dyn, dynOffset); err != nil {
+		return nil, fmt.Errorf("reading dynamic header: %v", err)
+	}
+	if !bytes.HasPrefix(dyn, []byte("cxsparse")) {
+		return nil, fmt.Errorf("missing dynamic disk header")
+	}
+
+	tableOffset := int64(be.Uint64(dyn[16:24]))
+	info.TotalBlocks = int64(be.Uint32(dyn[28:32]))
+	info.BlockSize = int64(be.Uint32(dyn[32:36]))
+	if info.Differencing {
+		info.ParentUUID = rtUUID(dyn[40:56])
+	}
+
+	if err := checkTable("block allocation table", tableOffset, info.TotalBlocks, 4, size); err != nil {
+		return nil, err
+	}
+	bat := make([]byte, 4*info.TotalBlocks)
+	if _, err := r.ReadAt(bat, tableOffset); err != nil {
+		return nil, fmt.Errorf("reading block allocation table: %v", err)
+	}
+	for i := int64(0); i < info.TotalBlocks; i++ {
+		if be.Uint32(bat[4*i:]) != vhdBlockUnused {
+			info.AllocatedBlocks++
+		}
+	}
+	info.AllocatedSize = info.AllocatedBlocks * info.BlockSize
+	return info, nil
+}
+
+// vmdkSparseHeader is the header of hosted sparse extents, all sizes are in sectors
+type vmdkSparseHeader struct {
+	capacity         int64
+	grainSize        int64
+	descriptorOffset uint64
+	descriptorSize   uint64
+	numGTEsPerGT     int64
+	gdOffset         uint64
+}
+
+func readVMDKSparseHeader(r io.ReaderAt) (*vmdkSparseHeader, error) {
+	h := make([]byte, 64)
+	if _, err := r.ReadAt(h, 0); err != nil {
+		return nil, err
+	}
+	le := binary.LittleEndian
+	if le.Uint32(h[0:4]) != vmdkSparseMagic {
+		return nil, fmt.Errorf("not a sparse extent")
+	}
+	return &vmdkSparseHeader{
+		capacity:         int64(le.Uint64(h[12:20])),
+		grainSize:        int64(le.Uint64(h[20:28])),
+		descriptorOffset: le.Uint64(h[28:36]),
+		descriptorSize:   le.Uint64(h[36:44]),
+		numGTEsPerGT:     int64(le.Uint32(h[44:48])),
+		gdOffset:         le.Uint64(h[56:64]),
+	}, nil
+}
+
+// grains returns the number of grains of the extent
+func (h *vmdkSparseHeader) grains() int64 {
+	return ceilDiv(h.capacity, h.grainSize)
+}
+
+// allocatedGrains walks the grain directory and its tables, counting grains that hold data
+func (h *vmdkSparseHeader) allocatedGrains(r io.ReaderAt, size int64) (int64, error) {
+	if h.gdOffset == vmdkGDAtEnd {
+		return 0, fmt.Errorf("grain directory location not supported")
+	}
+	if h.capacity < 0 || h.grainSize <= 0 || h.numGTEsPerGT <= 0 {
+		return 0, fmt.Errorf("invalid sparse extent geometry, capacity %d, grain size %d, %d entries per grain table",
+			h.capacity, h.grainSize, h.numGTEsPerGT)
+	}
+
+	le := binary.LittleEndian
+	tables := ceilDiv(h.grains(), h.numGTEsPerGT)
+
+	gdOffset, err := sectorOffset("grain directory", h.gdOffset, size)
+	if err != nil {
+		return 0, err
+	}
+	if err := checkTable("grain directory", gdOffset, tables, 4, size); err != nil {
+		return 0, err
+	}
+	gd := make([]byte, 4*tables)
+	if _, err := r.ReadAt(gd, gdOffset); err != nil {
+		return 0, err
+	}
+
+	if err := checkTable("grain table", 0, h.numGTEsPerGT, 4, size); err != nil {
+		return 0, err
+	}
+	var allocated int64
+	gt := make([]byte, 4*h.numGTEsPerGT)
+	for i := int64(0); i < tables; i++ {
+		sector := le.Uint32(gd[4*i:])
+		if sector == 0 {
+			continue
+		}
+		offset, err := sectorOffset("grain table", uint64(sector), size)
+		if err != nil {
+			return 0, err
+		}
+		if err := checkTable("grain table", offset, h.numGTEsPerGT, 4, size); err != nil {
+			return 0, err
+		}
+		if _, err := r.ReadAt(gt, offset); err != nil {
+			return 0, err
+		}
+		for j := int64(0); j < h.numGTEsPerGT; j++ {
+			// 0 is an unallocated grain, 1 a grain known to be zero
+			if le.Uint32(gt[4*j:]) > 1 {
+				allocated++
+			}
+		}
+	}
+	return allocated, nil
+}
+
+var reVMDKExtent = regexp.MustCompile(`^(RW|RDONLY|NOACCESS)\s+(\d+)\s+(\w+)(?:\s+"([^"]*)")?`)
+
+type vmdkExtent struct {
+	sectors  int64
+	kind     string
+	fileName string
+}
+
+type vmdkDescriptor struct {
+	values  map[string]string
+	extents []vmdkExtent
+}
+
+func parseVMDKDescriptor(text string) (*vmdkDescriptor, error) {
+	d := &vmdkDescriptor{values: map[string]string{}}
+	s := bufio.NewScanner(strings.NewReader(text))
+	for s.Scan() {
+		line := strings.TrimSpace(strings.Trim(s.Text(), "\x00"))
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if m := reVMDKExtent.FindStringSubmatch(line); m != nil {
+			sectors, err := strconv.ParseInt(m[2], 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			d.extents = append(d.extents, vmdkExtent{sectors: sectors, kind: m[3], fileName: m[4]})
+			continue
+		}
+		if kv := strings.SplitN(line, "=", 2); len(kv) == 2 {
+			d.values[strings.TrimSpace(kv[0])] = strings.Trim(strings.TrimSpace(kv[1]), `"`)
+		}
+	}
+	if len(d.extents) == 0 {
+		return nil, fmt.Errorf("descriptor has no extents")
+	}
+	return d, s.Err()
+}
+
+func vmdkUUID(uuid string) string {
+	if uuid == "" || strings.Trim(uuid, "0-") == "" {
+		return ""
+	}
+	return uuid
+}
+
+func inspectVMDK(r io.ReaderAt, size int64, dir string) (*DiskImageInfo, error) {
+	var text []byte
+	sparse, err := readVMDKSparseHeader(r)
+	if err == nil {
+		// monolithic sparse files embed the descriptor
+		if sparse.descriptorOffset == 0 {
+			return nil, fmt.Errorf("sparse extent without embedded descriptor, open the descriptor file instead")
+		}
+		offset, err := sectorOffset("descriptor", sparse.descriptorOffset, size)
+		if err != nil {
+			return nil, err
+		}
+		if sparse.descriptorSize > vmdkMaxDescriptorSize/sectorSize {
+			return nil, fmt.Errorf("embedded descriptor of %d sectors is too large", sparse.descriptorSize)
+		}
+		if err := checkTable("descriptor", offset, int64(sparse.descriptorSize), sectorSize, size); err != nil {
+			return nil, err
+		}
+		text = make([]byte, int64(sparse.descriptorSize)*sectorSize)
+		if _, err := r.ReadAt(text, offset); err != nil {
+			return nil, err
+		}
+	} else {
+		if size > vmdkMaxDescriptorSize {
+			return nil, fmt.Errorf("descriptor file of %d bytes is too large", size)
+		}
+		text = make([]byte, size)
+		if _, err := r.ReadAt(text, 0); err != nil && err != io.EOF {
+			return nil, err
+		}
+	}
+
+	desc, err := parseVMDKDescriptor(string(text))
+	if err != nil {
+		return nil, err
+	}
+
+	info := &DiskImageInfo{
+		Format:     VMDK,
+		UUID:       vmdkUUID(desc.values["ddb.uuid.image"]),
+		ParentUUID: vmdkUUID(desc.values["ddb.uuid.parent"]),
+		Fixed:      strings.Contains(strings.ToLower(desc.values["createType"]), "flat"),
+	}
+	info.Differencing = info.ParentUUID != "" || (desc.values["parentCID"] != "" && desc.values["parentCID"] != "ffffffff")
+
+	for _, e := range desc.extents {
+		info.LogicalSize += e.sectors * sectorSize
+
+		switch e.kind {
+		case "FLAT", "VMFS":
+			info.AllocatedSize += e.sectors * sectorSize
+		case "SPARSE", "VMFSSPARSE":
+			var h *vmdkSparseHeader
+			var er io.ReaderAt
+			erSize := size
+			if sparse != nil {
+				h, er = sparse, r
+			} else {
+				f, err := os.Open(filepath.Join(dir, e.fileName))
+				if err != nil {
+					return nil, err
+				}
+				defer f.Close()
+				st, err := f.Stat()
+				if err != nil {
+					return nil, err
+				}
+				if h, err = readVMDKSparseHeader(f); err != nil {
+					return nil, err
+				}
+				er, erSize = f, st.Size()
+			}
+
+			grains, err := h.allocatedGrains(er, erSize)
+			if err != nil {
+				return nil, err
+			}
+			info.BlockSize = h.grainSize * sectorSize
+			info.TotalBlocks += h.grains()
+			info.AllocatedBlocks += grains
+			info.AllocatedSize += grains * h.grainSize * sectorSize
+		}
+	}
+	return info, nil
+}
@@ -0,0 +1,278 @@
+package virtualbox
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var (
+	imageUUID  = []byte{0x71, 0x4e, 0xa4, 0x6a, 0x71, 0x71, 0x68, 0x4e, 0xa6, 0x1f, 0xf6, 0x9e, 0x13, 0x3e, 0xcf, 0xfa}
+	parentUUID = []byte{0x9d, 0xcf, 0xf0, 0x38, 0x0c, 0x6c, 0x59, 0x4f, 0xba, 0x0b, 0xcd, 0x1d, 0xfb, 0x53, 0x29, 0xd6}
+)
+
+const (
+	imageUUIDString  = "6aa44e71-7171-4e68-a61f-f69e133ecffa"
+	parentUUIDString = "38f0cf9d-6c0c-4f59-ba0b-cd1dfb5329d6"
+)
+
+func writeImage(t *testing.T, dir, name string, data []byte) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func vdiImage(parent []byte) []byte {
+	const blocks, blockSize = 4, 1024 * 1024
+	img := make([]byte, 1024)
+	le := binary.LittleEndian
+	copy(img, "<<< Oracle VM VirtualBox Disk Image >>>\n")
+	le.PutUint32(img[64:], vdiSignature)
+	le.PutUint32(img[68:], 0x00010001)
+	le.PutUint32(img[72:], 400)
+	le.PutUint32(img[76:], 1)
+	le.PutUint32(img[340:], 512)
+	le.PutUint32(img[344:], 1024)
+	le.PutUint64(img[368:], blocks*blockSize)
+	le.PutUint32(img[376:], blockSize)
+	le.PutUint32(img[384:], blocks)
+	le.PutUint32(img[388:], 2)
+	copy(img[392:], imageUUID)
+	if parent != nil {
+		le.PutUint32(img[76:], vdiTypeDiff)
+		copy(img[424:], parent)
+	}
+	for i, b := range []uint32{0, vdiBlockFree, 1, vdiBlockZero} {
+		le.PutUint32(img[512+4*i:], b)
+	}
+	return img
+}
+
+func vhdImage() []byte {
+	const blocks, blockSize = 8, 2 * 1024 * 1024
+	be := binary.BigEndian
+
+	footer := make([]byte, vhdFooterSize)
+	copy(footer, vhdCookie)
+	be.PutUint64(footer[16:], 512)
+	be.PutUint64(footer[48:], blocks*blockSize)
+	be.PutUint32(footer[60:], vhdTypeDiff)
+	copy(footer[68:], imageUUID)
+
+	img := append([]byte{}, footer...)
+	dyn := make([]byte, 1024)
+	copy(dyn, "cxsparse")
+	be.PutUint64(dyn[16:], 1536)
+	be.PutUint32(dyn[28:], blocks)
+	be.PutUint32(dyn[32:], blockSize)
+	copy(dyn[40:], parentUUID)
+	img = append(img, dyn...)
+
+	bat := make([]byte, 512)
+	for i := 0; i < blocks; i++ {
+		be.PutUint32(bat[4*i:], vhdBlockUnused)
+	}
+	be.PutUint32(bat[4:], 4)
+	img = append(img, bat...)
+	return append(img, footer...)
+}
+
+func vmdkSparseImage() []byte {
+	const capacity, grainSize, gtes = 2048, 128, 512
+	le := binary.LittleEndian
+	img := make([]byte, 8*sectorSize)
+	le.PutUint32(img[0:], vmdkSparseMagic)
+	le.PutUint32(img[4:], 1)
+	le.PutUint64(img[12:], capacity)
+	le.PutUint64(img[20:], grainSize)
+	le.PutUint64(img[28:], 1)
+	le.PutUint64(img[36:], 2)
+	le.PutUint32(img[44:], gtes)
+	le.PutUint64(img[56:], 3)
+	copy(img[sectorSize:], `# Disk DescriptorFile
+version=1
+CID=6f3d2a1b
+parentCID=ffffffff
+createType="monolithicSparse"
+
+RW 2048 SPARSE "disk.vmdk"
+
+ddb.uuid.image="`+imageUUIDString+`"
+ddb.uuid.parent="00000000-0000-0000-0000-000000000000"
+`)
+	// grain directory at sector 3 pointing to a grain table at sector 4
+	le.PutUint32(img[3*sectorSize:], 4)
+	gt := img[4*sectorSize:]
+	le.PutUint32(gt[0:], 100)
+	le.PutUint32(gt[4:], 1)
+	le.PutUint32(gt[8:], 228)
+	return img
+}
+
+func TestInspectDiskImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskimage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	vdi, err := InspectDiskImage(writeImage(t, dir, "disk.vdi", vdiImage(parentUUID)))
+	if err != nil {
+		t.Fatalf("inspecting vdi failed %v", err)
+	}
+	if vdi.Format != VDI || vdi.UUID != imageUUIDString || vdi.ParentUUID != parentUUIDString || !vdi.Differencing {
+		t.Errorf("unexpected vdi %+v", vdi)
+	}
+	if vdi.LogicalSize != 4*1024*1024 || vdi.AllocatedBlocks != 2 || vdi.AllocatedSize != 2*1024*1024 {
+		t.Errorf("unexpected vdi sizes %+v", vdi)
+	}
+
+	vhd, err := InspectDiskImage(writeImage(t, dir, "disk.vhd", vhdImage()))
+	if err != nil {
+		t.Fatalf("inspecting vhd failed %v", err)
+	}
+	if vhd.Format != VHD || vhd.UUID != imageUUIDString || vhd.ParentUUID != parentUUIDString {
+		t.Errorf("unexpected vhd %+v", vhd)
+	}
+	if vhd.TotalBlocks != 8 || vhd.AllocatedBlocks != 1 || vhd.AllocatedSize != 2*1024*1024 {
+		t.Errorf("unexpected vhd sizes %+v", vhd)
+	}
+
+	vmdk, err := InspectDiskImage(writeImage(t, dir, "disk.vmdk", vmdkSparseImage()))
+	if err != nil {
+		t.Fatalf("inspecting vmdk failed %v", err)
+	}
+	if vmdk.Format != VMDK || vmdk.UUID != imageUUIDString || vmdk.ParentUUID != "" || vmdk.Differencing {
+		t.Errorf("unexpected vmdk %+v", vmdk)
+	}
+	// grain table entry 1 marks a zero grain and is not allocated
+	if vmdk.LogicalSize != 2048*sectorSize || vmdk.AllocatedBlocks != 2 || vmdk.AllocatedSize != 2*128*sectorSize {
+		t.Errorf("unexpected vmdk sizes %+v", vmdk)
+	}
+
+	if _, err := InspectDiskImage(writeImage(t, dir, "disk.img", make([]byte, 4096))); !IsUnknownImageFormat(err) {
+		t.Errorf("expected unknown format error, got %v", err)
+	}
+}
+
+func TestInspectVMDKDescriptor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskimage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeImage(t, dir, "disk-flat.vmdk", make([]byte, 4096))
+	path := writeImage(t, dir, "disk.vmdk", []byte(`# Disk DescriptorFile
+version=1
+CID=6f3d2a1b
+parentCID=ffffffff
+createType="monolithicFlat"
+
+# Extent description
+RW 20480 FLAT "disk-flat.vmdk" 0
+
+ddb.uuid.image="`+imageUUIDString+`"
+ddb.uuid.parent="`+parentUUIDString+`"
+`))
+
+	info, err := InspectDiskImage(path)
+	if err != nil {
+		t.Fatalf("inspecting vmdk failed %v", err)
+	}
+	if !info.Fixed || info.LogicalSize != 20480*sectorSize || info.AllocatedSize != info.LogicalSize {
+		t.Errorf("unexpected vmdk %+v", info)
+	}
+	if info.ParentUUID != parentUUIDString || !info.Differencing {
+		t.Errorf("expected parent %s, got %+v", parentUUIDString, info)
+	}
+
+	if err := VerifyDiskImage(&Disk{Path: path, UUID: imageUUIDString}); err != nil {
+		t.Errorf("expected uuid to match %v", err)
+	}
+	if err := VerifyDiskImage(&Disk{Path: path, UUID: parentUUIDString}); err == nil {
+		t.Errorf("expected uuid mismatch")
+	}
+}
+
+func TestInspectCorruptDiskImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskimage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	le, be := binary.LittleEndian, binary.BigEndian
+	vmdkHeader := func() []byte {
+		img := make([]byte, sectorSize)
+		le.PutUint32(img[0:], vmdkSparseMagic)
+		le.PutUint64(img[28:], 1)
+		le.PutUint64(img[36:], 0xffffffffffffff00)
+		return img
+	}
+
+	for name, corrupt := range map[string]func() []byte{
+		"vmdk descriptor size": vmdkHeader,
+		"vmdk descriptor offset": func() []byte {
+			img := vmdkHeader()
+			le.PutUint64(img[28:], 0xffffffffffffff00)
+			le.PutUint64(img[36:], 1)
+			return img
+		},
+		"vmdk capacity": func() []byte {
+			img := vmdkSparseImage()
+			le.PutUint64(img[12:], 0x7fffffffffffffff)
+			le.PutUint64(img[20:], 1)
+			return img
+		},
+		"vmdk grain table entries": func() []byte {
+			img := vmdkSparseImage()
+			le.PutUint32(img[44:], 0xffffffff)
+			return img
+		},
+		"vmdk grain size": func() []byte {
+			img := vmdkSparseImage()
+			le.PutUint64(img[20:], 0)
+			return img
+		},
+		"vmdk grain directory offset": func() []byte {
+			img := vmdkSparseImage()
+			le.PutUint64(img[56:], 0x7fffffffffffffff)
+			return img
+		},
+		"vmdk grain table offset": func() []byte {
+			img := vmdkSparseImage()
+			le.PutUint32(img[3*sectorSize:], 0xfffffff0)
+			return img
+		},
+		"vdi block map": func() []byte {
+			img := vdiImage(nil)
+			le.PutUint32(img[384:], 0xffffffff)
+			return img
+		},
+		"vdi block map offset": func() []byte {
+			img := vdiImage(nil)
+			le.PutUint32(img[340:], 0xfffffff0)
+			return img
+		},
+		"vhd block allocation table": func() []byte {
+			img := vhdImage()
+			be.PutUint32(img[vhdFooterSize+28:], 0xffffffff)
+			return img
+		},
+		"vhd dynamic header offset": func() []byte {
+			img := vhdImage()
+			be.PutUint64(img[len(img)-vhdFooterSize+16:], 0xffffffffffffff00)
+			return img
+		},
+	} {
+		_, err := InspectDiskImage(writeImage(t, dir, "corrupt", corrupt()))
+		if _, ok := err.(OperationError); !ok {
+			t.Errorf("%s: expected a read error, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package virtualbox
+
+import (
+	"context"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// MediumUsage is the space a medium takes, as seen by the guest and on the host
+type MediumUsage struct {
+	Disk
+	LogicalBytes int64
+	OnDiskBytes  int64
+	// Shared media, for e.g base images, are part of the disks of more than one vm
+	Shared bool
+}
+
+// DiskUsage is the space the media of a vm take, including the differencing images of its snapshots
+type DiskUsage struct {
+	UUID  string
+	Name  string
+	Group string
+	Media []MediumUsage
+	// LogicalBytes is the capacity of the disks the guest sees, OnDiskBytes the size of all images on the host
+	LogicalBytes int64
+	OnDiskBytes  int64
+	// SharedBytes is the part of OnDiskBytes in media other vms use as well
+	SharedBytes int64
+	// ReclaimableBytes estimates what deleting the snapshots of the vm gives back, the size of the differencing
+	// images between its bases and the images it currently writes to
+	ReclaimableBytes int64
+}
+
+// GroupUsage sums up the disk usage of the vms of a group
+type GroupUsage struct {
+	Group string
+	VMs   int
+	// OnDiskBytes counts media shared by several vms of the group once
+	OnDiskBytes      int64
+	ReclaimableBytes int64
+}
+
+// HostDiskUsage is the disk usage of all vms of the host
+type HostDiskUsage struct {
+	// VMs and Groups are sorted by OnDiskBytes, largest first
+	VMs    []DiskUsage
+	Groups []GroupUsage
+	// Unattached media are used by no vm and can be removed altogether, see CollectGarbage
+	Unattached []MediumUsage
+	// OnDiskBytes counts every medium once, even those shared by many vms
+	OnDiskBytes      int64
+	ReclaimableBytes int64
+}
+
+func fileSize(path string) int64 {
+	st, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return st.Size()
+}
+
+// mediumUsers returns for each medium the uuids of the vms having it in the chain of one of their attachments
+func mediumUsers(media []Disk) map[string]map[string]bool {
+	byUUID := map[string]Disk{}
+	for _, d := range media {
+		byUUID[d.UUID] = d
+	}
+
+	users := map[string]map[string]bool{}
+	for _, d := range media {
+		for _, vm := range d.AttachedVMs {
+			// walk up to the base, guarding against broken registries
+			for m, ok := d, true; ok && !users[m.UUID][vm]; m, ok = byUUID[m.ParentUUID] {
+				if users[m.UUID] == nil {
+					users[m.UUID] = map[string]bool{}
+				}
+				users[m.UUID][vm] = true
+			}
+		}
+	}
+	return users
+}
+
+func mediumUsage(d Disk, users map[string]map[string]bool, size func(string) int64) MediumUsage {
+	return MediumUsage{
+		Disk:         d,
+		LogicalBytes: d.SizeMB * megabyte,
+		OnDiskBytes:  size(d.Path),
+		Shared:       len(users[d.UUID]) > 1,
+	}
+}
+
+// usageOf collects the media of the vm with the given uuid out of the registry media
+func usageOf(uuid string, media []Disk, users map[string]map[string]bool, size func(string) int64) DiskUsage {
+	usage := DiskUsage{UUID: uuid}
+
+	hasChild := map[string]bool{}
+	for _, d := range media {
+		if users[d.UUID][uuid] && d.ParentUUID != "" {
+			hasChild[d.ParentUUID] = true
+		}
+	}
+
+	for _, d := range media {
+		if !users[d.UUID][uuid] {
+			continue
+		}
+
+		m := mediumUsage(d, users, size)
+		usage.Media = append(usage.Media, m)
+		usage.OnDiskBytes += m.OnDiskBytes
+		if d.ParentUUID == "" {
+			usage.LogicalBytes += m.LogicalBytes
+		}
+		if m.Shared {
+			usage.SharedBytes += m.OnDiskBytes
+		} else if d.ParentUUID != "" && hasChild[d.UUID] {
+			usage.ReclaimableBytes += m.OnDiskBytes
+		}
+	}
+	return usage
+}
+
+// DiskUsage returns the space taken by the media of the vm and their differencing chains
+func (vb *VBox) DiskUsage(ctx context.Context, vm *VirtualMachine) (*DiskUsage, error) {
+	machine, err := vb.VMInfo(vm.UUIDOrName())
+	if err != nil {
+		return nil, err
+	}
+
+	media, err := vb.ListMedia(ctx, HDDrive)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := usageOf(machine.UUID, media, mediumUsers(media), fileSize)
+	usage.Name, usage.Group = machine.Spec.Name, machine.Spec.Group
+	return &usage, nil
+}
+
+// parses lines like the following
+//
+//	"vm01" {6aa44e71-71c6-4e68-a61f-f69e133ecffa}
+var reVMListLine = regexp.MustCompile(`^"(.*)" \{([^}]+)\}$`)
+
+// listVMs returns the names of the registered vms by uuid
+func (vb *VBox) listVMs(ctx context.Context) (map[string]string, error) {
+	out, err := vb.manageWithContext(ctx, "list", "vms")
+	if err != nil {
+		return nil, err
+	}
+
+	vms := map[string]string{}
+	for _, line := range strings.Split(strings.Replace(out, "\r\n", "\n", -1), "\n") {
+		if m := reVMListLine.FindStringSubmatch(strings.TrimSpace(line)); m != nil {
+			vms[m[2]] = m[1]
+		}
+	}
+	return vms, nil
+}
+
+// hostUsage builds the host report out of the registry media and the vms by uuid, which carry name and group
+func hostUsage(vms map[string]DiskUsage, media []Disk, size func(string) int64) *HostDiskUsage {
+	users := mediumUsers(media)
+	report := &HostDiskUsage{}
+
+	groups := map[string]*GroupUsage{}
+	// media already counted in a group, base images shared by its vms count once
+	counted := map[string]map[string]bool{}
+	for uuid, vm := range vms {
+		usage := usageOf(uuid, media, users, size)
+		usage.Name, usage.Group = vm.Name, vm.Group
+		report.VMs = append(report.VMs, usage)
+		report.ReclaimableBytes += usage.ReclaimableBytes
+
+		group := usage.Group
+		if group == "" {
+			group = "/"
+		}
+		if groups[group] == nil {
+			groups[group] = &GroupUsage{Group: group}
+			counted[group] = map[string]bool{}
+		}
+		groups[group].VMs++
+		// reclaimable media are never shared, they belong to this vm alone
+		groups[group].ReclaimableBytes += usage.ReclaimableBytes
+		for _, m := range usage.Media {
+			if !counted[group][m.UUID] {
+				counted[group][m.UUID] = true
+				groups[group].OnDiskBytes += m.OnDiskBytes
+			}
+		}
+	}
+
+	for _, d := range media {
+		m := mediumUsage(d, users, size)
+		report.OnDiskBytes += m.OnDiskBytes
+		if len(users[d.UUID]) == 0 {
+			report.Unattached = append(report.Unattached, m)
+			report.ReclaimableBytes += m.OnDiskBytes
+		}
+	}
+
+	for _, g := range groups {
+		report.Groups = append(report.Groups, *g)
+	}
+
+	sort.Slice(report.VMs, func(i, j int) bool {
+		if report.VMs[i].OnDiskBytes != report.VMs[j].OnDiskBytes {
+			return report.VMs[i].OnDiskBytes > report.VMs[j].OnDiskBytes
+		}
+		return report.VMs[i].Name < report.VMs[j].Name
+	})
+	sort.Slice(report.Groups, func(i, j int) bool {
+		if report.Groups[i].OnDiskBytes != report.Groups[j].OnDiskBytes {
+			return report.Groups[i].OnDiskBytes > report.Groups[j].OnDiskBytes
+		}
+		return report.Groups[i].Group < report.Groups[j].Group
+	})
+	sort.Slice(report.Unattached, func(i, j int) bool {
+		return report.Unattached[i].OnDiskBytes > report.Unattached[j].OnDiskBytes
+	})
+	return report
+}
+
+// HostDiskUsage reports the disk usage of every registered vm, summed up per group, together with the media
+// no vm uses
+func (vb *VBox) HostDiskUsage(ctx context.Context) (*HostDiskUsage, error) {
+	names, err := vb.listVMs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	media, err := vb.ListMedia(ctx, HDDrive)
+	if err != nil {
+		return nil, err
+	}
+
+	vms := map[string]DiskUsage{}
+	for uuid, name := range names {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		vm := DiskUsage{Name: name}
+		// vms that vanished in between keep their name only
+		if machine, err := vb.VMInfo(uuid); err == nil {
+			vm.Group = machine.Spec.Group
+		}
+		vms[uuid] = vm
+	}
+	return hostUsage(vms, media, fileSize), nil
+}
@@ -0,0 +1,80 @@
+package virtualbox
+
+import (
+	"testing"
+)
+
+const (
+	vmA = "6aa44e71-71c6-4e68-a61f-f69e133ecffa"
+	vmB = "6aa44e71-71c6-4e68-a61f-f69e133ecffb"
+)
+
+var usageMedia = []Disk{
+	{UUID: "base", Path: "/vms/base/golden.vdi", SizeMB: 100, MediumType: ImmutableMedium},
+	{UUID: "child-a", ParentUUID: "base", Path: "/vms/a/child.vdi", SizeMB: 100, AttachedVMs: []string{vmA}},
+	{UUID: "child-b", ParentUUID: "base", Path: "/vms/b/child.vdi", SizeMB: 100, AttachedVMs: []string{vmB}},
+	{UUID: "data", Path: "/vms/a/data.vdi", SizeMB: 50, AttachedVMs: []string{vmA}},
+	{UUID: "snap", ParentUUID: "data", Path: "/vms/a/Snapshots/snap.vdi", SizeMB: 50, AttachedVMs: []string{vmA}},
+	{UUID: "current", ParentUUID: "snap", Path: "/vms/a/Snapshots/current.vdi", SizeMB: 50, AttachedVMs: []string{vmA}},
+	{UUID: "leaked", Path: "/vms/c/leaked.vdi", SizeMB: 10},
+}
+
+var usageSizes = map[string]int64{
+	"/vms/base/golden.vdi":         1000,
+	"/vms/a/child.vdi":             100,
+	"/vms/b/child.vdi":             300,
+	"/vms/a/data.vdi":              500,
+	"/vms/a/Snapshots/snap.vdi":    200,
+	"/vms/a/Snapshots/current.vdi": 50,
+	"/vms/c/leaked.vdi":            10,
+}
+
+func usageSize(path string) int64 {
+	return usageSizes[path]
+}
+
+func TestUsageOf(t *testing.T) {
+	usage := usageOf(vmA, usageMedia, mediumUsers(usageMedia), usageSize)
+
+	if len(usage.Media) != 5 {
+		t.Fatalf("expected the chains of both disks, got %+v", usage.Media)
+	}
+	if usage.OnDiskBytes != 1850 || usage.SharedBytes != 1000 || usage.ReclaimableBytes != 200 {
+		t.Errorf("unexpected totals on disk %d, shared %d, reclaimable %d", usage.OnDiskBytes, usage.SharedBytes, usage.ReclaimableBytes)
+	}
+	if usage.LogicalBytes != 150*megabyte {
+		t.Errorf("expected the capacity of the two disks, got %d", usage.LogicalBytes)
+	}
+	if !usage.Media[0].Shared || usage.Media[3].Shared {
+		t.Errorf("expected only the base to be shared, got %+v", usage.Media)
+	}
+}
+
+func TestHostUsage(t *testing.T) {
+	report := hostUsage(map[string]DiskUsage{
+		vmA: {Name: "a", Group: "/lab"},
+		vmB: {Name: "b", Group: "/lab"},
+	}, usageMedia, usageSize)
+
+	if len(report.VMs) != 2 || report.VMs[0].Name != "a" || report.VMs[1].OnDiskBytes != 1300 {
+		t.Errorf("expected vms sorted by usage, got %+v", report.VMs)
+	}
+	// the base both vms of the group share counts once
+	if len(report.Groups) != 1 || report.Groups[0].VMs != 2 || report.Groups[0].OnDiskBytes != 2150 {
+		t.Errorf("unexpected groups %+v", report.Groups)
+	}
+	if len(report.Unattached) != 1 || report.Unattached[0].UUID != "leaked" {
+		t.Errorf("expected the leaked medium to be unattached, got %+v", report.Unattached)
+	}
+	// the shared base counts once
+	if report.OnDiskBytes != 2160 || report.ReclaimableBytes != 210 {
+		t.Errorf("unexpected host totals on disk %d, reclaimable %d", report.OnDiskBytes, report.ReclaimableBytes)
+	}
+}
+
+func TestListVMsRegex(t *testing.T) {
+	m := reVMListLine.FindStringSubmatch(`"my vm" {6aa44e71-71c6-4e68-a61f-f69e133ecffa}`)
+	if m == nil || m[1] != "my vm" || m[2] != vmA {
+		t.Errorf("unexpected match %v", m)
+	}
+}
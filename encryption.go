@@ -0,0 +1,156 @@
+package virtualbox
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Cipher is the algorithm encrypted media are encrypted with
+type Cipher string
+
+const (
+	AES128 = Cipher("AES-XTS128-PLAIN64")
+	AES256 = Cipher("AES-XTS256-PLAIN64")
+)
+
+// EncryptionOptions selects how EncryptDisk encrypts a medium
+type EncryptionOptions struct {
+	Cipher Cipher
+	// PasswordID names the password, vms ask for it by this id when they start
+	PasswordID string
+	Password   string
+	// OldPassword is needed to change the password or cipher of an already encrypted medium
+	OldPassword string
+}
+
+// writePasswordFile stores the password in a file only the current user can read, so that it never shows up in
+// the process list. The caller removes the file
+func writePasswordFile(password string) (string, error) {
+	f, err := ioutil.TempFile("", "vbox-password")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if err := f.Chmod(0600); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	if _, err := f.WriteString(password); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// encryptMedium runs encryptmedium with the passwords given through files, an empty password leaves its option out
+func (vb *VBox) encryptMedium(disk *Disk, newPassword, oldPassword string, extra ...string) error {
+	args := []string{"encryptmedium", disk.UUIDorPath()}
+
+	for _, p := range []struct{ option, password string }{
+		{"--newpassword", newPassword},
+		{"--oldpassword", oldPassword},
+	} {
+		if p.password == "" {
+			continue
+		}
+		path, err := writePasswordFile(p.password)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(path)
+		args = append(args, p.option, path)
+	}
+
+	_, err := vb.manage(append(args, extra...)...)
+	return err
+}
+
+// EncryptDisk encrypts the disk, or changes the password and cipher of an already encrypted one. The disk must
+// not be in use by a running vm
+func (vb *VBox) EncryptDisk(disk *Disk, opts EncryptionOptions) (*Disk, error) {
+	if opts.Password == "" {
+		return nil, fmt.Errorf("a password is needed to encrypt disk %s", disk.UUIDorPath())
+	}
+	if opts.PasswordID == "" {
+		return nil, fmt.Errorf("a password id is needed to encrypt disk %s", disk.UUIDorPath())
+	}
+
+	d, err := vb.ensureNotInUse(disk)
+	if err != nil {
+		return nil, err
+	}
+	if d.Encrypted && opts.OldPassword == "" {
+		return nil, fmt.Errorf("disk %s is already encrypted, the old password is needed", d.UUIDorPath())
+	}
+
+	extra := []string{"--newpasswordid", opts.PasswordID}
+	if opts.Cipher != "" {
+		extra = append(extra, "--cipher", string(opts.Cipher))
+	}
+	if err := vb.encryptMedium(d, opts.Password, opts.OldPassword, extra...); err != nil {
+		return nil, err
+	}
+	return vb.DiskInfo(d)
+}
+
+// DecryptDisk removes the encryption of the disk, it must not be in use by a running vm
+func (vb *VBox) DecryptDisk(disk *Disk, password string) (*Disk, error) {
+	d, err := vb.ensureNotInUse(disk)
+	if err != nil {
+		return nil, err
+	}
+	if !d.Encrypted {
+		return d, nil
+	}
+
+	if err := vb.encryptMedium(d, "", password); err != nil {
+		return nil, err
+	}
+	return vb.DiskInfo(d)
+}
+
+// CheckDiskPassword tells whether the password unlocks the encrypted disk
+func (vb *VBox) CheckDiskPassword(disk *Disk, password string) (bool, error) {
+	_, err := vb.manageStreaming(context.Background(), strings.NewReader(password+"\n"), nil,
+		"checkmediumpwd", disk.UUIDorPath(), "-")
+	if err != nil {
+		if isWrongPasswordMessage(err.Error()) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func isWrongPasswordMessage(out string) bool {
+	out = strings.ToLower(out)
+	return strings.Contains(out, "password is incorrect") || strings.Contains(out, "invalid password")
+}
+
+// AddEncryptionPassword hands the password with the given id to the running vm, so it can open the disks encrypted
+// with it. With removeOnSuspend the vm forgets the password when it is suspended
+func (vb *VBox) AddEncryptionPassword(vm *VirtualMachine, id, password string, removeOnSuspend bool) error {
+	removal := "no"
+	if removeOnSuspend {
+		removal = "yes"
+	}
+	_, err := vb.manageStreaming(context.Background(), strings.NewReader(password+"\n"), nil,
+		"controlvm", vm.UUIDOrName(), "addencpassword", id, "-", "--removeonsuspend", removal)
+	return err
+}
+
+// RemoveEncryptionPassword makes the running vm forget the password with the given id
+func (vb *VBox) RemoveEncryptionPassword(vm *VirtualMachine, id string) error {
+	_, err := vb.control(vm, "removeencpassword", id)
+	return err
+}
+
+// RemoveAllEncryptionPasswords makes the running vm forget every password it was given
+func (vb *VBox) RemoveAllEncryptionPasswords(vm *VirtualMachine) error {
+	_, err := vb.control(vm, "removeallencpasswords")
+	return err
+}
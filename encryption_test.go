@@ -0,0 +1,59 @@
+package virtualbox
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestParseMediumInfoEncryption(t *testing.T) {
+	disk := parseMediumInfo(`UUID:           0e3f0c1b-f523-4a50-b1a8-d1e8c9a508b4
+Parent UUID:    base
+State:          created
+Type:           normal (base)
+Location:       /vms/disk1.vdi
+Storage format: VDI
+Capacity:       1000 MBytes
+Encryption:     enabled
+Property:       CRYPT/KeyId=customer-data
+Property:       CRYPT/KeyStore=U0NORQABQUVTLVhUUzI1Ni1QTEFJTjY0AAAAAAAAAAAAAAAAAAAA
+`)
+
+	if !disk.Encrypted || disk.EncryptionKeyID != "customer-data" {
+		t.Errorf("expected encrypted disk with key id, got %+v", disk)
+	}
+
+	if disk := parseMediumInfo("UUID:           0e3f0c1b-f523-4a50-b1a8-d1e8c9a508b4\nEncryption:     disabled\n"); disk.Encrypted {
+		t.Errorf("expected disk not to be encrypted")
+	}
+}
+
+func TestWritePasswordFile(t *testing.T) {
+	path, err := writePasswordFile("s3cret")
+	if err != nil {
+		t.Fatalf("writing password file failed %v", err)
+	}
+	defer os.Remove(path)
+
+	st, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode().Perm() != 0600 {
+		t.Errorf("expected password file to be private, got %v", st.Mode())
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil || string(content) != "s3cret" {
+		t.Errorf("expected password in file, got %q %v", content, err)
+	}
+}
+
+func TestIsWrongPasswordMessage(t *testing.T) {
+	if !isWrongPasswordMessage("VBoxManage: error: The given password is incorrect") {
+		t.Errorf("expected wrong password to be detected")
+	}
+	if isWrongPasswordMessage("VBoxManage: error: Could not find file for the medium") {
+		t.Errorf("expected other errors not to be taken for a wrong password")
+	}
+}
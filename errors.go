@@ -25,7 +25,10 @@ type ValidationError struct {
 }
 
 func (v ValidationError) Error() string {
-	return v.Err.Error()
+	if v.Path == "" {
+		return v.Err.Error()
+	}
+	return v.Path + ": " + v.Err.Error()
 }
 
 type ValidationErrors struct {
@@ -40,10 +43,20 @@ func (v ValidationErrors) Error() string {
 
 	return strings.Join(messages, "\n")
 }
-func (v ValidationErrors) Add(path string, err error) {
+func (v *ValidationErrors) Add(path string, err error) {
 	v.errors = append(v.errors, ValidationError{path, err})
 }
 
+// Errors returns the individual validation errors, each with the path of the offending field
+func (v ValidationErrors) Errors() []ValidationError {
+	return v.errors
+}
+
+func IsValidationErrors(err error) bool {
+	_, ok := err.(ValidationErrors)
+	return ok
+}
+
 type AlreadyExists string
 
 func (v AlreadyExists) Error() string {
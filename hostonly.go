@@ -0,0 +1,339 @@
+package virtualbox
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/golang/glog"
+)
+
+// defaultIPv6PrefixLen is what VirtualBox uses when no prefix length is given
+const defaultIPv6PrefixLen = 64
+
+// hostOnlyAddress returns the ipv4 address and mask of the host on the network, IPNet may be in CIDR notation
+func hostOnlyAddress(nw Network) (ip, mask string, err error) {
+	if nw.IPNet == "" {
+		return "", "", nil
+	}
+
+	if ipAddr, ipNet, err := net.ParseCIDR(nw.IPNet); err == nil {
+		if ipAddr.To4() == nil {
+			return "", "", fmt.Errorf("network %s is not an ipv4 network", nw.IPNet)
+		}
+		return ipAddr.To4().String(), net.IP(ipNet.Mask).String(), nil
+	}
+
+	ipAddr := net.ParseIP(nw.IPNet).To4()
+	if ipAddr == nil {
+		return "", "", fmt.Errorf("invalid ipv4 address %s", nw.IPNet)
+	}
+	mask = nw.IPMask
+	if mask == "" {
+		mask = "255.255.255.0"
+	}
+	if m := net.ParseIP(mask).To4(); m == nil {
+		return "", "", fmt.Errorf("invalid network mask %s", mask)
+	}
+	return ipAddr.String(), mask, nil
+}
+
+func sameIPv6(have Network, want Network) bool {
+	prefix := func(n int) int {
+		if n == 0 {
+			return defaultIPv6PrefixLen
+		}
+		return n
+	}
+	return sameIP(have.IPv6Address, want.IPv6Address) && prefix(have.IPv6PrefixLen) == prefix(want.IPv6PrefixLen)
+}
+
+// findHostOnly returns the interface with the address and mask of want, or failing that the one named like it
+func findHostOnly(nws []Network, want Network) (*Network, error) {
+	ip, mask, err := hostOnlyAddress(want)
+	if err != nil {
+		return nil, err
+	}
+
+	if ip != "" {
+		for i, nw := range nws {
+			if sameIP(nw.IPNet, ip) && sameIP(nw.IPMask, mask) {
+				return &nws[i], nil
+			}
+		}
+	}
+	if want.Name != "" {
+		for i, nw := range nws {
+			if nw.Name == want.Name {
+				return &nws[i], nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// hostOnlyIPConfigCommands returns the hostonlyif ipconfig invocations giving the interface the addresses of want.
+// Addresses the interface already has are left alone, ipv4 and ipv6 take one call each
+func hostOnlyIPConfigCommands(want Network, have *Network) ([][]string, error) {
+	ip, mask, err := hostOnlyAddress(want)
+	if err != nil {
+		return nil, err
+	}
+
+	name := want.Name
+	if have != nil {
+		name = have.Name
+	}
+	if name == "" {
+		return nil, fmt.Errorf("host-only interface has no name")
+	}
+
+	var cmds [][]string
+	if ip != "" && (have == nil || !sameIP(have.IPNet, ip) || !sameIP(have.IPMask, mask)) {
+		cmds = append(cmds, []string{"hostonlyif", "ipconfig", name, "--ip", ip, "--netmask", mask})
+	}
+	if want.IPv6Address != "" && (have == nil || !sameIPv6(*have, want)) {
+		prefix := want.IPv6PrefixLen
+		if prefix == 0 {
+			prefix = defaultIPv6PrefixLen
+		}
+		cmds = append(cmds, []string{"hostonlyif", "ipconfig", name, "--ipv6", want.IPv6Address,
+			"--netmasklengthv6", strconv.Itoa(prefix)})
+	}
+	return cmds, nil
+}
+
+// hostOnlyDHCP fills in what the dhcp server of the host-only interface leaves out: its network name, and the
+// addresses of the server and the lease range. The server takes the first free address of the network and the
+// range the longest run of addresses up to broadcast that leaves out both the host and the server
+func hostOnlyDHCP(name, ip, mask string, dhcp DHCPServer) (DHCPServer, error) {
+	dhcp.NetworkName = "HostInterfaceNetworking-" + name
+	if dhcp.NetworkMask == "" {
+		dhcp.NetworkMask = mask
+	}
+	if dhcp.IPAddress != "" && dhcp.LowerIPAddress != "" && dhcp.UpperIPAddress != "" {
+		return dhcp, nil
+	}
+
+	host, m := net.ParseIP(ip).To4(), net.ParseIP(dhcp.NetworkMask).To4()
+	if host == nil || m == nil {
+		return dhcp, fmt.Errorf("cannot derive dhcp addresses of %s without its ipv4 address and mask", name)
+	}
+	bits := binary.BigEndian.Uint32(m)
+	base, hostAddr := binary.BigEndian.Uint32(host)&bits, binary.BigEndian.Uint32(host)
+	broadcast := base | ^bits
+	if broadcast-base < 4 {
+		return dhcp, fmt.Errorf("network of %s is too small for a dhcp server", name)
+	}
+
+	addr := func(v uint32) string {
+		b := make(net.IP, 4)
+		binary.BigEndian.PutUint32(b, v)
+		return b.String()
+	}
+	server := base + 1
+	if server == hostAddr {
+		server++
+	}
+	if dhcp.IPAddress == "" {
+		dhcp.IPAddress = addr(server)
+	} else if ip := net.ParseIP(dhcp.IPAddress).To4(); ip != nil {
+		server = binary.BigEndian.Uint32(ip)
+	}
+
+	// the range is the longest run of addresses between those of the host and the server
+	reserved := []uint32{hostAddr, server}
+	if server < hostAddr {
+		reserved = []uint32{server, hostAddr}
+	}
+	var lower, upper, longest uint32
+	start := base + 1
+	for _, r := range append(reserved, broadcast) {
+		if r < start || r > broadcast {
+			continue
+		}
+		if r-start > longest {
+			lower, upper, longest = start, r-1, r-start
+		}
+		start = r + 1
+	}
+
+	if dhcp.LowerIPAddress == "" {
+		dhcp.LowerIPAddress = addr(lower)
+	}
+	if dhcp.UpperIPAddress == "" {
+		dhcp.UpperIPAddress = addr(upper)
+	}
+	return dhcp, nil
+}
+
+// ensureDHCPServer adds the dhcp server or brings the one already there in line with it, leaving a server that
+// matches alone
+func (vb *VBox) ensureDHCPServer(dhcp DHCPServer) error {
+	servers, err := vb.ListDHCPServers()
+	if err != nil {
+		return err
+	}
+	if have, ok := servers[dhcp.NetworkName]; ok {
+		if sameIP(have.IPAddress, dhcp.IPAddress) && sameIP(have.NetworkMask, dhcp.NetworkMask) &&
+			sameIP(have.LowerIPAddress, dhcp.LowerIPAddress) && sameIP(have.UpperIPAddress, dhcp.UpperIPAddress) &&
+			have.Enabled == dhcp.Enabled {
+			return nil
+		}
+		return vb.ModifyDHCPServer(dhcp, []string{"ip", "netmask", "lowerip", "upperip", "work"})
+	}
+	_, err = vb.AddDHCPServer(dhcp)
+	return err
+}
+
+// EnsureHostOnlyNetwork returns the host-only interface with the address of the network, or else with its name,
+// after configuring its ipv4 and ipv6 addresses. It creates the interface when there is none, and pairs it with
+// nw.DHCP when set. Calling it again with the same network changes nothing
+func (vb *VBox) EnsureHostOnlyNetwork(ctx context.Context, nw Network) (*Network, error) {
+	if prefix, ok := anySubnetPrefix(nw.IPNet); ok {
+		// a new interface gets its subnet as it is created, under the name vbox gives it, an existing one keeps the
+		// subnet it was given
+		exists := false
+		if nw.Name != "" {
+			out, err := vb.manageWithContext(ctx, "list", "hostonlyifs")
+			if err != nil {
+				return nil, err
+			}
+			for _, current := range parseHostOnlyIfs(out) {
+				exists = exists || current.Name == nw.Name
+			}
+		}
+		if !exists {
+			if nw.DHCP != nil {
+				dhcp := *nw.DHCP
+				nw.DHCP = &dhcp
+			}
+			if err := vb.CreateNet(&nw); err != nil {
+				return nil, err
+			}
+			ensured, err := vb.EnsureHostOnlyNetwork(ctx, nw)
+			if err != nil {
+				if derr := vb.DeleteNet(&nw); derr != nil {
+					glog.Warningf("removing host-only interface %s failed: %v", nw.Name, derr)
+				}
+				return nil, err
+			}
+			return ensured, nil
+		}
+		a, err := vb.AllocateSubnet(ctx, hostOnlyOwner(nw.Name), prefix)
+		if err != nil {
+			return nil, err
+		}
+		nw.IPNet, nw.IPMask = a.Gateway, a.Mask()
+		if nw.DHCP != nil {
+			dhcp := *nw.DHCP
+			a.dhcp(&dhcp)
+			nw.DHCP = &dhcp
+		}
+	}
+
+	out, err := vb.manageWithContext(ctx, "list", "hostonlyifs")
+	if err != nil {
+		return nil, err
+	}
+	have, err := findHostOnly(parseHostOnlyIfs(out), nw)
+	if err != nil {
+		return nil, err
+	}
+
+	// an interface created here goes again when configuring it fails, or each retry would leave another one
+	created := false
+	fail := func(err error) (*Network, error) {
+		if created {
+			if _, rerr := vb.manage("hostonlyif", "remove", nw.Name); rerr != nil {
+				glog.Warningf("removing host-only interface %s failed: %v", nw.Name, rerr)
+			}
+		}
+		return nil, err
+	}
+
+	if have == nil {
+		n := nw
+		if err := vb.CreateNet(&n); err != nil {
+			return nil, err
+		}
+		nw.Name, created = n.Name, true
+	}
+
+	cmds, err := hostOnlyIPConfigCommands(nw, have)
+	if err != nil {
+		return fail(err)
+	}
+	for _, args := range cmds {
+		if _, err := vb.manageWithContext(ctx, args...); err != nil {
+			return fail(err)
+		}
+	}
+
+	if have != nil {
+		nw.Name = have.Name
+	}
+	if nw.DHCP != nil {
+		ip, mask, err := hostOnlyAddress(nw)
+		if err != nil {
+			return fail(err)
+		}
+		dhcp, err := hostOnlyDHCP(nw.Name, ip, mask, *nw.DHCP)
+		if err != nil {
+			return fail(err)
+		}
+		if err := vb.ensureDHCPServer(dhcp); err != nil {
+			return fail(err)
+		}
+	}
+
+	out, err = vb.manageWithContext(ctx, "list", "hostonlyifs")
+	if err != nil {
+		return nil, err
+	}
+	for _, current := range parseHostOnlyIfs(out) {
+		if current.Name == nw.Name {
+			current.DHCP = nw.DHCP
+			vb.HostOnlyNws[current.Name] = &current
+			return &current, nil
+		}
+	}
+	return nil, NotFoundError(fmt.Sprintf("host-only interface %s vanished", nw.Name))
+}
+
+// EnsureNets reconciles the networks of the config on startup: host-only interfaces are created or reconfigured
+// as needed, missing nat networks are created while existing ones are left as they are, bridged interfaces must
+// exist, and internal networks come into being with their first nic. Config.Networks is updated with what was found, for e.g the names given to new interfaces
+func (vb *VBox) EnsureNets(ctx context.Context) error {
+	if err := vb.SyncNICs(); err != nil {
+		return err
+	}
+
+	for i, nw := range vb.Config.Networks {
+		path := fmt.Sprintf("network/%d", i)
+		switch nw.Mode {
+		case NWMode_hostonly:
+			ensured, err := vb.EnsureHostOnlyNetwork(ctx, nw)
+			if err != nil {
+				return OperationError{Path: path, Op: "ensure", Err: err}
+			}
+			vb.Config.Networks[i] = *ensured
+		case NWMode_natnetwork:
+			if _, ok := vb.NatNws[nw.Name]; ok {
+				continue
+			}
+			nat := &NatNetwork{NetName: nw.Name, Network: nw.IPNet, Enabled: true, DHCP: nw.DHCP != nil}
+			if err := vb.AddNatNet(nat); err != nil && !isAlreadyExistErrorMessage(err.Error()) {
+				return OperationError{Path: path, Op: "ensure", Err: err}
+			}
+		case NWMode_bridged:
+			if _, ok := vb.BridgedNws[nw.Name]; !ok {
+				return OperationError{Path: path, Op: "ensure", Err: NotFoundError(fmt.Sprintf("bridged interface %s not found", nw.Name))}
+			}
+		}
+	}
+
+	return vb.SyncNICs()
+}
@@ -0,0 +1,334 @@
+package virtualbox
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const hostOnlyIfs = `Name:            vboxnet0
+GUID:            786f6276-656e-4074-8000-0a0027000000
+DHCP:            Disabled
+IPAddress:       192.168.56.1
+NetworkMask:     255.255.255.0
+IPV6Address:     fe80::800:27ff:fe00:0
+IPV6NetworkMaskPrefixLength: 64
+HardwareAddress: 0a:00:27:00:00:00
+MediumType:      Ethernet
+Wireless:        No
+Status:          Up
+VBoxNetworkName: HostInterfaceNetworking-vboxnet0
+
+Name:            vboxnet1
+GUID:            786f6276-656e-4174-8000-0a0027000001
+DHCP:            Disabled
+IPAddress:       10.10.0.1
+NetworkMask:     255.255.0.0
+IPV6Address:
+IPV6NetworkMaskPrefixLength: 0
+HardwareAddress: 0a:00:27:00:00:01
+MediumType:      Ethernet
+Wireless:        No
+Status:          Down
+VBoxNetworkName: HostInterfaceNetworking-vboxnet1
+`
+
+func TestParseHostOnlyIfs(t *testing.T) {
+	nws := parseHostOnlyIfs(hostOnlyIfs)
+	if len(nws) != 2 {
+		t.Fatalf("expected 2 interfaces, got %+v", nws)
+	}
+
+	expected := Network{
+		GUID:          "786f6276-656e-4074-8000-0a0027000000",
+		Name:          "vboxnet0",
+		IPNet:         "192.168.56.1",
+		IPMask:        "255.255.255.0",
+		IPv6Address:   "fe80::800:27ff:fe00:0",
+		IPv6PrefixLen: 64,
+		Mode:          NWMode_hostonly,
+		DeviceName:    "vboxnet0",
+		HWAddress:     "0a:00:27:00:00:00",
+	}
+	if !reflect.DeepEqual(nws[0], expected) {
+		t.Errorf("expected %+v, got %+v", expected, nws[0])
+	}
+	if nws[1].Name != "vboxnet1" || nws[1].IPMask != "255.255.0.0" {
+		t.Errorf("expected last interface without trailing blank line, got %+v", nws[1])
+	}
+}
+
+func TestFindHostOnly(t *testing.T) {
+	nws := parseHostOnlyIfs(hostOnlyIfs)
+
+	for _, c := range []struct {
+		want     Network
+		expected string
+	}{
+		{Network{IPNet: "10.10.0.1/16"}, "vboxnet1"},
+		{Network{IPNet: "192.168.56.1", IPMask: "255.255.255.0"}, "vboxnet0"},
+		{Network{IPNet: "192.168.56.1"}, "vboxnet0"},
+		{Network{Name: "vboxnet1", IPNet: "192.168.99.1/24"}, "vboxnet1"},
+		{Network{IPNet: "10.10.0.1/24"}, ""},
+	} {
+		found, err := findHostOnly(nws, c.want)
+		if err != nil {
+			t.Fatalf("finding %+v failed %v", c.want, err)
+		}
+		if (found == nil && c.expected != "") || (found != nil && found.Name != c.expected) {
+			t.Errorf("expected %+v to find %q, got %+v", c.want, c.expected, found)
+		}
+	}
+
+	if _, err := findHostOnly(nws, Network{IPNet: "fd00::1/64"}); err == nil {
+		t.Errorf("expected an ipv6 CIDR to be rejected")
+	}
+}
+
+func TestHostOnlyIPConfigCommands(t *testing.T) {
+	nws := parseHostOnlyIfs(hostOnlyIfs)
+
+	cmds, err := hostOnlyIPConfigCommands(Network{IPNet: "192.168.56.1/24", IPv6Address: "fe80::800:27ff:fe00:0"}, &nws[0])
+	if err != nil || len(cmds) != 0 {
+		t.Errorf("expected nothing to change, got %v %v", cmds, err)
+	}
+
+	cmds, err = hostOnlyIPConfigCommands(Network{IPNet: "192.168.57.1/24", IPv6Address: "fd00::1", IPv6PrefixLen: 48}, &nws[1])
+	expected := [][]string{
+		{"hostonlyif", "ipconfig", "vboxnet1", "--ip", "192.168.57.1", "--netmask", "255.255.255.0"},
+		{"hostonlyif", "ipconfig", "vboxnet1", "--ipv6", "fd00::1", "--netmasklengthv6", "48"},
+	}
+	if err != nil || !reflect.DeepEqual(cmds, expected) {
+		t.Errorf("expected %v, got %v %v", expected, cmds, err)
+	}
+
+	if _, err := hostOnlyIPConfigCommands(Network{IPNet: "192.168.57.1/24"}, nil); err == nil {
+		t.Errorf("expected an error without interface name")
+	}
+}
+
+func TestHostOnlyDHCP(t *testing.T) {
+	dhcp, err := hostOnlyDHCP("vboxnet0", "192.168.56.1", "255.255.255.0", DHCPServer{Enabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := DHCPServer{
+		NetworkName:    "HostInterfaceNetworking-vboxnet0",
+		IPAddress:      "192.168.56.2",
+		NetworkMask:    "255.255.255.0",
+		LowerIPAddress: "192.168.56.3",
+		UpperIPAddress: "192.168.56.254",
+		Enabled:        true,
+	}
+	if !reflect.DeepEqual(dhcp, expected) {
+		t.Errorf("expected %+v, got %+v", expected, dhcp)
+	}
+
+	// neither the host nor the server address is leased
+	dhcp, err = hostOnlyDHCP("vboxnet1", "10.10.0.3", "255.255.0.0", DHCPServer{IPAddress: "10.10.0.100"})
+	if err != nil || dhcp.IPAddress != "10.10.0.100" || dhcp.LowerIPAddress != "10.10.0.101" || dhcp.UpperIPAddress != "10.10.255.254" {
+		t.Errorf("unexpected dhcp server %+v %v", dhcp, err)
+	}
+
+	dhcp, err = hostOnlyDHCP("vboxnet1", "10.10.0.3", "255.255.255.0", DHCPServer{})
+	if err != nil || dhcp.IPAddress != "10.10.0.1" || dhcp.LowerIPAddress != "10.10.0.4" || dhcp.UpperIPAddress != "10.10.0.254" {
+		t.Errorf("unexpected dhcp server %+v %v", dhcp, err)
+	}
+
+	dhcp, err = hostOnlyDHCP("vboxnet1", "10.10.0.254", "255.255.255.0", DHCPServer{})
+	if err != nil || dhcp.LowerIPAddress != "10.10.0.2" || dhcp.UpperIPAddress != "10.10.0.253" {
+		t.Errorf("unexpected dhcp server %+v %v", dhcp, err)
+	}
+
+	if _, err := hostOnlyDHCP("vboxnet2", "10.0.0.1", "255.255.255.252", DHCPServer{}); err == nil {
+		t.Errorf("expected a /30 network to be too small")
+	}
+}
+
+// fakeHostOnly scripts the host-only interfaces and dhcp servers of VBoxManage
+type fakeHostOnly struct {
+	ifs      []Network
+	servers  []DHCPServer
+	commands []string
+	// fail fails the commands starting with it
+	fail string
+}
+
+func (f *fakeHostOnly) run(ctx context.Context, args ...string) (string, error) {
+	cmd := strings.Join(args, " ")
+	f.commands = append(f.commands, cmd)
+	if f.fail != "" && strings.HasPrefix(cmd, f.fail) {
+		return "", fmt.Errorf("%s failed", f.fail)
+	}
+
+	switch {
+	case cmd == "list hostonlyifs":
+		var out []string
+		for _, nw := range f.ifs {
+			out = append(out, fmt.Sprintf("Name:            %s\nIPAddress:       %s\nNetworkMask:     %s\n", nw.Name, nw.IPNet, nw.IPMask))
+		}
+		return strings.Join(out, "\n"), nil
+	case cmd == "list dhcpservers":
+		var out []string
+		for _, d := range f.servers {
+			enabled := "No"
+			if d.Enabled {
+				enabled = "Yes"
+			}
+			out = append(out, fmt.Sprintf("NetworkName:    %s\nDhcpd IP:       %s\nLowerIPAddress: %s\nUpperIPAddress: %s\nNetworkMask:    %s\nEnabled:        %s\n",
+				d.NetworkName, d.IPAddress, d.LowerIPAddress, d.UpperIPAddress, d.NetworkMask, enabled))
+		}
+		return strings.Join(out, "\n"), nil
+	case cmd == "hostonlyif create":
+		name := fmt.Sprintf("vboxnet%d", len(f.ifs))
+		f.ifs = append(f.ifs, Network{Name: name, Mode: NWMode_hostonly})
+		return fmt.Sprintf("Interface '%s' was successfully created\n", name), nil
+	case strings.HasPrefix(cmd, "hostonlyif ipconfig") && args[3] == "--ip":
+		for i := range f.ifs {
+			if f.ifs[i].Name == args[2] {
+				f.ifs[i].IPNet, f.ifs[i].IPMask = args[4], args[6]
+			}
+		}
+	case strings.HasPrefix(cmd, "hostonlyif remove"):
+		for i := range f.ifs {
+			if f.ifs[i].Name == args[2] {
+				f.ifs = append(f.ifs[:i], f.ifs[i+1:]...)
+				break
+			}
+		}
+	case strings.HasPrefix(cmd, "dhcpserver add"):
+		d := DHCPServer{NetworkName: args[3], Enabled: args[8] == "--enable"}
+		d.IPAddress = strings.TrimPrefix(args[4], "--ip=")
+		d.NetworkMask = strings.TrimPrefix(args[5], "--netmask=")
+		d.LowerIPAddress = strings.TrimPrefix(args[6], "--lowerip=")
+		d.UpperIPAddress = strings.TrimPrefix(args[7], "--upperip=")
+		f.servers = append(f.servers, d)
+	}
+	return "", nil
+}
+
+// changes returns the commands that are not listings
+func (f *fakeHostOnly) changes() []string {
+	var changes []string
+	for _, c := range f.commands {
+		if !strings.HasPrefix(c, "list") && !strings.HasPrefix(c, "natnetwork list") {
+			changes = append(changes, c)
+		}
+	}
+	return changes
+}
+
+func TestEnsureHostOnlyNetwork(t *testing.T) {
+	fake := &fakeHostOnly{}
+	vb := NewVBox(Config{})
+	vb.run = fake.run
+
+	nw := Network{IPNet: "192.168.60.1", IPMask: "255.255.255.0", Mode: NWMode_hostonly, DHCP: &DHCPServer{Enabled: true}}
+	ensured, err := vb.EnsureHostOnlyNetwork(context.Background(), nw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ensured.Name != "vboxnet0" || ensured.IPNet != "192.168.60.1" {
+		t.Errorf("unexpected interface %+v", ensured)
+	}
+	expected := []string{
+		"hostonlyif create",
+		"hostonlyif ipconfig vboxnet0 --ip 192.168.60.1 --netmask 255.255.255.0",
+		"dhcpserver add --netname HostInterfaceNetworking-vboxnet0 --ip=192.168.60.2 --netmask=255.255.255.0 --lowerip=192.168.60.3 --upperip=192.168.60.254 --enable",
+	}
+	if changes := fake.changes(); !reflect.DeepEqual(changes, expected) {
+		t.Errorf("expected %v, got %v", expected, changes)
+	}
+
+	// calling it again changes nothing
+	fake.commands = nil
+	if _, err := vb.EnsureHostOnlyNetwork(context.Background(), nw); err != nil {
+		t.Fatal(err)
+	}
+	if changes := fake.changes(); len(changes) != 0 {
+		t.Errorf("expected no changes the second time, got %v", changes)
+	}
+}
+
+func TestEnsureHostOnlyNetworkRemovesFailedInterface(t *testing.T) {
+	fake := &fakeHostOnly{fail: "dhcpserver add"}
+	vb := NewVBox(Config{})
+	vb.run = fake.run
+
+	nw := Network{IPNet: "192.168.60.1", IPMask: "255.255.255.0", Mode: NWMode_hostonly, DHCP: &DHCPServer{Enabled: true}}
+	if _, err := vb.EnsureHostOnlyNetwork(context.Background(), nw); err == nil {
+		t.Fatal("expected adding the dhcp server to fail")
+	}
+	if len(fake.ifs) != 0 {
+		t.Errorf("expected the new interface to be removed, got %+v", fake.ifs)
+	}
+}
+
+func TestEnsureNets(t *testing.T) {
+	fake := &fakeHostOnly{}
+	vb := NewVBox(Config{Networks: []Network{
+		{IPNet: "192.168.60.1", IPMask: "255.255.255.0", Mode: NWMode_hostonly},
+		{IPNet: "192.168.61.1", IPMask: "255.255.255.0", Mode: NWMode_hostonly},
+	}})
+	vb.run = fake.run
+
+	if err := vb.EnsureNets(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if vb.Config.Networks[0].Name != "vboxnet0" || vb.Config.Networks[1].Name != "vboxnet1" {
+		t.Errorf("expected the names of the new interfaces, got %+v", vb.Config.Networks)
+	}
+
+	fake.commands = nil
+	if err := vb.EnsureNets(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if changes := fake.changes(); len(changes) != 0 {
+		t.Errorf("expected no changes the second time, got %v", changes)
+	}
+}
+
+func TestEnsureHostOnlyNetworkAnySubnet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "subnets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fake := &fakeHostOnly{}
+	vb := NewVBox(Config{BasePath: dir})
+	vb.run = fake.run
+
+	// the interface is named by vbox, so the subnet has to be recorded under that name rather than the one asked for
+	nw := Network{Name: "lab", IPNet: AnySubnet(24), Mode: NWMode_hostonly, DHCP: &DHCPServer{Enabled: true}}
+	ensured, err := vb.EnsureHostOnlyNetwork(context.Background(), nw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ensured.Name != "vboxnet0" {
+		t.Fatalf("expected vboxnet0, got %s", ensured.Name)
+	}
+	var allocations []SubnetAllocation
+	if err := vb.readStateFile(subnetAllocationsFile, &allocations); err != nil {
+		t.Fatal(err)
+	}
+	if len(allocations) != 1 || allocations[0].Owner != hostOnlyOwner("vboxnet0") || allocations[0].Gateway != ensured.IPNet {
+		t.Fatalf("expected the subnet of vboxnet0 allocated, got %+v", allocations)
+	}
+
+	ensured.Mode = NWMode_hostonly
+	if err := vb.DeleteNet(ensured); err != nil {
+		t.Fatal(err)
+	}
+	allocations = nil
+	if err := vb.readStateFile(subnetAllocationsFile, &allocations); err != nil || len(allocations) != 0 {
+		t.Errorf("expected no subnets left, got %+v, %v", allocations, err)
+	}
+	if len(fake.ifs) != 0 {
+		t.Errorf("expected the interface removed, got %+v", fake.ifs)
+	}
+}
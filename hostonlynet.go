@@ -0,0 +1,167 @@
+package virtualbox
+
+import (
+	"fmt"
+	"strings"
+)
+
+// HostOnlyNet is a host-only network of VirtualBox 7 and later, which replaces host-only interfaces on hosts
+// where VirtualBox cannot create them. Guests get their addresses out of the LowerIP to UpperIP range
+type HostOnlyNet struct {
+	Name        string
+	GUID        string
+	NetworkMask string
+	LowerIP     string
+	UpperIP     string
+	Enabled     bool
+	// NetworkName is the name VirtualBox gives the network internally, for e.g to pair it with a dhcp server
+	NetworkName string
+}
+
+// Network returns the host-only network in the form SyncNICs keeps networks, it has no host address
+func (n HostOnlyNet) Network() Network {
+	return Network{GUID: n.GUID, Name: n.Name, IPMask: n.NetworkMask, Mode: NWMode_hostonlynet}
+}
+
+// hostOnlyNetFor returns the host-only network CreateNet and ChangeNet set up for the network. The address range is
+// that of its dhcp server, or else the one hostOnlyDHCP derives from IPNet and IPMask
+func hostOnlyNetFor(nw Network) (*HostOnlyNet, error) {
+	ip, mask, err := hostOnlyAddress(nw)
+	if err != nil {
+		return nil, err
+	}
+
+	var dhcp DHCPServer
+	if nw.DHCP != nil {
+		dhcp = *nw.DHCP
+	}
+	if dhcp.LowerIPAddress == "" || dhcp.UpperIPAddress == "" {
+		if dhcp, err = hostOnlyDHCP(nw.Name, ip, mask, dhcp); err != nil {
+			return nil, err
+		}
+	}
+	if mask == "" {
+		mask = dhcp.NetworkMask
+	}
+	return &HostOnlyNet{Name: nw.Name, NetworkMask: mask, LowerIP: dhcp.LowerIPAddress, UpperIP: dhcp.UpperIPAddress, Enabled: true}, nil
+}
+
+// parseHostOnlyNets parses the blank line separated networks listed by list hostonlynets
+func parseHostOnlyNets(out string) []HostOnlyNet {
+	var nets []HostOnlyNet
+
+	var n HostOnlyNet
+	_ = tryParseKeyValues(out, reColonLine, func(key, val string, ok bool) error {
+		switch key {
+		case "Name":
+			n.Name = val
+		case "GUID":
+			n.GUID = val
+		case "State":
+			n.Enabled = val == "Enabled"
+		case "NetworkMask":
+			n.NetworkMask = val
+		case "LowerIP":
+			n.LowerIP = val
+		case "UpperIP":
+			n.UpperIP = val
+		case "VBoxNetworkName":
+			n.NetworkName = val
+		default:
+			if !ok && strings.TrimSpace(val) == "" && n.Name != "" {
+				nets = append(nets, n)
+				n = HostOnlyNet{}
+			}
+		}
+		return nil
+	})
+	if n.Name != "" {
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// hostOnlyNetArgs returns the hostonlynet options for the addresses and state of the network
+func hostOnlyNetArgs(n *HostOnlyNet) []string {
+	args := []string{"--name=" + n.Name}
+	if n.NetworkMask != "" {
+		args = append(args, "--netmask="+n.NetworkMask)
+	}
+	if n.LowerIP != "" {
+		args = append(args, "--lower-ip="+n.LowerIP)
+	}
+	if n.UpperIP != "" {
+		args = append(args, "--upper-ip="+n.UpperIP)
+	}
+	if n.Enabled {
+		args = append(args, "--enable")
+	} else {
+		args = append(args, "--disable")
+	}
+	return args
+}
+
+// ListHostOnlyNets returns the host-only networks, VirtualBox releases before 7 have none and fail
+func (vb *VBox) ListHostOnlyNets() ([]HostOnlyNet, error) {
+	out, err := vb.manage("list", "hostonlynets")
+	if err != nil {
+		return nil, err
+	}
+	return parseHostOnlyNets(out), nil
+}
+
+// HostOnlyNetworkInfo returns the named host-only network
+func (vb *VBox) HostOnlyNetworkInfo(name string) (*HostOnlyNet, error) {
+	nets, err := vb.ListHostOnlyNets()
+	if err != nil {
+		return nil, err
+	}
+	for i := range nets {
+		if nets[i].Name == name {
+			return &nets[i], nil
+		}
+	}
+	return nil, NotFoundError(fmt.Sprintf("host-only network %s not found", name))
+}
+
+// AddHostOnlyNet creates the host-only network, the mask and address range are required
+func (vb *VBox) AddHostOnlyNet(n *HostOnlyNet) error {
+	if n.Name == "" || n.NetworkMask == "" || n.LowerIP == "" || n.UpperIP == "" {
+		return fmt.Errorf("host-only network needs a name, mask and address range, got %+v", *n)
+	}
+
+	_, err := vb.manage(append([]string{"hostonlynet", "add"}, hostOnlyNetArgs(n)...)...)
+	if err != nil && isAlreadyExistErrorMessage(err.Error()) {
+		return AlreadyExistsErrorr.New(n.Name)
+	}
+	if err != nil {
+		return err
+	}
+
+	nw := n.Network()
+	vb.HostOnlyNets[n.Name] = &nw
+	return nil
+}
+
+// ModifyHostOnlyNet changes the mask, address range and state of the host-only network to those given
+func (vb *VBox) ModifyHostOnlyNet(n *HostOnlyNet) error {
+	_, err := vb.manage(append([]string{"hostonlynet", "modify"}, hostOnlyNetArgs(n)...)...)
+	if err != nil && isHostDeviceNotFound(err.Error()) {
+		return NotFoundError(err.Error())
+	}
+	return err
+}
+
+// RemoveHostOnlyNet deletes the host-only network
+func (vb *VBox) RemoveHostOnlyNet(name string) error {
+	_, err := vb.manage("hostonlynet", "remove", "--name="+name)
+	if err != nil && isHostDeviceNotFound(err.Error()) {
+		return NotFoundError(err.Error())
+	}
+	if err != nil {
+		return err
+	}
+
+	delete(vb.HostOnlyNets, name)
+	return nil
+}
@@ -0,0 +1,172 @@
+package virtualbox
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseHostOnlyNets(t *testing.T) {
+	nets := parseHostOnlyNets(`Name:            HostNetwork
+GUID:            1a2b3c4d-0000-4000-8000-0a0027000000
+State:           Enabled
+NetworkMask:     255.255.255.0
+LowerIP:         192.168.60.100
+UpperIP:         192.168.60.200
+VBoxNetworkName: hostonly-HostNetwork
+
+Name:            Lab
+GUID:            1a2b3c4d-0000-4000-8000-0a0027000001
+State:           Disabled
+NetworkMask:     255.255.0.0
+LowerIP:         10.20.0.10
+UpperIP:         10.20.255.250
+VBoxNetworkName: hostonly-Lab
+`)
+
+	expected := []HostOnlyNet{
+		{Name: "HostNetwork", GUID: "1a2b3c4d-0000-4000-8000-0a0027000000", NetworkMask: "255.255.255.0",
+			LowerIP: "192.168.60.100", UpperIP: "192.168.60.200", Enabled: true, NetworkName: "hostonly-HostNetwork"},
+		{Name: "Lab", GUID: "1a2b3c4d-0000-4000-8000-0a0027000001", NetworkMask: "255.255.0.0",
+			LowerIP: "10.20.0.10", UpperIP: "10.20.255.250", NetworkName: "hostonly-Lab"},
+	}
+	if !reflect.DeepEqual(nets, expected) {
+		t.Errorf("expected %+v, got %+v", expected, nets)
+	}
+}
+
+func TestHostOnlyNetArgs(t *testing.T) {
+	args := hostOnlyNetArgs(&HostOnlyNet{Name: "Lab", NetworkMask: "255.255.0.0", LowerIP: "10.20.0.10", UpperIP: "10.20.255.250", Enabled: true})
+	expected := []string{"--name=Lab", "--netmask=255.255.0.0", "--lower-ip=10.20.0.10", "--upper-ip=10.20.255.250", "--enable"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("expected %v, got %v", expected, args)
+	}
+
+	if args := hostOnlyNetArgs(&HostOnlyNet{Name: "Lab"}); !reflect.DeepEqual(args, []string{"--name=Lab", "--disable"}) {
+		t.Errorf("expected only name and state, got %v", args)
+	}
+}
+
+func TestSettingsHostOnlyNet(t *testing.T) {
+	var settings settingsFile
+	if err := xml.Unmarshal([]byte(`<VirtualBox>
+  <Machine uuid="{6aa44e71-71c6-4e68-a61f-f69e133ecffa}" name="testvm1">
+    <Hardware>
+      <Network>
+        <Adapter slot="0" enabled="true" type="82540EM">
+          <HostOnlyNetwork name="HostNetwork"/>
+        </Adapter>
+      </Network>
+    </Hardware>
+  </Machine>
+</VirtualBox>`), &settings); err != nil {
+		t.Fatalf("unmarshal failed %v", err)
+	}
+
+	spec := settings.Machine.spec(nil)
+	if len(spec.NICs) != 1 || spec.NICs[0].Mode != NWMode_hostonlynet || spec.NICs[0].NetworkName != "HostNetwork" {
+		t.Errorf("expected nic on host-only network, got %+v", spec.NICs)
+	}
+}
+
+func TestHostOnlyNetFor(t *testing.T) {
+	for _, c := range []struct {
+		nw       Network
+		expected HostOnlyNet
+	}{
+		{
+			nw:       Network{Name: "HostNetwork", IPNet: "192.168.60.0/24", Mode: NWMode_hostonlynet},
+			expected: HostOnlyNet{Name: "HostNetwork", NetworkMask: "255.255.255.0", LowerIP: "192.168.60.2", UpperIP: "192.168.60.254", Enabled: true},
+		},
+		{
+			nw: Network{Name: "HostNetwork", Mode: NWMode_hostonlynet, DHCP: &DHCPServer{NetworkMask: "255.255.0.0",
+				LowerIPAddress: "10.10.0.10", UpperIPAddress: "10.10.0.99"}},
+			expected: HostOnlyNet{Name: "HostNetwork", NetworkMask: "255.255.0.0", LowerIP: "10.10.0.10", UpperIP: "10.10.0.99", Enabled: true},
+		},
+	} {
+		n, err := hostOnlyNetFor(c.nw)
+		if err != nil {
+			t.Errorf("%+v: %v", c.nw, err)
+			continue
+		}
+		if !reflect.DeepEqual(*n, c.expected) {
+			t.Errorf("expected %+v, got %+v", c.expected, *n)
+		}
+	}
+
+	if _, err := hostOnlyNetFor(Network{Name: "HostNetwork", Mode: NWMode_hostonlynet}); err == nil {
+		t.Error("expected a network without addresses to fail")
+	}
+}
+
+func TestChangeNetHostOnlyNet(t *testing.T) {
+	var commands []string
+	vb := &VBox{run: func(ctx context.Context, args ...string) (string, error) {
+		commands = append(commands, strings.Join(args, " "))
+		return "", nil
+	}}
+
+	if err := vb.ChangeNet(&Network{Name: "HostNetwork", IPNet: "192.168.60.0/24", Mode: NWMode_hostonlynet}); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"hostonlynet modify --name=HostNetwork --netmask=255.255.255.0 --lower-ip=192.168.60.2 --upper-ip=192.168.60.254 --enable"}
+	if !reflect.DeepEqual(commands, expected) {
+		t.Errorf("expected %v, got %v", expected, commands)
+	}
+}
+
+func TestCreateNetHostOnlyNetAnySubnet(t *testing.T) {
+	vb, commands, cleanup := failingNetVBox(t, "none")
+	defer cleanup()
+
+	nw := &Network{Name: "lab", IPNet: AnySubnet(24), Mode: NWMode_hostonlynet}
+	if err := vb.CreateNet(nw); err != nil {
+		t.Fatal(err)
+	}
+	var allocations []SubnetAllocation
+	if err := vb.readStateFile(subnetAllocationsFile, &allocations); err != nil {
+		t.Fatal(err)
+	}
+	if len(allocations) != 1 || allocations[0].Owner != hostOnlyOwner("lab") || allocations[0].Gateway != nw.IPNet {
+		t.Fatalf("expected the subnet of lab allocated, got %+v for %+v", allocations, nw)
+	}
+	a := allocations[0]
+	expected := []string{fmt.Sprintf("hostonlynet add --name=lab --netmask=255.255.255.0 --lower-ip=%s --upper-ip=%s --enable", a.DHCPLower, a.DHCPUpper)}
+	var changes []string
+	for _, c := range *commands {
+		if strings.HasPrefix(c, "hostonlynet") {
+			changes = append(changes, c)
+		}
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("expected %v, got %v", expected, changes)
+	}
+
+	if err := vb.DeleteNet(nw); err != nil {
+		t.Fatal(err)
+	}
+	allocations = nil
+	if err := vb.readStateFile(subnetAllocationsFile, &allocations); err != nil || len(allocations) != 0 {
+		t.Errorf("expected no subnets left, got %+v, %v", allocations, err)
+	}
+}
+
+func TestCreateNetHostOnlyNetRollback(t *testing.T) {
+	vb, _, cleanup := failingNetVBox(t, "hostonlynet add")
+	defer cleanup()
+
+	nw := &Network{Name: "lab", IPNet: AnySubnet(24), Mode: NWMode_hostonlynet}
+	if err := vb.CreateNet(nw); err == nil {
+		t.Fatal("expected adding the network to fail")
+	}
+	if nw.IPNet != AnySubnet(24) {
+		t.Errorf("expected the network left as it was, got %+v", nw)
+	}
+	var allocations []SubnetAllocation
+	if err := vb.readStateFile(subnetAllocationsFile, &allocations); err != nil || len(allocations) != 0 {
+		t.Errorf("expected the subnet released, got %+v, %v", allocations, err)
+	}
+}
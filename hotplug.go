@@ -0,0 +1,204 @@
+package virtualbox
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// EmptyDrive is the medium of a removable drive with nothing inserted
+const EmptyDrive = "emptydrive"
+
+// nextFreeSlot returns the first port and device of the controller no disk is attached to
+func nextFreeSlot(sc StorageController, disks []Disk) (StorageControllerAttachment, error) {
+	used := map[string]bool{}
+	for _, d := range disks {
+		if d.Controller.Name == sc.Name {
+			used[fmt.Sprintf("%d-%d", d.Controller.Port, d.Controller.Device)] = true
+		}
+	}
+
+	for port := 0; port < sc.PortCount; port++ {
+		for device := 0; device < sc.Type.DevicesPerPort(); device++ {
+			if !used[fmt.Sprintf("%d-%d", port, device)] {
+				return StorageControllerAttachment{Type: sc.Type, Name: sc.Name, Port: port, Device: device}, nil
+			}
+		}
+	}
+	return StorageControllerAttachment{}, fmt.Errorf("storage controller %s has no free port left out of %d", sc.Name, sc.PortCount)
+}
+
+// findController returns the controller of the vm by name, or the first one of type t when name is empty
+func findController(vm *VirtualMachine, name string, t StorageControllerType) (*StorageController, error) {
+	for i, sc := range vm.Spec.StorageControllers {
+		if (name != "" && sc.Name == name) || (name == "" && sc.Type == t) {
+			return &vm.Spec.StorageControllers[i], nil
+		}
+	}
+	if name == "" {
+		return nil, NotFoundError(fmt.Sprintf("vm %s has no %s storage controller", vm.Spec.Name, t))
+	}
+	return nil, NotFoundError(fmt.Sprintf("vm %s has no storage controller %s", vm.Spec.Name, name))
+}
+
+// findAttachment returns what is attached at the slot of the disk
+func findAttachment(vm *VirtualMachine, slot StorageControllerAttachment) *Disk {
+	for i, d := range vm.Spec.Disks {
+		if d.Controller.Name == slot.Name && d.Controller.Port == slot.Port && d.Controller.Device == slot.Device {
+			return &vm.Spec.Disks[i]
+		}
+	}
+	return nil
+}
+
+func isRunning(state VirtualMachineState) bool {
+	return state == Running || state == Paused || state == Stuck
+}
+
+// NextFreeSlot returns the first free port and device of the named storage controller of the vm
+func (vb *VBox) NextFreeSlot(vm *VirtualMachine, controller string) (StorageControllerAttachment, error) {
+	machine, err := vb.VMInfo(vm.UUIDOrName())
+	if err != nil {
+		return StorageControllerAttachment{}, err
+	}
+	sc, err := findController(machine, controller, "")
+	if err != nil {
+		return StorageControllerAttachment{}, err
+	}
+	return nextFreeSlot(*sc, machine.Spec.Disks)
+}
+
+// HotPlugDisk attaches the hard disk to a hot-pluggable SATA port, which works whether or not the vm is running.
+// Without a controller name the first SATA controller is used, and without a port the next free one. The slot
+// used is written back to disk.Controller
+func (vb *VBox) HotPlugDisk(vm *VirtualMachine, disk *Disk) error {
+	machine, err := vb.VMInfo(vm.UUIDOrName())
+	if err != nil {
+		return err
+	}
+	sc, err := findController(machine, disk.Controller.Name, SATA)
+	if err != nil {
+		return err
+	}
+	if sc.Type != SATA {
+		return fmt.Errorf("storage controller %s is %s, only SATA ports can be hot-plugged", sc.Name, sc.Type)
+	}
+
+	if disk.Controller.Name == "" {
+		if disk.Controller, err = nextFreeSlot(*sc, machine.Spec.Disks); err != nil {
+			return err
+		}
+	} else if d := findAttachment(machine, disk.Controller); d != nil {
+		return AlreadyExists(fmt.Sprintf("port %d of %s is already used by %s", disk.Controller.Port, sc.Name, d.UUIDorPath()))
+	}
+
+	disk.Type = HDDrive
+	disk.Controller.Type = sc.Type
+	disk.Controller.HotPluggable = true
+	return vb.AttachStorage(machine, disk)
+}
+
+// HotUnplugDisk detaches the hard disk from the vm, while the vm runs only hot-pluggable ports can be released.
+// The disk is found by its slot, or by its uuid or path when the slot is not set
+func (vb *VBox) HotUnplugDisk(vm *VirtualMachine, disk *Disk) error {
+	machine, err := vb.VMInfo(vm.UUIDOrName())
+	if err != nil {
+		return err
+	}
+
+	var attached *Disk
+	if disk.Controller.Name != "" {
+		attached = findAttachment(machine, disk.Controller)
+	} else {
+		for i, d := range machine.Spec.Disks {
+			if d.Type == HDDrive && ((disk.UUID != "" && d.UUID == disk.UUID) || (disk.Path != "" && d.Path == disk.Path)) {
+				attached = &machine.Spec.Disks[i]
+				break
+			}
+		}
+	}
+	if attached == nil {
+		return NotFoundError(fmt.Sprintf("disk %s is not attached to vm %s", disk.UUIDorPath(), machine.Spec.Name))
+	}
+
+	if isRunning(machine.Spec.State) && !attached.Controller.HotPluggable {
+		return fmt.Errorf("port %d of %s is not hot-pluggable and vm %s is %s", attached.Controller.Port, attached.Controller.Name, machine.Spec.Name, machine.Spec.State)
+	}
+	if err := vb.DetachStorage(machine, attached); err != nil {
+		return err
+	}
+	disk.Controller = attached.Controller
+	return nil
+}
+
+// SetHotPluggable marks the port of the attached disk as hot-pluggable or not, the vm must be powered off
+func (vb *VBox) SetHotPluggable(vm *VirtualMachine, disk *Disk, hotPluggable bool) error {
+	_, err := vb.manage(
+		"storageattach", vm.UUIDOrName(),
+		"--storagectl", disk.Controller.Name,
+		"--port", strconv.Itoa(disk.Controller.Port),
+		"--device", strconv.Itoa(disk.Controller.Device),
+		"--hotpluggable", onOff(hotPluggable))
+	if err != nil {
+		return err
+	}
+	disk.Controller.HotPluggable = hotPluggable
+	return nil
+}
+
+// InsertMedium puts the image at disk.Path into the removable drive at disk.Controller, an empty disk.Path inserts
+// an empty drive. While the vm runs the drive must already exist. force unmounts a medium the guest has locked
+func (vb *VBox) InsertMedium(vm *VirtualMachine, disk *Disk, force bool) error {
+	if disk.Type == "" {
+		disk.Type = DVDDrive
+	}
+	if disk.Type == HDDrive {
+		return fmt.Errorf("hard disks are not removable, use HotPlugDisk")
+	}
+
+	machine, err := vb.VMInfo(vm.UUIDOrName())
+	if err != nil {
+		return err
+	}
+	if isRunning(machine.Spec.State) {
+		if d := findAttachment(machine, disk.Controller); d == nil || d.Type != disk.Type {
+			return NotFoundError(fmt.Sprintf("vm %s is %s and has no %s at port %d device %d of %s", machine.Spec.Name, machine.Spec.State, disk.Type, disk.Controller.Port, disk.Controller.Device, disk.Controller.Name))
+		}
+	}
+
+	medium := disk.Path
+	if medium == "" {
+		medium = EmptyDrive
+	}
+	args := []string{
+		"storageattach", machine.UUIDOrName(),
+		"--storagectl", disk.Controller.Name,
+		"--port", strconv.Itoa(disk.Controller.Port),
+		"--device", strconv.Itoa(disk.Controller.Device),
+		"--type", string(disk.Type),
+		"--medium", medium,
+	}
+	if force {
+		args = append(args, "--forceunmount")
+	}
+	_, err = vb.manage(args...)
+	return err
+}
+
+// EjectMedium removes the image from the removable drive at disk.Controller and leaves the drive empty
+func (vb *VBox) EjectMedium(vm *VirtualMachine, disk *Disk, force bool) error {
+	empty := *disk
+	empty.Path = ""
+	if err := vb.InsertMedium(vm, &empty, force); err != nil {
+		return err
+	}
+	disk.Path = ""
+	disk.UUID = ""
+	return nil
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
@@ -0,0 +1,80 @@
+package virtualbox
+
+import (
+	"testing"
+)
+
+var storageInfoOutput = `storagecontrollername0="IDE1"
+storagecontrollertype0="PIIX4"
+storagecontrollerinstance0="0"
+storagecontrollermaxportcount0="2"
+storagecontrollerportcount0="2"
+storagecontrollerbootable0="on"
+storagecontrollername1="SATA1"
+storagecontrollertype1="IntelAhci"
+storagecontrollerinstance1="0"
+storagecontrollermaxportcount1="30"
+storagecontrollerportcount1="3"
+storagecontrollerbootable1="on"
+"IDE1-0-0"="none"
+"IDE1-0-1"="none"
+"IDE1-1-0"="emptydrive"
+"IDE1-IsEjected-1-0"="off"
+"IDE1-1-1"="/isos/install.iso"
+"IDE1-ImageUUID-1-1"="44444444-0000-0000-0000-000000000001"
+"IDE1-IsEjected-1-1"="off"
+"SATA1-0-0"="/vms/vm01/disk1.vdi"
+"SATA1-ImageUUID-0-0"="38f0cf9d-6c60-4f59-ba0b-cd1dfb5329d6"
+"SATA1-1-0"="/vms/vm01/disk2.vdi"
+"SATA1-ImageUUID-1-0"="38f0cf9d-6c60-4f59-ba0b-cd1dfb5329d7"
+"SATA1-hot-pluggable-1-0"="on"
+"SATA1-2-0"="none"
+`
+
+func TestStorageAttachments(t *testing.T) {
+	m := parseMachineReadable(storageInfoOutput)
+
+	ide := storageAttachments(m, StorageController{Name: "IDE1", Type: IDE, PortCount: 2})
+	if len(ide) != 2 {
+		t.Fatalf("expected 2 ide attachments, got %+v", ide)
+	}
+	if ide[0].Type != DVDDrive || ide[0].Path != "" || ide[0].Controller.Port != 1 || ide[0].Controller.Device != 0 {
+		t.Errorf("expected empty dvd drive at 1-0, got %+v", ide[0])
+	}
+	if ide[1].Type != DVDDrive || ide[1].Path != "/isos/install.iso" || ide[1].Controller.Device != 1 {
+		t.Errorf("expected iso at 1-1, got %+v", ide[1])
+	}
+
+	sata := storageAttachments(m, StorageController{Name: "SATA1", Type: SATA, PortCount: 3})
+	if len(sata) != 2 {
+		t.Fatalf("expected 2 sata attachments, got %+v", sata)
+	}
+	if sata[0].Type != HDDrive || sata[0].Controller.HotPluggable {
+		t.Errorf("expected plain hard disk at port 0, got %+v", sata[0])
+	}
+	if !sata[1].Controller.HotPluggable || sata[1].UUID != "38f0cf9d-6c60-4f59-ba0b-cd1dfb5329d7" {
+		t.Errorf("expected hot-pluggable hard disk at port 1, got %+v", sata[1])
+	}
+}
+
+func TestNextFreeSlot(t *testing.T) {
+	m := parseMachineReadable(storageInfoOutput)
+
+	ide := StorageController{Name: "IDE1", Type: IDE, PortCount: 2}
+	slot, err := nextFreeSlot(ide, storageAttachments(m, ide))
+	if err != nil || slot.Port != 0 || slot.Device != 0 {
+		t.Errorf("expected ide slot 0-0, got %+v %v", slot, err)
+	}
+
+	sata := StorageController{Name: "SATA1", Type: SATA, PortCount: 3}
+	disks := storageAttachments(m, sata)
+	slot, err = nextFreeSlot(sata, disks)
+	if err != nil || slot.Port != 2 || slot.Name != "SATA1" || slot.Type != SATA {
+		t.Errorf("expected sata port 2, got %+v %v", slot, err)
+	}
+
+	disks = append(disks, Disk{Controller: slot})
+	if _, err := nextFreeSlot(sata, disks); err == nil {
+		t.Errorf("expected an error when all ports are used")
+	}
+}
@@ -0,0 +1,184 @@
+package virtualbox
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/golang/glog"
+)
+
+// ImportOptions tunes how foreign images are converted by ImportDiskImage and ImportRawImage
+type ImportOptions struct {
+	Variants []DiskVariant
+	// Progress, when set, is called with the percentage of the conversion done
+	Progress ProgressFunc
+}
+
+// DetectDiskFormat sniffs the format of the image at path from its magic bytes, files without any are taken as RAW
+func DetectDiskFormat(path string) (DiskFormat, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	if format := detectImageFormat(f, st.Size()); format != "" {
+		return format, nil
+	}
+	if st.Size() == 0 || st.Size()%sectorSize != 0 {
+		return "", UnknownImageFormatError(fmt.Sprintf("%s has no known image header and its size is not a multiple of %d", path, sectorSize))
+	}
+	return RAW, nil
+}
+
+// ImportDiskImage converts the raw, qcow, VMDK, VHD or VDI image at src.Path into dst and returns the registered
+// result. dst.Format defaults to VDI
+func (vb *VBox) ImportDiskImage(ctx context.Context, src, dst Disk, opts ImportOptions) (*Disk, error) {
+	srcPath, err := filepath.Abs(src.Path)
+	if err != nil {
+		return nil, err
+	}
+	format, err := DetectDiskFormat(srcPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if format == RAW {
+		f, err := os.Open(srcPath)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		st, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		return vb.ImportRawImage(ctx, f, st.Size(), dst, opts)
+	}
+
+	if err := prepareImportTarget(&dst); err != nil {
+		return nil, err
+	}
+
+	// clonemedium registers the source as a side effect, remember whether it has to be closed again
+	registered, err := vb.isRegisteredDisk(ctx, srcPath)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{"clonemedium", "disk", srcPath, dst.Path, "--format", string(dst.Format)}
+	if len(opts.Variants) > 0 {
+		args = append(args, "--variant", joinVariants(opts.Variants))
+	}
+	_, err = vb.manageStreaming(ctx, nil, opts.Progress, args...)
+
+	if !registered {
+		if _, cerr := vb.manageWithContext(context.Background(), "closemedium", "disk", srcPath); cerr != nil {
+			glog.Warningf("closing imported source %s failed: %v", srcPath, cerr)
+		}
+	}
+	if err != nil {
+		if isAlreadyExistErrorMessage(err.Error()) {
+			return nil, AlreadyExistsErrorr.New(dst.Path)
+		}
+		return nil, OperationError{Path: srcPath, Op: "import", Err: fmt.Errorf("%s: %v", format, err)}
+	}
+	return vb.DiskInfo(&Disk{Path: dst.Path, Type: dst.Type, Controller: dst.Controller})
+}
+
+// ImportRawImage streams size bytes of a raw disk image from r into dst and returns the registered result. When
+// dst.UUID is set the new image gets that uuid
+func (vb *VBox) ImportRawImage(ctx context.Context, r io.Reader, size int64, dst Disk, opts ImportOptions) (*Disk, error) {
+	if size <= 0 || size%sectorSize != 0 {
+		return nil, fmt.Errorf("raw image size %d is not a multiple of %d", size, sectorSize)
+	}
+	if err := prepareImportTarget(&dst); err != nil {
+		return nil, err
+	}
+
+	args := []string{"convertfromraw", "stdin", dst.Path, strconv.FormatInt(size, 10), "--format", string(dst.Format)}
+	if len(opts.Variants) > 0 {
+		args = append(args, "--variant", joinVariants(opts.Variants))
+	}
+	if dst.UUID != "" {
+		args = append(args, "--uuid", dst.UUID)
+	}
+
+	// convertfromraw prints no progress of its own, so count what it reads
+	in := &progressReader{r: r, size: size, progress: opts.Progress, last: -1}
+	if _, err := vb.manageStreaming(ctx, in, nil, args...); err != nil {
+		if isAlreadyExistErrorMessage(err.Error()) {
+			return nil, AlreadyExistsErrorr.New(dst.Path)
+		}
+		return nil, OperationError{Path: dst.Path, Op: "import", Err: err}
+	}
+	return vb.DiskInfo(&Disk{Path: dst.Path, Type: dst.Type, Controller: dst.Controller})
+}
+
+// prepareImportTarget fills in the defaults of the target disk, VBoxManage resolves relative paths against its own
+// home directory so the path is made absolute
+func prepareImportTarget(dst *Disk) error {
+	if dst.Path == "" {
+		return fmt.Errorf("no target path to import to")
+	}
+	path, err := filepath.Abs(dst.Path)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); err == nil {
+		return AlreadyExistsErrorr.New(path)
+	}
+
+	dst.Path = path
+	if dst.Format == "" {
+		dst.Format = VDI
+	}
+	if dst.Type == "" {
+		dst.Type = HDDrive
+	}
+	return nil
+}
+
+func (vb *VBox) isRegisteredDisk(ctx context.Context, path string) (bool, error) {
+	media, err := vb.ListMedia(ctx, HDDrive)
+	if err != nil {
+		return false, err
+	}
+	for _, d := range media {
+		if d.Path == path {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// progressReader reports the share of size read so far whenever it advances by a percent
+type progressReader struct {
+	r        io.Reader
+	size     int64
+	read     int64
+	last     int
+	progress ProgressFunc
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.read += int64(n)
+	if p.progress != nil && p.size > 0 {
+		if percent := int(p.read * 100 / p.size); percent != p.last {
+			p.last = percent
+			p.progress(percent)
+		}
+	}
+	return n, err
+}
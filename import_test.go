@@ -0,0 +1,77 @@
+package virtualbox
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestDetectDiskFormat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	qcow := make([]byte, 1024)
+	copy(qcow, qcowMagic)
+
+	for name, tc := range map[string]struct {
+		data   []byte
+		format DiskFormat
+	}{
+		"disk.vdi":   {vdiImage(nil), VDI},
+		"disk.vhd":   {vhdImage(), VHD},
+		"disk.vmdk":  {vmdkSparseImage(), VMDK},
+		"disk.qcow2": {qcow, QCOW},
+		"disk.img":   {make([]byte, 4096), RAW},
+	} {
+		format, err := DetectDiskFormat(writeImage(t, dir, name, tc.data))
+		if err != nil || format != tc.format {
+			t.Errorf("%s: expected %s, got %s %v", name, tc.format, format, err)
+		}
+	}
+
+	if _, err := DetectDiskFormat(writeImage(t, dir, "notes.txt", []byte("not a disk"))); !IsUnknownImageFormat(err) {
+		t.Errorf("expected unknown format error, got %v", err)
+	}
+}
+
+func TestProgressWriter(t *testing.T) {
+	var seen []int
+	w := progressWriter{progress: func(percent int) { seen = append(seen, percent) }}
+
+	for _, chunk := range []string{"0%...1", "0%...20%.", "..30%", "...100%\n"} {
+		w.Write([]byte(chunk))
+	}
+
+	if expected := []int{0, 10, 20, 30, 100}; !reflect.DeepEqual(seen, expected) {
+		t.Errorf("expected progress %v, got %v", expected, seen)
+	}
+	if w.String() != "0%...10%...20%...30%...100%\n" {
+		t.Errorf("expected stderr to be kept, got %q", w.String())
+	}
+}
+
+func TestProgressReader(t *testing.T) {
+	var seen []int
+	r := &progressReader{
+		r:        bytes.NewReader(make([]byte, 1000)),
+		size:     1000,
+		last:     -1,
+		progress: func(percent int) { seen = append(seen, percent) },
+	}
+
+	buf := make([]byte, 250)
+	for {
+		if _, err := r.Read(buf); err != nil {
+			break
+		}
+	}
+
+	if expected := []int{25, 50, 75, 100}; !reflect.DeepEqual(seen, expected) {
+		t.Errorf("expected progress %v, got %v", expected, seen)
+	}
+}
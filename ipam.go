@@ -0,0 +1,390 @@
+package virtualbox
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// subnetAllocationsFile is kept in the base path, next to the port allocations
+const subnetAllocationsFile = "subnets.json"
+
+// DefaultSubnetPools are the ranges subnets are allocated from when Config.SubnetPools is empty. VirtualBox only
+// allows host-only networks in 192.168.56.0/21 unless configured otherwise in /etc/vbox/networks.conf
+var DefaultSubnetPools = []string{"192.168.56.0/21"}
+
+// SubnetAllocation is a subnet handed out to a network, with the addresses reserved in it
+type SubnetAllocation struct {
+	// Owner is the network the subnet belongs to, for e.g hostonly/vboxnet3 or natnetwork/lab
+	Owner string `json:"owner"`
+	CIDR  string `json:"cidr"`
+	// Gateway is the address of the host on the network
+	Gateway    string `json:"gateway"`
+	DHCPServer string `json:"dhcpServer"`
+	// DHCPLower and DHCPUpper bound the addresses leased to guests, those below DHCPLower are free for static use
+	DHCPLower string `json:"dhcpLower"`
+	DHCPUpper string `json:"dhcpUpper"`
+}
+
+// subnetAllocationLock serializes the read, allocate and write cycles on the allocations file of this process, the
+// lock file of lockSubnetAllocations those of other processes
+var subnetAllocationLock sync.Mutex
+
+func (vb *VBox) lockSubnetAllocations() (func(), error) {
+	subnetAllocationLock.Lock()
+	unlock, err := vb.lockStateFile(subnetAllocationsFile)
+	if err != nil {
+		subnetAllocationLock.Unlock()
+		return nil, err
+	}
+	return func() {
+		unlock()
+		subnetAllocationLock.Unlock()
+	}, nil
+}
+
+// AnySubnet asks AddNatNet and CreateNet for a subnet of the given prefix length out of the pools, for e.g
+// NatNetwork{Network: AnySubnet(24)}
+func AnySubnet(prefix int) string {
+	return fmt.Sprintf("any/%d", prefix)
+}
+
+// anySubnetPrefix returns the prefix length of an AnySubnet request
+func anySubnetPrefix(cidr string) (int, bool) {
+	if !strings.HasPrefix(cidr, "any/") {
+		return 0, false
+	}
+	prefix, err := strconv.Atoi(strings.TrimPrefix(cidr, "any/"))
+	return prefix, err == nil
+}
+
+func hostOnlyOwner(name string) string {
+	return "hostonly/" + name
+}
+
+func ipToUint(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func uintToIP(v uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, v)
+	return ip
+}
+
+func overlaps(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// subnetOf returns the ipv4 network of the address with the mask, nil when either does not parse
+func subnetOf(ip, mask string) *net.IPNet {
+	addr, m := net.ParseIP(ip).To4(), net.ParseIP(mask).To4()
+	if addr == nil || m == nil {
+		return nil
+	}
+	return &net.IPNet{IP: addr.Mask(net.IPMask(m)), Mask: net.IPMask(m)}
+}
+
+// allocateSubnet returns the first subnet of the prefix length in the pools that overlaps none of the used ones.
+// A /29 is the smallest that holds the gateway, the dhcp server and a lease range, see reserveAddresses
+func allocateSubnet(pools []string, prefix int, used []*net.IPNet) (*net.IPNet, error) {
+	if prefix < 1 || prefix > 29 {
+		return nil, fmt.Errorf("subnets of prefix length /%d cannot hold a gateway and guests", prefix)
+	}
+
+	for _, p := range pools {
+		_, pool, err := net.ParseCIDR(p)
+		if err != nil || pool.IP.To4() == nil {
+			return nil, fmt.Errorf("invalid ipv4 subnet pool %s", p)
+		}
+		ones, _ := pool.Mask.Size()
+		if ones > prefix {
+			continue
+		}
+
+		size := uint64(1) << uint(32-prefix)
+		start := uint64(ipToUint(pool.IP))
+		end := start + uint64(1)<<uint(32-ones)
+	next:
+		for base := start; base < end; base += size {
+			candidate := &net.IPNet{IP: uintToIP(uint32(base)), Mask: net.CIDRMask(prefix, 32)}
+			for _, u := range used {
+				if overlaps(candidate, u) {
+					continue next
+				}
+			}
+			return candidate, nil
+		}
+	}
+	return nil, fmt.Errorf("no free /%d subnet left in %s", prefix, strings.Join(pools, ", "))
+}
+
+// reserveAddresses lays out the subnet: the gateway takes the first address and the dhcp server the second. In
+// subnets large enough the first tenth of the rest stays free for static use, the remainder is leased
+func reserveAddresses(owner string, subnet *net.IPNet) SubnetAllocation {
+	base := ipToUint(subnet.IP)
+	ones, bits := subnet.Mask.Size()
+	broadcast := base + uint32(1)<<uint(bits-ones) - 1
+
+	static := (broadcast - base - 3) / 10
+	if static < 2 {
+		static = 0
+	}
+	return SubnetAllocation{
+		Owner:      owner,
+		CIDR:       subnet.String(),
+		Gateway:    uintToIP(base + 1).String(),
+		DHCPServer: uintToIP(base + 2).String(),
+		DHCPLower:  uintToIP(base + 3 + static).String(),
+		DHCPUpper:  uintToIP(broadcast - 1).String(),
+	}
+}
+
+// Mask returns the network mask of the subnet in dotted form
+func (a SubnetAllocation) Mask() string {
+	_, subnet, err := net.ParseCIDR(a.CIDR)
+	if err != nil {
+		return ""
+	}
+	return net.IP(subnet.Mask).String()
+}
+
+// dhcp fills in the addresses of the dhcp server the allocation leaves blank
+func (a SubnetAllocation) dhcp(dhcp *DHCPServer) {
+	if dhcp.IPAddress == "" {
+		dhcp.IPAddress = a.DHCPServer
+	}
+	if dhcp.NetworkMask == "" {
+		dhcp.NetworkMask = a.Mask()
+	}
+	if dhcp.LowerIPAddress == "" {
+		dhcp.LowerIPAddress = a.DHCPLower
+	}
+	if dhcp.UpperIPAddress == "" {
+		dhcp.UpperIPAddress = a.DHCPUpper
+	}
+}
+
+// parseRoutes reads the ipv4 routes of a linux host in the format of /proc/net/route, leaving out default routes
+func parseRoutes(out string) []*net.IPNet {
+	var routes []*net.IPNet
+	s := bufio.NewScanner(strings.NewReader(out))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 8 || fields[0] == "Iface" {
+			continue
+		}
+		dst, err1 := hex.DecodeString(fields[1])
+		mask, err2 := hex.DecodeString(fields[7])
+		if err1 != nil || err2 != nil || len(dst) != 4 || len(mask) != 4 {
+			continue
+		}
+		// the kernel writes them in host byte order, little endian on every platform VirtualBox runs on
+		dst[0], dst[1], dst[2], dst[3] = dst[3], dst[2], dst[1], dst[0]
+		mask[0], mask[1], mask[2], mask[3] = mask[3], mask[2], mask[1], mask[0]
+		if ones, _ := net.IPMask(mask).Size(); ones == 0 {
+			continue
+		}
+		routes = append(routes, &net.IPNet{IP: net.IP(dst), Mask: net.IPMask(mask)})
+	}
+	return routes
+}
+
+// hostSubnets returns the ipv4 networks of the interfaces of the host and, on linux, those it has routes to, for
+// e.g through a vpn
+func hostSubnets() []*net.IPNet {
+	var subnets []*net.IPNet
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok && n.IP.To4() != nil && !n.IP.IsLoopback() {
+				subnets = append(subnets, &net.IPNet{IP: n.IP.To4().Mask(n.Mask), Mask: n.Mask[len(n.Mask)-4:]})
+			}
+		}
+	}
+	if routes, err := ioutil.ReadFile("/proc/net/route"); err == nil {
+		subnets = append(subnets, parseRoutes(string(routes))...)
+	}
+	return subnets
+}
+
+func sameSubnet(a, b *net.IPNet) bool {
+	return a.IP.Equal(b.IP) && a.Mask.String() == b.Mask.String()
+}
+
+// ownSubnet returns the subnet the owner has already when it is of the prefix length, lies in one of the pools
+// and overlaps none of the used ones, so that allocating one for it does not move it
+func ownSubnet(pools []string, prefix int, own *net.IPNet, used []*net.IPNet) *net.IPNet {
+	if own == nil {
+		return nil
+	}
+	if ones, _ := own.Mask.Size(); ones != prefix {
+		return nil
+	}
+	for _, u := range used {
+		if overlaps(own, u) {
+			return nil
+		}
+	}
+	for _, p := range pools {
+		if _, pool, err := net.ParseCIDR(p); err == nil && pool.Contains(own.IP) {
+			return own
+		}
+	}
+	return nil
+}
+
+// usedSubnets returns the subnets of the host-only interfaces and networks, nat networks and dhcp servers of
+// VirtualBox together with those of the host. The subnet of the host-only interface or nat network of the owner
+// is left out and returned on its own, the host and its dhcp server see it as well
+func (vb *VBox) usedSubnets(owner string) ([]*net.IPNet, *net.IPNet, error) {
+	all := hostSubnets()
+	var own *net.IPNet
+	add := func(n *net.IPNet) {
+		if n != nil {
+			all = append(all, n)
+		}
+	}
+
+	ifs, err := vb.HostOnlyNetInfo()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, nw := range ifs {
+		if hostOnlyOwner(nw.Name) == owner {
+			own = subnetOf(nw.IPNet, nw.IPMask)
+			continue
+		}
+		add(subnetOf(nw.IPNet, nw.IPMask))
+	}
+
+	if nets, err := vb.ListHostOnlyNets(); err == nil {
+		for _, n := range nets {
+			add(subnetOf(n.LowerIP, n.NetworkMask))
+		}
+	} else {
+		glog.V(6).Infof("no host-only networks found: %v", err)
+	}
+
+	nats, err := vb.ListNatNets()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, nat := range nats {
+		if _, n, err := net.ParseCIDR(nat.Network); err == nil {
+			if natNetOwner(nat.NetName) == owner {
+				own = n
+				continue
+			}
+			add(n)
+		}
+	}
+
+	servers, err := vb.ListDHCPServers()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, dhcp := range servers {
+		add(subnetOf(dhcp.IPAddress, dhcp.NetworkMask))
+	}
+
+	var used []*net.IPNet
+	for _, n := range all {
+		if own == nil || !sameSubnet(n, own) {
+			used = append(used, n)
+		}
+	}
+	return used, own, nil
+}
+
+// AllocateSubnet returns the subnet of the owner, allocating one of the prefix length out of Config.SubnetPools
+// when it has none yet. Subnets overlap neither each other nor the networks of VirtualBox and the host, and are
+// remembered in the base path so the owner gets the same one again until ReleaseSubnet. An existing interface or
+// nat network whose subnet fits keeps it
+func (vb *VBox) AllocateSubnet(ctx context.Context, owner string, prefix int) (*SubnetAllocation, error) {
+	a, _, err := vb.allocateSubnet(ctx, owner, prefix)
+	return a, err
+}
+
+// allocateSubnet is AllocateSubnet, it also tells whether the subnet was allocated by this call, so that callers
+// failing afterwards know whether to release it
+func (vb *VBox) allocateSubnet(ctx context.Context, owner string, prefix int) (*SubnetAllocation, bool, error) {
+	unlock, err := vb.lockSubnetAllocations()
+	if err != nil {
+		return nil, false, err
+	}
+	defer unlock()
+
+	var allocations []SubnetAllocation
+	if err := vb.readStateFile(subnetAllocationsFile, &allocations); err != nil {
+		return nil, false, err
+	}
+	for i := range allocations {
+		if allocations[i].Owner == owner {
+			return &allocations[i], false, nil
+		}
+	}
+
+	if ctx.Err() != nil {
+		return nil, false, ctx.Err()
+	}
+	used, own, err := vb.usedSubnets(owner)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, a := range allocations {
+		if _, n, err := net.ParseCIDR(a.CIDR); err == nil {
+			used = append(used, n)
+		}
+	}
+
+	pools := vb.Config.SubnetPools
+	if len(pools) == 0 {
+		pools = DefaultSubnetPools
+	}
+	subnet := ownSubnet(pools, prefix, own, used)
+	if subnet == nil {
+		if subnet, err = allocateSubnet(pools, prefix, used); err != nil {
+			return nil, false, err
+		}
+	}
+
+	allocation := reserveAddresses(owner, subnet)
+	if err := vb.writeStateFile(subnetAllocationsFile, append(allocations, allocation)); err != nil {
+		return nil, false, err
+	}
+	return &allocation, true, nil
+}
+
+// ReleaseSubnet gives the subnet of the owner back to the pools
+func (vb *VBox) ReleaseSubnet(owner string) error {
+	unlock, err := vb.lockSubnetAllocations()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	var allocations []SubnetAllocation
+	if err := vb.readStateFile(subnetAllocationsFile, &allocations); err != nil {
+		return err
+	}
+
+	var kept []SubnetAllocation
+	for _, a := range allocations {
+		if a.Owner != owner {
+			kept = append(kept, a)
+		}
+	}
+	if len(kept) == len(allocations) {
+		return nil
+	}
+	return vb.writeStateFile(subnetAllocationsFile, kept)
+}
@@ -0,0 +1,271 @@
+package virtualbox
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func cidrs(t *testing.T, s ...string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, c := range s {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+func TestAllocateSubnet(t *testing.T) {
+	used := cidrs(t, "192.168.56.0/24", "192.168.57.128/25", "10.0.0.0/8")
+
+	for _, c := range []struct {
+		pools    []string
+		prefix   int
+		expected string
+	}{
+		{[]string{"192.168.56.0/21"}, 24, "192.168.58.0/24"},
+		{[]string{"192.168.56.0/21"}, 25, "192.168.57.0/25"},
+		{[]string{"192.168.56.0/21"}, 22, "192.168.60.0/22"},
+		{[]string{"10.0.0.0/16", "172.16.0.0/12"}, 24, "172.16.0.0/24"},
+		{[]string{"192.168.56.0/24", "192.168.59.0/24"}, 24, "192.168.59.0/24"},
+	} {
+		subnet, err := allocateSubnet(c.pools, c.prefix, used)
+		if err != nil {
+			t.Errorf("allocating /%d from %v failed %v", c.prefix, c.pools, err)
+			continue
+		}
+		if subnet.String() != c.expected {
+			t.Errorf("expected /%d from %v to be %s, got %s", c.prefix, c.pools, c.expected, subnet)
+		}
+	}
+
+	if _, err := allocateSubnet([]string{"192.168.56.0/24"}, 24, used); err == nil {
+		t.Errorf("expected an exhausted pool to fail")
+	}
+	for _, prefix := range []int{30, 31} {
+		if _, err := allocateSubnet([]string{"192.168.56.0/21"}, prefix, nil); err == nil {
+			t.Errorf("expected a /%d to be refused", prefix)
+		}
+	}
+	if _, err := allocateSubnet([]string{"not a subnet"}, 24, nil); err == nil {
+		t.Errorf("expected an invalid pool to fail")
+	}
+}
+
+func TestReserveAddresses(t *testing.T) {
+	expected := SubnetAllocation{
+		Owner:      "natnetwork/lab",
+		CIDR:       "192.168.58.0/24",
+		Gateway:    "192.168.58.1",
+		DHCPServer: "192.168.58.2",
+		DHCPLower:  "192.168.58.28",
+		DHCPUpper:  "192.168.58.254",
+	}
+	a := reserveAddresses("natnetwork/lab", cidrs(t, "192.168.58.0/24")[0])
+	if !reflect.DeepEqual(a, expected) {
+		t.Errorf("expected %+v, got %+v", expected, a)
+	}
+	if a.Mask() != "255.255.255.0" {
+		t.Errorf("expected mask of /24, got %s", a.Mask())
+	}
+
+	if a := reserveAddresses("hostonly/vboxnet1", cidrs(t, "10.1.1.0/29")[0]); a.DHCPLower != "10.1.1.3" || a.DHCPUpper != "10.1.1.6" {
+		t.Errorf("expected small subnets to lease all but gateway and server, got %+v", a)
+	}
+
+	dhcp := DHCPServer{UpperIPAddress: "192.168.58.200"}
+	expected.dhcp(&dhcp)
+	if !reflect.DeepEqual(dhcp, DHCPServer{IPAddress: "192.168.58.2", NetworkMask: "255.255.255.0", LowerIPAddress: "192.168.58.28", UpperIPAddress: "192.168.58.200"}) {
+		t.Errorf("unexpected dhcp server %+v", dhcp)
+	}
+}
+
+func TestParseRoutes(t *testing.T) {
+	routes := parseRoutes(`Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+eth0	00000000	0102A8C0	0003	0	0	100	00000000	0	0	0
+eth0	0002A8C0	00000000	0001	0	0	100	00FFFFFF	0	0	0
+tun0	0000080A	00000000	0001	0	0	0	0000FFFF	0	0	0
+`)
+	if expected := cidrs(t, "192.168.2.0/24", "10.8.0.0/16"); !reflect.DeepEqual(routes, expected) {
+		t.Errorf("expected %v, got %v", expected, routes)
+	}
+}
+
+func TestAnySubnetPrefix(t *testing.T) {
+	if prefix, ok := anySubnetPrefix(AnySubnet(24)); !ok || prefix != 24 {
+		t.Errorf("expected any /24, got %d %v", prefix, ok)
+	}
+	if _, ok := anySubnetPrefix("192.168.56.0/24"); ok {
+		t.Errorf("expected a plain subnet not to be a request")
+	}
+}
+
+func TestAllocateSubnetKnownOwner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "subnets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	vb := NewVBox(Config{BasePath: dir})
+	allocation := reserveAddresses("natnetwork/lab", cidrs(t, "192.168.58.0/24")[0])
+	if err := vb.writeStateFile(subnetAllocationsFile, []SubnetAllocation{allocation}); err != nil {
+		t.Fatal(err)
+	}
+
+	// owners with a subnet get it back without looking at VirtualBox
+	a, err := vb.AllocateSubnet(context.Background(), "natnetwork/lab", 24)
+	if err != nil || !reflect.DeepEqual(*a, allocation) {
+		t.Errorf("expected %+v, got %+v %v", allocation, a, err)
+	}
+
+	if err := vb.ReleaseSubnet("natnetwork/lab"); err != nil {
+		t.Fatal(err)
+	}
+	var allocations []SubnetAllocation
+	if err := vb.readStateFile(subnetAllocationsFile, &allocations); err != nil || len(allocations) != 0 {
+		t.Errorf("expected no allocations after release, got %+v %v", allocations, err)
+	}
+}
+
+// failingNetVBox fails the commands starting with fail and reports no networks of VirtualBox
+func failingNetVBox(t *testing.T, fail string) (*VBox, *[]string, func()) {
+	dir, err := ioutil.TempDir("", "subnets")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var commands []string
+	vb := NewVBox(Config{BasePath: dir})
+	vb.run = func(ctx context.Context, args ...string) (string, error) {
+		cmd := strings.Join(args, " ")
+		commands = append(commands, cmd)
+		switch {
+		case strings.HasPrefix(cmd, fail):
+			return "", fmt.Errorf("%s failed", fail)
+		case cmd == "hostonlyif create":
+			return "Interface 'vboxnet5' was successfully created\n", nil
+		}
+		return "", nil
+	}
+	return vb, &commands, func() { os.RemoveAll(dir) }
+}
+
+func TestAddNatNetRollback(t *testing.T) {
+	vb, commands, cleanup := failingNetVBox(t, "natnetwork modify")
+	defer cleanup()
+
+	nat := &NatNetwork{NetName: "lab", Network: AnySubnet(24), PortForward4: []PortForwarding{
+		{Name: "ssh", Protocol: TCP, HostPort: 0, GuestIP: "10.0.2.15", GuestPort: 22},
+	}}
+	if err := vb.AddNatNet(nat); err == nil {
+		t.Fatal("expected adding the port forwards to fail")
+	}
+	if nat.Network != AnySubnet(24) {
+		t.Errorf("expected the network to be restored, got %s", nat.Network)
+	}
+	if last := (*commands)[len(*commands)-1]; last != "natnetwork remove --netname lab" {
+		t.Errorf("expected the nat network to be removed, got %v", *commands)
+	}
+	var allocations []SubnetAllocation
+	if err := vb.readStateFile(subnetAllocationsFile, &allocations); err != nil || len(allocations) != 0 {
+		t.Errorf("expected the subnet to be released, got %+v %v", allocations, err)
+	}
+}
+
+func TestCreateNetRollback(t *testing.T) {
+	vb, commands, cleanup := failingNetVBox(t, "hostonlyif ipconfig")
+	defer cleanup()
+
+	dhcp := &DHCPServer{Enabled: true}
+	nw := &Network{IPNet: AnySubnet(24), DHCP: dhcp}
+	if err := vb.CreateNet(nw); err == nil {
+		t.Fatal("expected configuring the interface to fail")
+	}
+	if !reflect.DeepEqual(*nw, Network{IPNet: AnySubnet(24), DHCP: dhcp}) || !reflect.DeepEqual(*dhcp, DHCPServer{Enabled: true}) {
+		t.Errorf("expected the network to be restored, got %+v %+v", *nw, *dhcp)
+	}
+	if last := (*commands)[len(*commands)-1]; last != "hostonlyif remove vboxnet5" {
+		t.Errorf("expected the interface to be removed, got %v", *commands)
+	}
+	var allocations []SubnetAllocation
+	if err := vb.readStateFile(subnetAllocationsFile, &allocations); err != nil || len(allocations) != 0 {
+		t.Errorf("expected the subnet to be released, got %+v %v", allocations, err)
+	}
+}
+
+func TestOwnSubnet(t *testing.T) {
+	pools := []string{"192.168.56.0/21"}
+	own := cidrs(t, "192.168.58.0/24")[0]
+
+	if n := ownSubnet(pools, 24, own, cidrs(t, "192.168.56.0/24")); n != own {
+		t.Errorf("expected the owner to keep %s, got %v", own, n)
+	}
+	for _, c := range []struct {
+		prefix int
+		used   []*net.IPNet
+		pools  []string
+	}{
+		{prefix: 25, pools: pools},
+		{prefix: 24, used: cidrs(t, "192.168.58.128/25"), pools: pools},
+		{prefix: 24, pools: []string{"10.0.0.0/8"}},
+	} {
+		if n := ownSubnet(c.pools, c.prefix, own, c.used); n != nil {
+			t.Errorf("expected %s not to fit /%d in %v beside %v", own, c.prefix, c.pools, c.used)
+		}
+	}
+}
+
+func TestAllocateSubnetExistingInterface(t *testing.T) {
+	dir, err := ioutil.TempDir("", "subnets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	vb := NewVBox(Config{BasePath: dir})
+	vb.run = func(ctx context.Context, args ...string) (string, error) {
+		switch strings.Join(args, " ") {
+		case "list hostonlyifs":
+			return "Name:            vboxnet0\nIPAddress:       192.168.57.1\nNetworkMask:     255.255.255.0\n", nil
+		case "list dhcpservers":
+			return "NetworkName:    HostInterfaceNetworking-vboxnet0\nIP:             192.168.57.2\nNetworkMask:    255.255.255.0\n", nil
+		}
+		return "", nil
+	}
+
+	// the subnet of vboxnet0 and its dhcp server do not count against it
+	a, err := vb.AllocateSubnet(context.Background(), hostOnlyOwner("vboxnet0"), 24)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.CIDR != "192.168.57.0/24" {
+		t.Errorf("expected vboxnet0 to keep 192.168.57.0/24, got %s", a.CIDR)
+	}
+}
+
+func TestDeleteNetKeepsSubnetOnFailure(t *testing.T) {
+	vb, _, cleanup := failingNetVBox(t, "hostonlyif remove")
+	defer cleanup()
+
+	allocation := reserveAddresses(hostOnlyOwner("vboxnet5"), cidrs(t, "192.168.58.0/24")[0])
+	if err := vb.writeStateFile(subnetAllocationsFile, []SubnetAllocation{allocation}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vb.DeleteNet(&Network{Name: "vboxnet5", Mode: NWMode_hostonly}); err == nil {
+		t.Fatal("expected the failed removal to be returned")
+	}
+	var allocations []SubnetAllocation
+	if err := vb.readStateFile(subnetAllocationsFile, &allocations); err != nil || len(allocations) != 1 {
+		t.Errorf("expected the subnet to stay allocated, got %+v %v", allocations, err)
+	}
+}
@@ -6,8 +6,10 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/golang/glog"
 )
@@ -37,7 +39,10 @@ func (vb *VBox) CreateVM(vm *VirtualMachine) error {
 
 // DeleteVM removes the setting file and must be  used with caution.  The VM must be unregistered before calling this
 func (vb *VBox) DeleteVM(vm *VirtualMachine) error {
-	return os.RemoveAll(vb.getVMSettingsFile(vm))
+	if err := os.RemoveAll(vb.getVMSettingsFile(vm)); err != nil {
+		return err
+	}
+	return vb.ReleaseHostPorts(vm)
 }
 
 // TODO: Ensure this is idempotent
@@ -51,75 +56,94 @@ func (vb *VBox) UnRegisterVM(vm *VirtualMachine) error {
 	return err
 }
 
-func (vb *VBox) TakeSnapshot(vm *VirtualMachine, snapshot Snapshot, live bool) error {
-	args := []string{"snapshot", vm.Spec.Name, "take", snapshot.Name}
-	if snapshot.Description != "" {
-		param := fmt.Sprintf("--description=%s", snapshot.Description)
-		args = append(args, param)
-	}
-
-	if live {
-		args = append(args, "--live")
+func (vb *VBox) AttachStorage(vm *VirtualMachine, disk *Disk) error {
+	args := []string{
+		"storageattach", vm.UUIDOrName(),
+		"--storagectl", disk.Controller.Name,
+		"--port", strconv.Itoa(disk.Controller.Port),
+		"--device", strconv.Itoa(disk.Controller.Device),
+		"--type", string(disk.Type),
+		"--medium", disk.Path,
 	}
-
+	args = append(args, attachmentArgs(disk)...)
 	_, err := vb.manage(args...)
 	return err
 }
 
-func (vb *VBox) DeleteSnapshot(vm *VirtualMachine, snapshot Snapshot) error {
-	_, err := vb.manage("snapshot", vm.Spec.Name, "delete", snapshot.Name)
-	return err
-}
-
-func (vb *VBox) RestoreSnapshot(vm *VirtualMachine, snapshot Snapshot) error {
-	_, err := vb.manage("snapshot", vm.Spec.Name, "restore", snapshot.Name)
-	return err
-}
-
-func (vb *VBox) EditSnapshot(vm *VirtualMachine, prevSnapshot Snapshot, newSh Snapshot) error {
-	args := []string{"snapshot", vm.Spec.Name, "edit", prevSnapshot.Name}
-
-	if newSh.Description != "" && newSh.Description != prevSnapshot.Description {
-		param := fmt.Sprintf("--description=%s", newSh.Description)
-		args = append(args, param)
+// attachmentArgs returns the storageattach options for the characteristics declared on the disk
+func attachmentArgs(disk *Disk) []string {
+	var args []string
+	if disk.NonRotational {
+		args = append(args, "--nonrotational", "on")
 	}
-
-	if newSh.Name != "" && newSh.Name != prevSnapshot.Name {
-		args = append(args, "--name", newSh.Name)
+	if disk.AutoDiscard {
+		args = append(args, "--discard", "on")
 	}
-
-	_, err := vb.manage(args...)
-	return err
-}
-
-func (vb *VBox) ListOfSnapshots(vm *VirtualMachine) (string, error) {
-	return vb.manage("snapshot", vm.Spec.Name, "list")
-}
-
-func (vb *VBox) showSnapshotInfo(vm *VirtualMachine, snapshot Snapshot) (string, error) {
-	return vb.manage("snapshot", vm.Spec.Name, "showvminfo", snapshot.Name)
-}
-
-func (vb *VBox) AddStorageController(vm *VirtualMachine, ctr StorageController) error {
-
-	_, err := vb.manage("storagectl", vm.UUIDOrName(), "--name", ctr.Name, "--add", string(ctr.Type))
-	if err != nil && isAlreadyExistErrorMessage(err.Error()) {
-		return AlreadyExists(vm.Spec.Name)
+	if disk.Controller.HotPluggable {
+		args = append(args, "--hotpluggable", "on")
 	}
-	return nil
+	if disk.MediumType != "" {
+		args = append(args, "--mtype", string(disk.MediumType))
+	}
+	if disk.Comment != "" {
+		args = append(args, "--comment", disk.Comment)
+	}
+	if disk.SetUUID != "" {
+		args = append(args, "--setuuid", disk.SetUUID)
+	}
+	if disk.BandwidthGroup != "" {
+		args = append(args, "--bandwidthgroup", disk.BandwidthGroup)
+	}
+	return args
 }
 
-func (vb *VBox) AttachStorage(vm *VirtualMachine, disk *Disk) error {
+// DetachStorage removes whatever medium is attached at the controller slot of the disk
+func (vb *VBox) DetachStorage(vm *VirtualMachine, disk *Disk) error {
 	_, err := vb.manage(
-		"storageattach", vm.Spec.Name,
+		"storageattach", vm.UUIDOrName(),
 		"--storagectl", disk.Controller.Name,
 		"--port", strconv.Itoa(disk.Controller.Port),
 		"--device", strconv.Itoa(disk.Controller.Device),
-		"--type", string(disk.Type),
-		"--medium", disk.Path)
+		"--medium", "none")
 	return err
 }
 
+// storageAttachments reads the media attached to the ports of the controller, keys look like SATA1-0-0
+func storageAttachments(m map[string]interface{}, sc StorageController) []Disk {
+	var disks []Disk
+	for port := 0; port < sc.PortCount; port++ {
+		for device := 0; device < sc.Type.DevicesPerPort(); device++ {
+			slot := fmt.Sprintf("%d-%d", port, device)
+			path := stringValue(m, sc.Name+"-"+slot)
+			if path == "" || path == "none" {
+				continue
+			}
+
+			d := Disk{
+				Path: path,
+				UUID: stringValue(m, sc.Name+"-ImageUUID-"+slot),
+				Type: HDDrive,
+				Controller: StorageControllerAttachment{
+					Type:         sc.Type,
+					Port:         port,
+					Device:       device,
+					Name:         sc.Name,
+					HotPluggable: stringValue(m, sc.Name+"-hot-pluggable-"+slot) == "on",
+				},
+			}
+			// only removable drives report whether they are ejected
+			if _, ok := m[sc.Name+"-IsEjected-"+slot]; ok || path == EmptyDrive {
+				d.Type = DVDDrive
+			}
+			if path == EmptyDrive {
+				d.Path = ""
+			}
+			disks = append(disks, d)
+		}
+	}
+	return disks
+}
+
 func (vb *VBox) ModifyVM(vm *VirtualMachine, parameters []string) error {
 	if len(parameters) == 0 {
 		return errors.New("No parameters to change")
@@ -157,10 +181,14 @@ func (vb *VBox) ModifyVM(vm *VirtualMachine, parameters []string) error {
 					args = append(args, fmt.Sprintf("--bridgeadapter%d", nic.Index), nic.NetworkName)
 				case NWMode_hostonly:
 					args = append(args, fmt.Sprintf("--hostonlyadapter%d", nic.Index), nic.NetworkName)
+				case NWMode_hostonlynet:
+					args = append(args, fmt.Sprintf("--host-only-net%d", nic.Index), nic.NetworkName)
 				case NWMode_intnet:
 					args = append(args, fmt.Sprintf("--intnet%d", nic.Index), nic.NetworkName)
 				case NWMode_natnetwork:
 					args = append(args, fmt.Sprintf("--nat-network%d", nic.Index), nic.NetworkName)
+				case NWMode_nat:
+					args = append(args, natEngineArgs(nic.Index, nic.NATEngine)...)
 				}
 			}
 		case "drag_and_drop":
@@ -263,10 +291,72 @@ func (vb *VBox) Reset(vm *VirtualMachine) (string, error) {
 	return vb.control(vm, "reset")
 }
 
+// DiscardState throws away the saved state of a vm in the saved state, leaving it powered off
+func (vb *VBox) DiscardState(vm *VirtualMachine) (string, error) {
+	return vb.manage("discardstate", vm.UUIDOrName())
+}
+
+// State returns the current state of the vm without reading the rest of its configuration
+func (vb *VBox) State(vm *VirtualMachine) (VirtualMachineState, error) {
+	return vb.state(context.Background(), vm)
+}
+
+func (vb *VBox) state(ctx context.Context, vm *VirtualMachine) (VirtualMachineState, error) {
+	out, err := vb.manageWithContext(ctx, "showvminfo", vm.UUIDOrName(), "--machinereadable")
+	if err != nil && ctx.Err() != nil {
+		return "", ctx.Err()
+	}
+	if err != nil {
+		return "", ErrMachineNotExist
+	}
+	return VirtualMachineState(stringValue(parseMachineReadable(out), "VMState")), nil
+}
+
+// WaitForState polls the vm every interval until it reaches one of the states or the context is done
+func (vb *VBox) WaitForState(ctx context.Context, vm *VirtualMachine, interval time.Duration, states ...VirtualMachineState) (VirtualMachineState, error) {
+	for {
+		state, err := vb.state(ctx, vm)
+		if err != nil {
+			return state, err
+		}
+		for _, s := range states {
+			if state == s {
+				return state, nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return state, ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// GuestProperty returns the value of a guest property, the empty string when the guest has not set it
+func (vb *VBox) GuestProperty(vm *VirtualMachine, key string) (string, error) {
+	return vb.guestProperty(context.Background(), vm, key)
+}
+
+func (vb *VBox) guestProperty(ctx context.Context, vm *VirtualMachine, key string) (string, error) {
+	out, err := vb.manageWithContext(ctx, "guestproperty", "get", vm.UUIDOrName(), key)
+	if err != nil {
+		return "", err
+	}
+	out = strings.TrimSpace(out)
+	if strings.HasPrefix(out, "No value set") {
+		return "", nil
+	}
+	return strings.TrimPrefix(out, "Value: "), nil
+}
+
 func (vb *VBox) EnableIOAPIC(vm *VirtualMachine) (string, error) {
 	return vb.modify(vm, "--ioapic", "on")
 }
 
+// reNICKey matches the nicN keys of showvminfo that start the settings of each nic slot
+var reNICKey = regexp.MustCompile(`^nic\d+$`)
+
 func (vb *VBox) VMInfoGetRules(machine *VirtualMachine) (*VirtualMachine, error) {
 	out, err := vb.manage("showvminfo", machine.UUIDOrName(), "--machinereadable")
 	if err != nil {
@@ -292,103 +382,97 @@ func (vb *VBox) VMInfoGetRules(machine *VirtualMachine) (*VirtualMachine, error)
 		return nil
 	})
 
-	amountOFNICs := len(machine.Spec.NICs)
-	if amountOFNICs == 0 {
+	if len(machine.Spec.NICs) == 0 || len(optionList) == 0 {
 		return machine, nil
 	}
 
-	position := 0
-	for i := 1; i <= amountOFNICs; i++ {
-		keyNIC := fmt.Sprintf("nic%d", i)
-		for {
-			if optionList[position][0] == keyNIC || position >= len(optionList)-1 {
-				break
-			}
-			position++
+	parseRule := func(value string, index int, nicNumber int) (*PortForwarding, error) {
+		data := strings.Split(value, ",")
+		if len(data) != 6 {
+			return nil, fmt.Errorf("some problems with rule, sorry (-____-)")
 		}
 
-		if optionList[position][0] == keyNIC && optionList[position][1] != "nat" {
-			continue
+		protocol := TCP
+		if data[1] == "udp" {
+			protocol = UDP
 		}
 
-		parseRule := func(value string, index int, nicNumber int) (*PortForwarding, error) {
-			data := strings.Split(value, ",")
-			if len(data) != 6 {
-				return nil, fmt.Errorf("some problems with rule, sorry (-____-)")
-			}
+		hostPort, err := strconv.Atoi(data[3])
+		if err != nil {
+			return nil, err
+		}
 
-			protocol := TCP
-			if data[1] == "udp" {
-				protocol = UDP
-			}
+		guestPort, err := strconv.Atoi(data[5])
 
-			hostPort, err := strconv.Atoi(data[3])
-			if err != nil {
-				return nil, err
-			}
+		newPortForwarding := &PortForwarding{
+			NicIndex:  nicNumber,
+			Index:     index,
+			Name:      data[0],
+			Protocol:  protocol,
+			HostIP:    data[2],
+			HostPort:  hostPort,
+			GuestIP:   data[4],
+			GuestPort: guestPort,
+		}
+		return newPortForwarding, nil
+	}
 
-			guestPort, err := strconv.Atoi(data[5])
-
-			newPortForwarding := &PortForwarding{
-				NicIndex:  nicNumber,
-				Index:     index,
-				Name:      data[0],
-				Protocol:  protocol,
-				HostIP:    data[2],
-				HostPort:  hostPort,
-				GuestIP:   data[4],
-				GuestPort: guestPort,
-			}
-			return newPortForwarding, nil
+	// the rules follow the nicN key of their nic, match them by the index of the nic rather than its position in
+	// the spec, VMInfo leaves out the slots without a nic
+	for i := range machine.Spec.NICs {
+		nic := &machine.Spec.NICs[i]
+		index := nic.Index
+		if index == 0 {
+			index = i + 1
+		}
+		keyNIC := fmt.Sprintf("nic%d", index)
+
+		position := 0
+		for position < len(optionList) && optionList[position][0] != keyNIC {
+			position++
+		}
+		if position == len(optionList) || optionList[position][1] != "nat" {
+			continue
 		}
 
-		nextNICkey := fmt.Sprint("nic%d", i+1)
 		portForwardingKey := "Forwarding(0)"
 		ruleId := 0
-		machine.Spec.NICs[i-1].PortForwarding = make([]PortForwarding, 0)
-		for {
-			if optionList[position][0] == portForwardingKey {
-				portForwarding, err := parseRule(optionList[position][1].(string), ruleId, i)
+		nic.PortForwarding = make([]PortForwarding, 0)
+		for position++; position < len(optionList); position++ {
+			key := optionList[position][0].(string)
+			if key == portForwardingKey {
+				portForwarding, err := parseRule(optionList[position][1].(string), ruleId, index)
 				if err != nil {
 					return machine, err
 				}
-				machine.Spec.NICs[i-1].PortForwarding = append(machine.Spec.NICs[i-1].PortForwarding, *portForwarding)
+				nic.PortForwarding = append(nic.PortForwarding, *portForwarding)
 				ruleId++
 				portForwardingKey = fmt.Sprintf("Forwarding(%d)", ruleId)
-			} else if position >= len(optionList)-1 || optionList[position][0] == nextNICkey {
+			} else if reNICKey.MatchString(key) {
 				break
 			}
-			position++
 		}
 	}
 	return machine, nil
 }
 
+// isMachineNotFoundMessage tells whether VBoxManage failed as no vm of the name or uuid is registered
+func isMachineNotFoundMessage(out string) bool {
+	return strings.Contains(out, "Could not find a registered machine")
+}
+
+// VMInfo returns the vm, ErrMachineNotExist when VirtualBox has no such vm and the VBoxManage error otherwise
 func (vb *VBox) VMInfo(uuidOrVmName string) (machine *VirtualMachine, err error) {
 	out, err := vb.manage("showvminfo", uuidOrVmName, "--machinereadable")
-	if err != nil {
+	if err != nil && isMachineNotFoundMessage(err.Error()) {
 		return nil, ErrMachineNotExist
 	}
+	if err != nil {
+		return nil, err
+	}
 
 	// lets populate the map from output strings
-	m := map[string]interface{}{}
-	_ = parseKeyValues(out, reKeyEqVal, func(key, val string) error {
-		if strings.HasPrefix(key, "\"") {
-			if k, err := strconv.Unquote(key); err == nil {
-				key = k
-			} //else ignore; might need to warn in log
-		}
-		if strings.HasPrefix(val, "\"") {
-			if val, err := strconv.Unquote(val); err == nil {
-				m[key] = val
-			}
-		} else if i, err := strconv.Atoi(val); err == nil {
-			m[key] = i
-		} else { // we dont expect any actually
-			glog.V(6).Infof("ignoring parsing val %s for key %s", val, key)
-		}
-		return nil
-	})
+	m := parseMachineReadable(out)
 
 	vm := &VirtualMachine{}
 
@@ -410,73 +494,22 @@ func (vb *VBox) VMInfo(uuidOrVmName string) (machine *VirtualMachine, err error)
 	vm.Spec.State = VirtualMachineState(m["VMState"].(string))
 
 	//Snapshots--------------------------
-	helper := func(str string) string {
-		sub_string := ""
-		for symbol := range str {
-			if symbol == '1' {
-				sub_string += "-1"
-			}
-		}
-		return sub_string
-	}
-
-	subStringGenerator := func(cnt int) string {
-		result := ""
-		for i := 0; i < cnt; i++ {
-			result += "-1"
-		}
-		return result
-	}
-
-	listOfSnapshots := make([]Snapshot, 0, 10)
-	count := 0
-	subStr := ""
-	for {
-		if _, ok := m["SnapshotName"+subStr]; !ok {
-			break
+	tree := parseSnapshotTree(m)
+	if tree != nil {
+		if err := vb.readSnapshotSettings(path, tree); err != nil {
+			glog.V(6).Infof("unable to read snapshot details from %s: %v", path, err)
 		}
-
-		var description string
-		val, ok := m["SnapshotDescription"+subStr]
-		if ok {
-			description = val.(string)
-		} else {
-			description = ""
+		vm.Spec.Snapshots = tree.Flatten()
+		if current := tree.FindCurrent(); current != nil {
+			vm.Spec.CurrentSnapshot = current.Snapshot
 		}
-
-		listOfSnapshots = append(listOfSnapshots, Snapshot{
-			Name:        m["SnapshotName"+subStr].(string),
-			Description: description,
-		})
-		count++
-		subStr = subStringGenerator(count)
-	}
-
-	vm.Spec.Snapshots = listOfSnapshots
-
-	_, ok := m["CurrentSnapshotName"]
-	if ok {
-		vm.Spec.CurrentSnapshot.Name = m["CurrentSnapshotName"].(string)
 	} else {
-		vm.Spec.CurrentSnapshot.Name = ""
-	}
-
-	val, ok := m["CurrentSnapshotNode"]
-	if ok {
-		param := "SnapshotDescription" + helper(val.(string))
-		_, ok := m[param]
-		if ok {
-			vm.Spec.CurrentSnapshot.Description = m[param].(string)
-		} else {
-			vm.Spec.CurrentSnapshot.Description = ""
-		}
-	} else {
-		vm.Spec.CurrentSnapshot.Description = ""
+		vm.Spec.Snapshots = []Snapshot{}
 	}
 	//------------------------------------
 
 	//draganddrop
-	val, ok = m["draganddrop"]
+	val, ok := m["draganddrop"]
 	if ok {
 		vm.Spec.DragAndDrop = val.(string)
 	} else {
@@ -493,6 +526,7 @@ func (vb *VBox) VMInfo(uuidOrVmName string) (machine *VirtualMachine, err error)
 
 	// fill in storage details
 	vm.Spec.StorageControllers = make([]StorageController, 0, 2)
+	vm.Spec.Disks = make([]Disk, 0, 2)
 
 	for i := 0; i < 20; i++ { // upto a 20 storage controller? :)
 		sk := fmt.Sprintf("storagecontrollername%d", i)
@@ -500,16 +534,10 @@ func (vb *VBox) VMInfo(uuidOrVmName string) (machine *VirtualMachine, err error)
 
 			sc := StorageController{Name: v.(string)}
 
-			switch fmt.Sprintf("storagecontrollertype%d", i) {
-			case string(SATA):
-				sc.Type = SATA
-			case string(IDE):
-				sc.Type = IDE
-			case string(SCSCI):
-				sc.Type = SCSCI
-			case string(NVME):
-				sc.Type = NVME
-			}
+			// the type is reported as the chipset, for e.g IntelAhci
+			chipset := StorageControllerChipset(stringValue(m, fmt.Sprintf("storagecontrollertype%d", i)))
+			sc.Chipset = chipset.normalize()
+			sc.Type = chipset.Type()
 
 			var err error
 
@@ -531,25 +559,7 @@ func (vb *VBox) VMInfo(uuidOrVmName string) (machine *VirtualMachine, err error)
 				}
 			}
 
-			vm.Spec.Disks = make([]Disk, 0, 2)
-
-			for j := 0; j < sc.PortCount; j++ {
-				dp := fmt.Sprintf("%s-%d-%d", v, j, 0) // key to path of disk, e.g SATA1-0-0
-				if dpv, ok := m[dp]; ok && dpv != "none" {
-					d := Disk{
-						Path: dpv.(string),
-						Controller: StorageControllerAttachment{
-							Type: sc.Type,
-							Port: j,
-							Name: sc.Name,
-						},
-					}
-					if duv, ok := m[fmt.Sprintf("%s-ImageUUID-%d-%d", v, j, 0)]; ok { // e.g SATA1-ImageUUID-0-0
-						d.UUID = duv.(string)
-					}
-					vm.Spec.Disks = append(vm.Spec.Disks, d)
-				}
-			}
+			vm.Spec.Disks = append(vm.Spec.Disks, storageAttachments(m, sc)...)
 			vm.Spec.StorageControllers = append(vm.Spec.StorageControllers, sc)
 
 		} else { //storage controllers index not found, dont loop anymore
@@ -562,12 +572,16 @@ func (vb *VBox) VMInfo(uuidOrVmName string) (machine *VirtualMachine, err error)
 	for i := 1; i < 20; i++ { // upto a 20 nics
 		n := fmt.Sprintf("nic%d", i)
 
-		nic := NIC{}
+		nic := NIC{Index: i}
 		if v, ok := m[n]; ok {
 			if v == "none" {
 				continue
 			}
 			nic.Mode = NetworkMode(v.(string))
+			// showvminfo spells the mode differently from modifyvm
+			if nic.Mode == "hostonlynetwork" {
+				nic.Mode = NWMode_hostonlynet
+			}
 		} else {
 			continue
 		}
@@ -598,22 +612,44 @@ func (vb *VBox) VMInfo(uuidOrVmName string) (machine *VirtualMachine, err error)
 			if v, ok := m[n]; ok {
 				nic.NetworkName = v.(string)
 			}
+		case NWMode_hostonlynet:
+			n = fmt.Sprintf("hostonly-network%d", i)
+			if v, ok := m[n]; ok {
+				nic.NetworkName = v.(string)
+			}
 		case NWMode_natnetwork:
 			n = fmt.Sprintf("natnet%d", i)
 			if v, ok := m[n]; ok {
 				nic.NetworkName = v.(string)
 			}
+		case NWMode_nat:
+			// natnet reads nat while the guest network is the default one
+			n = fmt.Sprintf("natnet%d", i)
+			if v, ok := m[n]; ok && v.(string) != "nat" {
+				nic.NATEngine.Network = v.(string)
+			}
 		}
 
 		vm.Spec.NICs = append(vm.Spec.NICs, nic)
 	}
 
+	// the host i/o cache, most attachment options and bandwidth groups are only found in the settings file
+	if settings, err := readSettingsFile(path); err == nil {
+		settings.Machine.applySettings(path, &vm.Spec)
+	} else {
+		glog.V(6).Infof("unable to read storage and bandwidth details from %s: %v", path, err)
+	}
+
 	updatedVm, err := vb.VMInfoGetRules(vm)
 	return updatedVm, err
 }
 
 func (vb *VBox) Define(context context.Context, vm *VirtualMachine) (*VirtualMachine, error) {
 
+	if err := vb.ValidateVMPortForwards(context, vm); err != nil {
+		return nil, err
+	}
+
 	if err := vb.EnsureVMHostPath(vm); err != nil {
 		return nil, err
 	}
@@ -653,6 +689,13 @@ func (vb *VBox) Define(context context.Context, vm *VirtualMachine) (*VirtualMac
 		}
 	}
 
+	// disks and nics refer to the bandwidth groups, so they go first
+	for i, g := range vm.Spec.BandwidthGroups {
+		if err := vb.AddBandwidthGroup(vm, g); err != nil && !IsAlreadyExistsError(err) {
+			return nil, OperationError{Path: fmt.Sprintf("bandwidthgroup/%d", i), Op: "add", Err: err}
+		}
+	}
+
 	disks := vm.Spec.Disks
 	for i := range disks {
 		if err := vb.AttachStorage(vm, &disks[i]); err != nil && !IsAlreadyExistsError(err) {
@@ -693,18 +736,22 @@ func (vb *VBox) EnsureVMHostPath(vm *VirtualMachine) error {
 }
 
 // EnsureDefaults expands the vm structure to fill in details needed based on well defined conventions
-// The returned instance has all the modifications and may be the same as the passed in instance
+// The returned instance has all the modifications and may be the same as the passed in instance.
+// Duplicate controller names, unresolved controller refs and invalid slots fail with ValidationErrors
 func (vb *VBox) EnsureDefaults(vm *VirtualMachine) (machine *VirtualMachine, err error) {
 
 	verr := ValidationErrors{}
 	tsctl := map[string]*StorageController{}
+	var ctlNames []string
 
-	for i, c := range vm.Spec.StorageControllers {
+	for i := range vm.Spec.StorageControllers {
+		c := vm.Spec.StorageControllers[i]
 		if c.Name == "" {
 			c.Name = fmt.Sprintf("%s%d", string(c.Type), i+1) // for e.g ide1
 		}
 		if _, ok := tsctl[c.Name]; !ok {
 			tsctl[c.Name] = &c
+			ctlNames = append(ctlNames, c.Name)
 		} else {
 			verr.Add(fmt.Sprintf("storagecontroller/[%d]/", i), fmt.Errorf("duplicate name"))
 		}
@@ -728,55 +775,56 @@ func (vb *VBox) EnsureDefaults(vm *VirtualMachine) (machine *VirtualMachine, err
 			disk.Controller.Type = SATA
 		}
 
+		if disk.Controller.Name == "" {
+			// prefer a controller of the same type the spec already has
+			for _, name := range ctlNames {
+				if tsctl[name].Type == disk.Controller.Type {
+					disk.Controller.Name = name
+					break
+				}
+			}
+		}
+
 		if disk.Controller.Name == "" {
 			sctlName := fmt.Sprintf("%s1", string(disk.Controller.Type))
 			disk.Controller.Name = sctlName // default to 1, for e.g ide1
 			// auto create a storage controller if one does not already exist
 			if _, ok := tsctl[sctlName]; !ok {
 				tsctl[sctlName] = &StorageController{Name: sctlName, Type: disk.Controller.Type}
+				ctlNames = append(ctlNames, sctlName)
 			}
 		}
 
 		if disks[i].Format == "" {
 			disks[i].Format = VDI
 		}
-	}
-
-	// counts track the number of disks using a storage controller
-	counts := map[string]int{}
-
-	// now set back the storage controllers to VM
-	vm.Spec.StorageControllers = []StorageController{}
-	for k, v := range tsctl {
-		vm.Spec.StorageControllers = append(vm.Spec.StorageControllers, *v)
-		counts[k] = 0
-	}
-
-	// now ensure that we account for all user set and auto assigned (defaulted) value and attach them to ports
-	for i := range disks {
 
 		if disks[i].Path == "" {
 			verr.Add(fmt.Sprintf("disk/%d", i), fmt.Errorf("disk path is empty, needs an absolute file path"))
 		}
+	}
 
-		if count, ok := counts[disks[i].Controller.Name]; ok {
-			counts[disks[i].Controller.Name] = count + 1
-			switch disks[i].Controller.Type {
-			case IDE:
-				disks[i].Controller.Port = count / 2
-				disks[i].Controller.Device = count % 2
-			case SATA:
-				disks[i].Controller.Port = count
-			default:
-				disks[i].Controller.Port = count
-				glog.Warning("trying to default the port for controller type %s, this might not work", disks[i].Controller.Type)
-			}
-
-		} else {
-			verr.Add(fmt.Sprintf("disk/%d", i), fmt.Errorf("storagecontroller ref %s did not resolve", disks[i].Controller.Name))
+	// now set back the storage controllers to VM
+	vm.Spec.StorageControllers = []StorageController{}
+	for _, name := range ctlNames {
+		vm.Spec.StorageControllers = append(vm.Spec.StorageControllers, *tsctl[name])
+	}
+
+	// when the vm exists, the ports its other media use are taken and its disks stay where they are
+	var existing []Disk
+	if vm.UUIDOrName() != "" {
+		current, err := vb.VMInfo(vm.UUIDOrName())
+		switch {
+		case err == nil:
+			existing = current.Spec.Disks
+		case err != ErrMachineNotExist:
+			return nil, err
 		}
 	}
 
+	// now ensure that we account for all user set and auto assigned (defaulted) value and attach them to ports
+	assignStorageSlots(vm.Spec.StorageControllers, disks, existing, &verr)
+
 	if err := vb.SetNICDefaults(vm); err != nil {
 		return nil, err
 	}
@@ -0,0 +1,122 @@
+package virtualbox
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// ListMedia returns the media of the given kind known to the VirtualBox media registry
+func (vb *VBox) ListMedia(ctx context.Context, kind DiskType) ([]Disk, error) {
+	list := kind.ForList()
+	if list == "" {
+		return nil, fmt.Errorf("unknown medium kind %q", kind)
+	}
+
+	out, err := vb.manageWithContext(ctx, "list", "--long", list)
+	if err != nil {
+		return nil, err
+	}
+
+	media := parseMediaList(out)
+	for i := range media {
+		media[i].Type = kind
+	}
+	return media, nil
+}
+
+// parseMediaList splits the list output into its blank line separated records
+func parseMediaList(out string) []Disk {
+	var media []Disk
+	for _, block := range strings.Split(strings.Replace(out, "\r\n", "\n", -1), "\n\n") {
+		if strings.TrimSpace(block) == "" {
+			continue
+		}
+		if d := parseMediumInfo(block); d.UUID != "" {
+			media = append(media, d)
+		}
+	}
+	return media
+}
+
+// GarbageReport lists the media CollectGarbage closed, or would close on a dry run
+type GarbageReport struct {
+	DryRun    bool
+	Collected []Disk
+	Failed    []OperationError
+}
+
+// collectable returns the media under basePath that are inaccessible or not used by any vm. A medium that still has
+// children is only collectable when all of its children are. Base images are left alone even without children, they
+// are removed with DeleteBaseImage
+func collectable(media []Disk, basePath string) []Disk {
+	children := map[string]int{}
+	for _, d := range media {
+		if d.ParentUUID != "" {
+			children[d.ParentUUID]++
+		}
+	}
+
+	var garbage []Disk
+	collected := map[string]bool{}
+	for {
+		found := false
+		for _, d := range media {
+			if collected[d.UUID] || children[d.UUID] > 0 || !isUnder(d.Path, basePath) || isBaseImageType(d.MediumType) {
+				continue
+			}
+			if d.State != MediumInaccessible && len(d.AttachedVMs) > 0 {
+				continue
+			}
+			collected[d.UUID] = true
+			garbage = append(garbage, d)
+			if d.ParentUUID != "" {
+				children[d.ParentUUID]--
+			}
+			found = true
+		}
+		if !found {
+			return garbage
+		}
+	}
+}
+
+func isUnder(path, basePath string) bool {
+	rel, err := filepath.Rel(basePath, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// CollectGarbage closes the media below Config.BasePath that are inaccessible or unattached, so the ones leaked by
+// failed or aborted runs do not pile up in the registry. Hard disk files are deleted, dvd and floppy images are kept
+func (vb *VBox) CollectGarbage(ctx context.Context, dryRun bool) (*GarbageReport, error) {
+	report := &GarbageReport{DryRun: dryRun}
+
+	for _, kind := range []DiskType{HDDrive, DVDDrive, FDDrive} {
+		media, err := vb.ListMedia(ctx, kind)
+		if err != nil {
+			return report, err
+		}
+
+		for _, d := range collectable(media, vb.Config.BasePath) {
+			if dryRun {
+				report.Collected = append(report.Collected, d)
+				continue
+			}
+
+			args := []string{"closemedium", kind.ForShowMedium(), d.UUID}
+			if kind == HDDrive && d.State != MediumInaccessible {
+				args = append(args, "--delete")
+			}
+			if _, err := vb.manageWithContext(ctx, args...); err != nil {
+				if ctx.Err() != nil {
+					return report, ctx.Err()
+				}
+				report.Failed = append(report.Failed, OperationError{Path: d.Path, Op: "close", Err: err})
+				continue
+			}
+			report.Collected = append(report.Collected, d)
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,124 @@
+package virtualbox
+
+import (
+	"reflect"
+	"testing"
+)
+
+var listHddsOutput = `UUID:           11111111-0000-0000-0000-000000000001
+Parent UUID:    base
+State:          created
+Type:           normal (base)
+Location:       /vms/example/vm01/disk1.vdi
+Storage format: VDI
+Capacity:       10 MBytes
+Encryption:     disabled
+In use by VMs:  vm01 (UUID: 6aa44e71-71c6-4e68-a61f-f69e133ecffa)
+
+UUID:           11111111-0000-0000-0000-000000000002
+Parent UUID:    base
+State:          created
+Type:           normal (base)
+Location:       /vms/example/vm02/disk1.vdi
+Storage format: VDI
+Capacity:       10 MBytes
+Encryption:     disabled
+
+UUID:           11111111-0000-0000-0000-000000000003
+Parent UUID:    base
+State:          inaccessible
+Type:           normal (base)
+Location:       /vms/example/vm03/disk1.vdi
+Storage format: VDI
+Capacity:       0 MBytes
+Encryption:     disabled
+In use by VMs:  vm03 (UUID: 6aa44e71-71c6-4e68-a61f-f69e133ecffc)
+
+UUID:           11111111-0000-0000-0000-000000000004
+Parent UUID:    base
+State:          created
+Type:           immutable (base)
+Location:       /vms/base/golden.vdi
+Storage format: VDI
+Capacity:       100 MBytes
+Encryption:     disabled
+
+UUID:           11111111-0000-0000-0000-000000000005
+Parent UUID:    11111111-0000-0000-0000-000000000004
+State:          created
+Type:           normal (differencing)
+Location:       /vms/example/vm04/Snapshots/{11111111-0000-0000-0000-000000000005}.vdi
+Storage format: VDI
+Capacity:       100 MBytes
+Encryption:     disabled
+
+UUID:           11111111-0000-0000-0000-000000000006
+Parent UUID:    base
+State:          created
+Type:           normal (base)
+Location:       /elsewhere/disk.vdi
+Storage format: VDI
+Capacity:       10 MBytes
+Encryption:     disabled
+`
+
+func TestParseMediaList(t *testing.T) {
+	media := parseMediaList(listHddsOutput)
+	if len(media) != 6 {
+		t.Fatalf("expected 6 media, got %d", len(media))
+	}
+
+	if media[0].Path != "/vms/example/vm01/disk1.vdi" || len(media[0].AttachedVMs) != 1 || media[0].SizeMB != 10 {
+		t.Errorf("unexpected first medium %+v", media[0])
+	}
+	if media[2].State != MediumInaccessible {
+		t.Errorf("expected third medium to be inaccessible, got %s", media[2].State)
+	}
+	if media[4].ParentUUID != "11111111-0000-0000-0000-000000000004" {
+		t.Errorf("expected parent uuid, got %q", media[4].ParentUUID)
+	}
+	if media[3].ParentUUID != "" {
+		t.Errorf("expected base medium to have no parent, got %q", media[3].ParentUUID)
+	}
+}
+
+func TestCollectable(t *testing.T) {
+	garbage := collectable(parseMediaList(listHddsOutput), "/vms")
+
+	collected := map[string]bool{}
+	for _, d := range garbage {
+		collected[d.UUID] = true
+	}
+
+	// unattached, inaccessible, and the unattached differencing image, but not the immutable base it leaves childless
+	for _, uuid := range []string{
+		"11111111-0000-0000-0000-000000000002",
+		"11111111-0000-0000-0000-000000000003",
+		"11111111-0000-0000-0000-000000000005",
+	} {
+		if !collected[uuid] {
+			t.Errorf("expected %s to be collected", uuid)
+		}
+	}
+	if len(garbage) != 3 {
+		t.Errorf("expected 3 media to be collected, got %+v", garbage)
+	}
+}
+
+func TestCollectableKeepsBaseImages(t *testing.T) {
+	media := []Disk{
+		{UUID: "golden", Path: "/vms/base/golden.vdi", MediumType: ImmutableMedium},
+		{UUID: "shared", Path: "/vms/base/shared.vdi", MediumType: MultiattachMedium},
+		{UUID: "parent", Path: "/vms/example/parent.vdi", MediumType: NormalMedium},
+		{UUID: "child", ParentUUID: "parent", Path: "/vms/example/child.vdi", MediumType: NormalMedium},
+	}
+
+	var collected []string
+	for _, d := range collectable(media, "/vms") {
+		collected = append(collected, d.UUID)
+	}
+	// children go first
+	if !reflect.DeepEqual(collected, []string{"child", "parent"}) {
+		t.Errorf("expected only the normal chain to be collected, child first, got %v", collected)
+	}
+}
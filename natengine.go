@@ -0,0 +1,97 @@
+package virtualbox
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// NATAliasMode tunes how the NAT engine of a nic rewrites connections
+type NATAliasMode string
+
+const (
+	NATAliasLog       = NATAliasMode("log")
+	NATAliasProxyOnly = NATAliasMode("proxyonly")
+	NATAliasSamePorts = NATAliasMode("sameports")
+)
+
+// NATEngine configures the NAT engine behind a nat mode nic, zero values keep the VirtualBox defaults
+type NATEngine struct {
+	// Network is the guest side network in CIDR notation, 10.0.2.0/24 by default
+	Network string
+	// DNSHostResolver, DNSProxy and DNSPassDomain are on or off
+	DNSHostResolver string
+	DNSProxy        string
+	DNSPassDomain   string
+	// BindIP is the host address outgoing connections are made from
+	BindIP string
+	// MTU and the socket and tcp window sizes, in kilobytes, go to --natsettings
+	MTU              int
+	SocketSend       int
+	SocketReceive    int
+	TCPWindowSend    int
+	TCPWindowReceive int
+	AliasMode        []NATAliasMode
+	TFTPPrefix       string
+	TFTPFile         string
+	TFTPServer       string
+}
+
+func intOrEmpty(v int) string {
+	if v == 0 {
+		return ""
+	}
+	return strconv.Itoa(v)
+}
+
+// natEngineArgs returns the modifyvm options configuring the NAT engine of the nic with the given index
+func natEngineArgs(index int, e NATEngine) []string {
+	var args []string
+	add := func(option, value string) {
+		if value != "" {
+			args = append(args, fmt.Sprintf("--%s%d", option, index), value)
+		}
+	}
+
+	add("natnet", e.Network)
+	add("natdnshostresolver", e.DNSHostResolver)
+	add("natdnsproxy", e.DNSProxy)
+	add("natdnspassdomain", e.DNSPassDomain)
+	add("natbindip", e.BindIP)
+	if e.MTU != 0 || e.SocketSend != 0 || e.SocketReceive != 0 || e.TCPWindowSend != 0 || e.TCPWindowReceive != 0 {
+		add("natsettings", strings.Join([]string{
+			intOrEmpty(e.MTU),
+			intOrEmpty(e.SocketSend),
+			intOrEmpty(e.SocketReceive),
+			intOrEmpty(e.TCPWindowSend),
+			intOrEmpty(e.TCPWindowReceive),
+		}, ","))
+	}
+	if e.AliasMode != nil {
+		modes := make([]string, len(e.AliasMode))
+		for i, m := range e.AliasMode {
+			modes[i] = string(m)
+		}
+		if len(modes) == 0 {
+			modes = []string{"default"}
+		}
+		add("nataliasmode", strings.Join(modes, ","))
+	}
+	add("nattftpprefix", e.TFTPPrefix)
+	add("nattftpfile", e.TFTPFile)
+	add("nattftpserver", e.TFTPServer)
+	return args
+}
+
+// SetNATEngine applies nic.NATEngine to the nat mode nic of the vm, the vm must be powered off
+func (vb *VBox) SetNATEngine(vm *VirtualMachine, nic *NIC) error {
+	if nic.Mode != NWMode_nat {
+		return fmt.Errorf("nic %d is %s, only nat nics have a NAT engine", nic.Index, nic.Mode)
+	}
+	args := natEngineArgs(nic.Index, nic.NATEngine)
+	if len(args) == 0 {
+		return nil
+	}
+	_, err := vb.modify(vm, args...)
+	return err
+}
@@ -0,0 +1,85 @@
+package virtualbox
+
+import (
+	"encoding/xml"
+	"reflect"
+	"testing"
+)
+
+func TestNATEngineArgs(t *testing.T) {
+	if args := natEngineArgs(1, NATEngine{}); len(args) != 0 {
+		t.Errorf("expected defaults to pass no options, got %v", args)
+	}
+
+	args := natEngineArgs(2, NATEngine{
+		Network:         "10.0.3.0/24",
+		DNSHostResolver: "on",
+		DNSPassDomain:   "off",
+		BindIP:          "192.168.1.10",
+		MTU:             1400,
+		TCPWindowSend:   128,
+		AliasMode:       []NATAliasMode{NATAliasLog, NATAliasSamePorts},
+		TFTPFile:        "pxelinux.0",
+	})
+	expected := []string{
+		"--natnet2", "10.0.3.0/24",
+		"--natdnshostresolver2", "on",
+		"--natdnspassdomain2", "off",
+		"--natbindip2", "192.168.1.10",
+		"--natsettings2", "1400,,,128,",
+		"--nataliasmode2", "log,sameports",
+		"--nattftpfile2", "pxelinux.0",
+	}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("expected %v, got %v", expected, args)
+	}
+
+	if args := natEngineArgs(1, NATEngine{AliasMode: []NATAliasMode{}}); !reflect.DeepEqual(args, []string{"--nataliasmode1", "default"}) {
+		t.Errorf("expected empty alias mode to reset it, got %v", args)
+	}
+}
+
+func TestSettingsNATEngine(t *testing.T) {
+	var settings settingsFile
+	if err := xml.Unmarshal([]byte(`<VirtualBox>
+  <Machine uuid="{6aa44e71-71c6-4e68-a61f-f69e133ecffa}" name="testvm1">
+    <Hardware>
+      <Network>
+        <Adapter slot="0" enabled="true" type="82540EM">
+          <NAT network="10.0.3.0/24" hostip="192.168.1.10" mtu="1400" tcpsnd="128">
+            <DNS pass-domain="false" use-host-resolver="true"/>
+            <Alias logging="true" use-same-ports="true"/>
+            <TFTP boot-file="pxelinux.0" next-server="10.0.3.4"/>
+          </NAT>
+        </Adapter>
+        <Adapter slot="1" enabled="true" type="82540EM">
+          <NAT/>
+        </Adapter>
+      </Network>
+    </Hardware>
+  </Machine>
+</VirtualBox>`), &settings); err != nil {
+		t.Fatalf("unmarshal failed %v", err)
+	}
+
+	spec := VirtualMachineSpec{NICs: []NIC{{Index: 1, Mode: NWMode_nat}, {Index: 2, Mode: NWMode_nat}}}
+	settings.Machine.applySettings("/vms/testvm1/testvm1.vbox", &spec)
+
+	expected := NATEngine{
+		Network:         "10.0.3.0/24",
+		DNSHostResolver: "on",
+		DNSPassDomain:   "off",
+		BindIP:          "192.168.1.10",
+		MTU:             1400,
+		TCPWindowSend:   128,
+		AliasMode:       []NATAliasMode{NATAliasLog, NATAliasSamePorts},
+		TFTPFile:        "pxelinux.0",
+		TFTPServer:      "10.0.3.4",
+	}
+	if !reflect.DeepEqual(spec.NICs[0].NATEngine, expected) {
+		t.Errorf("expected %+v, got %+v", expected, spec.NICs[0].NATEngine)
+	}
+	if !reflect.DeepEqual(spec.NICs[1].NATEngine, NATEngine{}) {
+		t.Errorf("expected default NAT engine, got %+v", spec.NICs[1].NATEngine)
+	}
+}
@@ -2,14 +2,48 @@ package virtualbox
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"regexp"
 	"strconv"
 	"strings"
+
+	"github.com/golang/glog"
 )
 
+// AddNatNet creates the nat network, with nat.Network set to AnySubnet it gets a subnet allocated to it. When a
+// step fails the network and the subnet allocated for it go again and nat.Network is restored
 func (vb *VBox) AddNatNet(nat *NatNetwork) error {
+	network := nat.Network
+	allocated, added := false, false
+	undo := func(err error) error {
+		if added {
+			if _, rerr := vb.manage("natnetwork", "remove", "--netname", nat.NetName); rerr != nil {
+				glog.Warningf("removing nat network %s failed: %v", nat.NetName, rerr)
+			}
+		}
+		if allocated {
+			if rerr := vb.ReleaseSubnet(natNetOwner(nat.NetName)); rerr != nil {
+				glog.Warningf("releasing the subnet of %s failed: %v", nat.NetName, rerr)
+			}
+		}
+		nat.Network = network
+		return err
+	}
+
+	if prefix, ok := anySubnetPrefix(nat.Network); ok {
+		a, created, err := vb.allocateSubnet(context.Background(), natNetOwner(nat.NetName), prefix)
+		if err != nil {
+			return err
+		}
+		nat.Network, allocated = a.CIDR, created
+	}
+
+	if err := vb.ValidateNatNetPortForwards(context.Background(), nat); err != nil {
+		return undo(err)
+	}
+
 	args := []string{"natnetwork", "add", "--netname", nat.NetName, "--network", nat.Network}
 	if !nat.Enabled {
 		args = append(args, "--disable")
@@ -21,17 +55,18 @@ func (vb *VBox) AddNatNet(nat *NatNetwork) error {
 		args = append(args, "--ipv6", "on")
 	}
 	if _, err := vb.manage(args...); err != nil {
-		return err
+		return undo(err)
 	}
+	added = true
 
 	if len(nat.PortForward4) != 0 {
 		if err := vb.AddAllPortForwNat(nat, nat.PortForward4, "--port-forward-4"); err != nil {
-			return err
+			return undo(err)
 		}
 	}
 	if len(nat.PortForward6) != 0 {
 		if err := vb.AddAllPortForwNat(nat, nat.PortForward6, "--port-forward-6"); err != nil {
-			return err
+			return undo(err)
 		}
 	}
 
@@ -59,8 +94,10 @@ func (vb *VBox) DeleteAllPortForwNat(nat *NatNetwork, rule []PortForwarding, fla
 
 func (vb *VBox) RemoveNatNet(nat *NatNetwork) error {
 	args := []string{"natnetwork", "remove", "--netname", nat.NetName}
-	_, err := vb.manage(args...)
-	return err
+	if _, err := vb.manage(args...); err != nil {
+		return err
+	}
+	return vb.ReleaseSubnet(natNetOwner(nat.NetName))
 }
 
 func (vb *VBox) StartNatNet(nat *NatNetwork) error {
@@ -1,40 +1,34 @@
 package virtualbox
 
 import (
+	"context"
 	"fmt"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+
+	"github.com/golang/glog"
 )
 
+// PortForwarding adds the rule to the nat nic of the vm, with controlvm while it runs and modifyvm otherwise
 func (vb *VBox) PortForwarding(vm *VirtualMachine, rule PortForwarding) error {
-
-	_, err := vb.manage("modifyvm", vm.UUIDOrName(), fmt.Sprintf("--natpf%d", rule.NicIndex), fmt.Sprintf("%v,%v,%v,%v,%v,%v", rule.Name, string(rule.Protocol), rule.HostIP, rule.HostPort, rule.GuestIP, rule.GuestPort))
-	return err
+	return vb.changePortForwards(context.Background(), vm, []PortForwarding{rule}, nil)
 }
 
+// AddALlPortForw adds the rules to the nat nics of the vm, running or not
 func (vb *VBox) AddALlPortForw(vm *VirtualMachine, rule []PortForwarding) error {
-	args := []string{"modifyvm", vm.UUIDOrName()}
-	for i := 0; i < len(rule); i++ {
-		args = append(args, fmt.Sprintf("--natpf%d", rule[i].NicIndex), fmt.Sprintf("%v,%v,%v,%v,%v,%v", rule[i].Name, string(rule[i].Protocol),
-			rule[i].HostIP, rule[i].HostPort, rule[i].GuestIP, rule[i].GuestPort))
-	}
-	_, err := vb.manage(args...)
-	return err
+	return vb.changePortForwards(context.Background(), vm, rule, nil)
 }
 
+// DeleteAllPortForw removes the rules, matched by nic and name, from the nat nics of the vm, running or not
 func (vb *VBox) DeleteAllPortForw(vm *VirtualMachine, rule []PortForwarding) error {
-	args := []string{"modifyvm", vm.UUIDOrName()}
-	for i := 0; i < len(rule); i++ {
-		args = append(args, fmt.Sprintf("--natpf%d", rule[i].NicIndex), "delete", rule[i].Name)
-	}
-	_, err := vb.manage(args...)
-	return err
+	return vb.changePortForwards(context.Background(), vm, nil, rule)
 }
 
+// PortForwardingDelete removes the named rule from the nat nic with the given index
 func (vb *VBox) PortForwardingDelete(vm *VirtualMachine, index int, name string) error {
-	_, err := vb.manage("modifyvm", vm.UUIDOrName(), fmt.Sprintf("--natpf%d", index), "delete", name)
-	return err
+	return vb.changePortForwards(context.Background(), vm, nil, []PortForwarding{{NicIndex: index, Name: name}})
 }
 
 func (vb *VBox) HostOnlyNetInfo() ([]Network, error) {
@@ -42,7 +36,11 @@ func (vb *VBox) HostOnlyNetInfo() ([]Network, error) {
 	if err != nil {
 		return nil, err
 	}
+	return parseHostOnlyIfs(out), nil
+}
 
+// parseHostOnlyIfs parses the blank line separated interfaces listed by list hostonlyifs
+func parseHostOnlyIfs(out string) []Network {
 	var nws []Network
 
 	var nw Network
@@ -56,12 +54,16 @@ func (vb *VBox) HostOnlyNetInfo() ([]Network, error) {
 			nw.IPNet = val
 		case "NetworkMask":
 			nw.IPMask = val
+		case "IPV6Address":
+			nw.IPv6Address = val
+		case "IPV6NetworkMaskPrefixLength":
+			nw.IPv6PrefixLen, _ = strconv.Atoi(val)
 		case "HardwareAddress":
 			nw.HWAddress = val
 		case "VBoxNetworkName":
 			nw.DeviceName = val[len("HostInterfaceNetworking-"):]
 		default:
-			if !ok && strings.TrimSpace(val) == "" {
+			if !ok && strings.TrimSpace(val) == "" && nw.Name != "" {
 				nw.Mode = NWMode_hostonly
 				nws = append(nws, nw)
 				nw = Network{}
@@ -69,7 +71,11 @@ func (vb *VBox) HostOnlyNetInfo() ([]Network, error) {
 		}
 		return nil
 	})
-	return nws, nil
+	if nw.Name != "" {
+		nw.Mode = NWMode_hostonly
+		nws = append(nws, nw)
+	}
+	return nws
 }
 
 func (vb *VBox) NatNetInfo() ([]Network, error) {
@@ -163,6 +169,16 @@ func (vb *VBox) SyncNICs() (err error) {
 		}
 	}
 
+	// releases before VirtualBox 7 know no host-only networks and fail to list them
+	if hostOnlyNets, err := vb.ListHostOnlyNets(); err != nil {
+		glog.V(6).Infof("no host-only networks found: %v", err)
+	} else {
+		for i := range hostOnlyNets {
+			nw := hostOnlyNets[i].Network()
+			vb.HostOnlyNets[nw.Name] = &nw
+		}
+	}
+
 	if internalNws, err := vb.InternalNetInfo(); err != nil {
 		return err
 	} else {
@@ -190,7 +206,15 @@ func (vb *VBox) SyncNICs() (err error) {
 	return nil
 }
 
+// CreateNet creates a host-only interface and sets net.Name to the name VirtualBox gave it. With net.IPNet set to
+// AnySubnet the interface gets the gateway address of a subnet allocated to it, which also fills in the blanks
+// of net.DHCP. Should that fail the interface is removed again and net left as it was. A net of mode
+// NWMode_hostonlynet creates the named host-only network instead, see hostOnlyNetFor, taking AnySubnet the same
+// way
 func (vb *VBox) CreateNet(net *Network) error {
+	if net.Mode == NWMode_hostonlynet {
+		return vb.setUpHostOnlyNet(net, vb.AddHostOnlyNet)
+	}
 
 	out, err := vb.manage("hostonlyif", "create")
 	if err != nil {
@@ -199,22 +223,120 @@ func (vb *VBox) CreateNet(net *Network) error {
 
 	re := regexp.MustCompile(`Interface '([^']+)' was successfully created`)
 	matches := re.FindStringSubmatch(out)
-	if len(matches) >= 2 {
-		net.Name = matches[1]
-	} else {
+	if len(matches) < 2 {
 		return fmt.Errorf("could not determine the interface name from vbox output: %s", out)
 	}
 
-	return err
+	prefix, ok := anySubnetPrefix(net.IPNet)
+	if !ok {
+		net.Name = matches[1]
+		return nil
+	}
+
+	// the interface, its subnet and the changes to net go again when setting them up fails
+	orig := *net
+	var origDHCP DHCPServer
+	if net.DHCP != nil {
+		origDHCP = *net.DHCP
+	}
+	allocated := false
+	undo := func(err error) error {
+		if _, rerr := vb.manage("hostonlyif", "remove", matches[1]); rerr != nil {
+			glog.Warningf("removing host-only interface %s failed: %v", matches[1], rerr)
+		}
+		if allocated {
+			if rerr := vb.ReleaseSubnet(hostOnlyOwner(matches[1])); rerr != nil {
+				glog.Warningf("releasing the subnet of %s failed: %v", matches[1], rerr)
+			}
+		}
+		*net = orig
+		if net.DHCP != nil {
+			*net.DHCP = origDHCP
+		}
+		return err
+	}
+
+	net.Name = matches[1]
+	a, created, err := vb.allocateSubnet(context.Background(), hostOnlyOwner(net.Name), prefix)
+	if err != nil {
+		return undo(err)
+	}
+	allocated = created
+	net.Mode, net.IPNet, net.IPMask = NWMode_hostonly, a.Gateway, a.Mask()
+	if net.DHCP != nil {
+		a.dhcp(net.DHCP)
+	}
+	if err := vb.ChangeNet(net); err != nil {
+		return undo(err)
+	}
+	return nil
+}
+
+// setUpHostOnlyNet adds or modifies the host-only network with apply, giving it a subnet out of the pools first
+// when it asks for AnySubnet. A subnet allocated here and the changes to net go again when apply fails
+func (vb *VBox) setUpHostOnlyNet(net *Network, apply func(*HostOnlyNet) error) error {
+	orig := *net
+	var origDHCP DHCPServer
+	if net.DHCP != nil {
+		origDHCP = *net.DHCP
+	}
+	allocated := false
+	undo := func(err error) error {
+		if allocated {
+			if rerr := vb.ReleaseSubnet(hostOnlyOwner(net.Name)); rerr != nil {
+				glog.Warningf("releasing the subnet of %s failed: %v", net.Name, rerr)
+			}
+		}
+		*net = orig
+		if net.DHCP != nil {
+			*net.DHCP = origDHCP
+		}
+		return err
+	}
+
+	var a *SubnetAllocation
+	if prefix, ok := anySubnetPrefix(net.IPNet); ok {
+		var created bool
+		var err error
+		if a, created, err = vb.allocateSubnet(context.Background(), hostOnlyOwner(net.Name), prefix); err != nil {
+			return err
+		}
+		allocated = created
+		net.IPNet, net.IPMask = a.Gateway, a.Mask()
+		if net.DHCP != nil {
+			a.dhcp(net.DHCP)
+		}
+	}
+
+	n, err := hostOnlyNetFor(*net)
+	if err != nil {
+		return undo(err)
+	}
+	// without a dhcp server the guests still get their addresses out of the range the allocation keeps for them
+	if a != nil && net.DHCP == nil {
+		n.LowerIP, n.UpperIP = a.DHCPLower, a.DHCPUpper
+	}
+	if err := apply(n); err != nil {
+		return undo(err)
+	}
+	return nil
 }
 
+// ChangeNet sets the addresses of the network, only host-only interfaces and networks are configured
 func (vb *VBox) ChangeNet(netCurr *Network) error {
 	switch netCurr.Mode {
+	case NWMode_hostonlynet:
+		return vb.setUpHostOnlyNet(netCurr, vb.ModifyHostOnlyNet)
 	case NWMode_hostonly:
-		_, err := vb.manage("hostonlyif", "ipconfig", "vboxnet0", "--ip", netCurr.IPNet, "--netmask", netCurr.IPMask)
+		cmds, err := hostOnlyIPConfigCommands(*netCurr, nil)
 		if err != nil {
 			return err
 		}
+		for _, args := range cmds {
+			if _, err := vb.manage(args...); err != nil {
+				return err
+			}
+		}
 	}
 
 	return nil
@@ -227,11 +349,24 @@ func (vb *VBox) DeleteNet(net *Network) error {
 		if err != nil && isHostDeviceNotFound(err.Error()) {
 			return NotFoundError(err.Error())
 		}
+		if err != nil {
+			return err
+		}
+		return vb.ReleaseSubnet(hostOnlyOwner(net.Name))
 	case NWMode_natnetwork:
 		_, err := vb.manage("natnetwork", "remove", "--netname", net.Name)
 		if err != nil && isHostDeviceNotFound(err.Error()) {
 			return NotFoundError(err.Error())
 		}
+		if err != nil {
+			return err
+		}
+		return vb.ReleaseSubnet(natNetOwner(net.Name))
+	case NWMode_hostonlynet:
+		if err := vb.RemoveHostOnlyNet(net.Name); err != nil {
+			return err
+		}
+		return vb.ReleaseSubnet(hostOnlyOwner(net.Name))
 	} //others are no op
 
 	return nil
@@ -244,10 +379,15 @@ func isHostDeviceNotFound(text string) bool {
 func (vb *VBox) AddNic(vm *VirtualMachine, nic *NIC) error {
 	args := []string{}
 	switch nic.Mode {
+	case NWMode_nat:
+		args = append(args, fmt.Sprintf("--nic%d", nic.Index), string(NWMode_nat))
+		args = append(args, natEngineArgs(nic.Index, nic.NATEngine)...)
 	case NWMode_bridged:
 		args = append(args, fmt.Sprintf("--nic %d", nic.Index), string(NWMode_bridged), fmt.Sprintf("--bridgeadapter%d", nic.Index), nic.NetworkName)
 	case NWMode_hostonly:
 		args = append(args, fmt.Sprintf("--nic%d", nic.Index), string(NWMode_hostonly), fmt.Sprintf("--hostonlyadapter%d", nic.Index), nic.NetworkName)
+	case NWMode_hostonlynet:
+		args = append(args, fmt.Sprintf("--nic%d", nic.Index), string(NWMode_hostonlynet), fmt.Sprintf("--host-only-net%d", nic.Index), nic.NetworkName)
 	case NWMode_intnet:
 		args = append(args, fmt.Sprintf("--nic%d", nic.Index), string(NWMode_intnet), fmt.Sprintf("--intnet%d", nic.Index), nic.NetworkName)
 	case NWMode_natnetwork:
@@ -255,6 +395,9 @@ func (vb *VBox) AddNic(vm *VirtualMachine, nic *NIC) error {
 	}
 
 	args = append(args, fmt.Sprintf("--nictype%d", nic.Index), string(nic.Type))
+	if nic.BandwidthGroup != "" {
+		args = append(args, fmt.Sprintf("--nicbandwidthgroup%d", nic.Index), nic.BandwidthGroup)
+	}
 
 	_, err := vb.modify(vm, args...)
 	return err
@@ -307,6 +450,8 @@ func (vb *VBox) getNetwork(nw string, mode NetworkMode) (*Network, error) {
 		return vb.BridgedNws[nw], nil
 	case NWMode_hostonly:
 		return vb.HostOnlyNws[nw], nil
+	case NWMode_hostonlynet:
+		return vb.HostOnlyNets[nw], nil
 	case NWMode_intnet:
 		return vb.InternalNws[nw], nil
 	case NWMode_natnetwork:
@@ -329,6 +474,11 @@ func (vb *VBox) getDefaultNetwork(mode NetworkMode) (*Network, error) {
 		for _, v := range vb.HostOnlyNws {
 			nws = append(nws, v)
 		}
+	case NWMode_hostonlynet:
+		nws = make([]*Network, 0, len(vb.HostOnlyNets))
+		for _, v := range vb.HostOnlyNets {
+			nws = append(nws, v)
+		}
 	case NWMode_intnet:
 		nws = make([]*Network, 0, len(vb.InternalNws))
 		for _, v := range vb.InternalNws {
@@ -351,7 +501,3 @@ func (vb *VBox) getDefaultNetwork(mode NetworkMode) (*Network, error) {
 
 	return nil, nil
 }
-
-func (vb *VBox) EnsureNets() error {
-	return nil
-}
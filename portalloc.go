@@ -0,0 +1,234 @@
+package virtualbox
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// portAllocationsFile is kept in the base path, next to the vms the ports were handed out to
+const portAllocationsFile = "natports.json"
+
+// portAllocation is a host port handed out to a port forward rule of a vm
+type portAllocation struct {
+	VM       string      `json:"vm"`
+	NicIndex int         `json:"nic"`
+	Rule     string      `json:"rule"`
+	Protocol NetProtocol `json:"protocol"`
+	HostPort int         `json:"hostPort"`
+}
+
+// portAllocationLock serializes the read, allocate and write cycles on the allocations file of this process, the
+// lock file of lockPortAllocations those of other processes
+var portAllocationLock sync.Mutex
+
+func (vb *VBox) lockPortAllocations() (func(), error) {
+	portAllocationLock.Lock()
+	unlock, err := vb.lockStateFile(portAllocationsFile)
+	if err != nil {
+		portAllocationLock.Unlock()
+		return nil, err
+	}
+	return func() {
+		unlock()
+		portAllocationLock.Unlock()
+	}, nil
+}
+
+func portKey(protocol NetProtocol, port int) string {
+	if protocol == "" {
+		protocol = TCP
+	}
+	return fmt.Sprintf("%s/%d", protocol, port)
+}
+
+// hostPortFree tells whether nothing listens on the port of the host, by binding it for a moment
+func hostPortFree(protocol NetProtocol, ip string, port int) bool {
+	addr := net.JoinHostPort(ip, strconv.Itoa(port))
+	if protocol == UDP {
+		c, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return false
+		}
+		c.Close()
+		return true
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return false
+	}
+	l.Close()
+	return true
+}
+
+// allocatePorts fills in the host port of the rules of the vm that have none. A rule keeps the port it was given
+// before unless another vm took it meanwhile, otherwise it gets the first port from NatPortBase on that is neither
+// taken by a VirtualBox forward or allocation nor bound on the host. It returns the rules and the allocations
+// to persist
+func allocatePorts(vm string, rules []PortForwarding, allocations []portAllocation, taken map[string]bool,
+	free func(NetProtocol, string, int) bool) ([]PortForwarding, []portAllocation, error) {
+
+	requested := map[string]bool{}
+	for _, r := range rules {
+		requested[ruleKey(r)] = true
+		if r.HostPort != 0 {
+			taken[portKey(r.Protocol, r.HostPort)] = true
+		}
+	}
+
+	previous := map[string]int{}
+	var kept []portAllocation
+	for _, a := range allocations {
+		key := ruleKey(PortForwarding{NicIndex: a.NicIndex, Name: a.Rule})
+		if a.VM == vm && requested[key] {
+			previous[key] = a.HostPort
+			continue
+		}
+		taken[portKey(a.Protocol, a.HostPort)] = true
+		kept = append(kept, a)
+	}
+
+	result := make([]PortForwarding, len(rules))
+	for i, r := range rules {
+		result[i] = r
+		if r.HostPort != 0 {
+			continue
+		}
+
+		if port, ok := previous[ruleKey(r)]; ok && !taken[portKey(r.Protocol, port)] {
+			r.HostPort = port
+		}
+		for port := NatPortBase; r.HostPort == 0 && port <= 65535; port++ {
+			if !taken[portKey(r.Protocol, port)] && free(r.Protocol, r.HostIP, port) {
+				r.HostPort = port
+			}
+		}
+		if r.HostPort == 0 {
+			return nil, nil, fmt.Errorf("no free host port left from %d for rule %s of nic %d", NatPortBase, r.Name, r.NicIndex)
+		}
+
+		taken[portKey(r.Protocol, r.HostPort)] = true
+		result[i] = r
+		kept = append(kept, portAllocation{VM: vm, NicIndex: r.NicIndex, Rule: r.Name, Protocol: r.Protocol, HostPort: r.HostPort})
+	}
+	return result, kept, nil
+}
+
+func (vb *VBox) readPortAllocations() ([]portAllocation, error) {
+	var allocations []portAllocation
+	if err := vb.readStateFile(portAllocationsFile, &allocations); err != nil {
+		return nil, err
+	}
+	return allocations, nil
+}
+
+func (vb *VBox) writePortAllocations(allocations []portAllocation) error {
+	return vb.writeStateFile(portAllocationsFile, allocations)
+}
+
+// forwardedPorts returns the host ports forwarded by the nat networks and by the nics of every vm but the one named
+func (vb *VBox) forwardedPorts(ctx context.Context, except string) (map[string]bool, error) {
+	forwards, err := vb.hostForwards(ctx, vmOwner(except))
+	if err != nil {
+		return nil, err
+	}
+
+	taken := map[string]bool{}
+	for _, f := range forwards {
+		taken[portKey(f.Rule.Protocol, f.Rule.HostPort)] = true
+	}
+	return taken, nil
+}
+
+// takeOtherRules marks the host ports of the current forwards of the nics that are not among the rules as taken
+func takeOtherRules(taken map[string]bool, nics []NIC, rules []PortForwarding) {
+	requested := map[string]bool{}
+	for _, r := range rules {
+		requested[ruleKey(r)] = true
+	}
+	for _, nic := range nics {
+		for _, r := range nic.PortForwarding {
+			if !requested[ruleKey(r)] {
+				taken[portKey(r.Protocol, r.HostPort)] = true
+			}
+		}
+	}
+}
+
+// AllocateHostPorts returns the rules with a host port filled in for those that have none. Ports are handed out
+// from NatPortBase on, skipping the ones forwarded by nat networks, other vms and the other rules of the vm or bound
+// on the host, and are remembered in the base path so a rule gets the same port again the next time. A lock file
+// next to them keeps other processes from handing out the same ports meanwhile. ReleaseHostPorts gives them back
+func (vb *VBox) AllocateHostPorts(ctx context.Context, vm *VirtualMachine, rules []PortForwarding) ([]PortForwarding, error) {
+	auto := false
+	for _, r := range rules {
+		auto = auto || r.HostPort == 0
+	}
+	if !auto {
+		return rules, nil
+	}
+
+	name := vm.Spec.Name
+	if name == "" {
+		machine, err := vb.VMInfo(vm.UUIDOrName())
+		if err != nil {
+			return nil, err
+		}
+		name = machine.Spec.Name
+	}
+
+	unlock, err := vb.lockPortAllocations()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	taken, err := vb.forwardedPorts(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	// the vm keeps the forwards it has that are not among the rules
+	if machine, err := vb.VMInfo(name); err == nil {
+		takeOtherRules(taken, machine.Spec.NICs, rules)
+	}
+	allocations, err := vb.readPortAllocations()
+	if err != nil {
+		return nil, err
+	}
+
+	result, allocations, err := allocatePorts(name, rules, allocations, taken, hostPortFree)
+	if err != nil {
+		return nil, err
+	}
+	if err := vb.writePortAllocations(allocations); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ReleaseHostPorts forgets the host ports allocated to the rules of the vm, DeleteVM calls it
+func (vb *VBox) ReleaseHostPorts(vm *VirtualMachine) error {
+	unlock, err := vb.lockPortAllocations()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	allocations, err := vb.readPortAllocations()
+	if err != nil || allocations == nil {
+		return err
+	}
+
+	var kept []portAllocation
+	for _, a := range allocations {
+		if a.VM != vm.Spec.Name {
+			kept = append(kept, a)
+		}
+	}
+	if len(kept) == len(allocations) {
+		return nil
+	}
+	return vb.writePortAllocations(kept)
+}
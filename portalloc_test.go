@@ -0,0 +1,150 @@
+package virtualbox
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAllocatePorts(t *testing.T) {
+	allocations := []portAllocation{
+		{VM: "vm1", NicIndex: 1, Rule: "ssh", Protocol: TCP, HostPort: NatPortBase + 5},
+		{VM: "vm2", NicIndex: 1, Rule: "ssh", Protocol: TCP, HostPort: NatPortBase},
+		{VM: "vm1", NicIndex: 1, Rule: "web", Protocol: TCP, HostPort: NatPortBase + 6},
+	}
+	taken := map[string]bool{portKey(TCP, NatPortBase+1): true}
+	bound := map[int]bool{NatPortBase + 2: true}
+	free := func(protocol NetProtocol, ip string, port int) bool { return !bound[port] }
+
+	rules := []PortForwarding{
+		{NicIndex: 1, Name: "ssh", Protocol: TCP, GuestPort: 22},
+		{NicIndex: 1, Name: "rdp", Protocol: TCP, GuestPort: 3389},
+		{NicIndex: 2, Name: "dns", Protocol: UDP, GuestPort: 53},
+		{NicIndex: 2, Name: "fixed", Protocol: TCP, HostPort: NatPortBase + 3, GuestPort: 8080},
+	}
+	result, kept, err := allocatePorts("vm1", rules, allocations, taken, free)
+	if err != nil {
+		t.Fatalf("allocation failed %v", err)
+	}
+
+	// ssh keeps its port, rdp skips the ports of vm2, VirtualBox, the host and the fixed rule
+	for i, expected := range []int{NatPortBase + 5, NatPortBase + 4, NatPortBase} {
+		if result[i].HostPort != expected {
+			t.Errorf("expected rule %s to get %d, got %d", result[i].Name, expected, result[i].HostPort)
+		}
+	}
+	if result[3].HostPort != NatPortBase+3 {
+		t.Errorf("expected fixed port to be kept, got %d", result[3].HostPort)
+	}
+
+	expected := []portAllocation{
+		{VM: "vm2", NicIndex: 1, Rule: "ssh", Protocol: TCP, HostPort: NatPortBase},
+		{VM: "vm1", NicIndex: 1, Rule: "web", Protocol: TCP, HostPort: NatPortBase + 6},
+		{VM: "vm1", NicIndex: 1, Rule: "ssh", Protocol: TCP, HostPort: NatPortBase + 5},
+		{VM: "vm1", NicIndex: 1, Rule: "rdp", Protocol: TCP, HostPort: NatPortBase + 4},
+		{VM: "vm1", NicIndex: 2, Rule: "dns", Protocol: UDP, HostPort: NatPortBase},
+	}
+	if !reflect.DeepEqual(kept, expected) {
+		t.Errorf("expected allocations %+v, got %+v", expected, kept)
+	}
+}
+
+func TestAllocatePortsTakenMeanwhile(t *testing.T) {
+	allocations := []portAllocation{{VM: "vm1", NicIndex: 1, Rule: "ssh", Protocol: TCP, HostPort: NatPortBase}}
+	taken := map[string]bool{portKey(TCP, NatPortBase): true}
+
+	result, _, err := allocatePorts("vm1", []PortForwarding{{NicIndex: 1, Name: "ssh", Protocol: TCP}}, allocations, taken,
+		func(NetProtocol, string, int) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result[0].HostPort != NatPortBase+1 {
+		t.Errorf("expected a new port once the old one was taken, got %d", result[0].HostPort)
+	}
+}
+
+func TestPortAllocationsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "natports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	vb := NewVBox(Config{BasePath: dir})
+	if allocations, err := vb.readPortAllocations(); err != nil || allocations != nil {
+		t.Errorf("expected no allocations without a file, got %v %v", allocations, err)
+	}
+
+	allocations := []portAllocation{
+		{VM: "vm1", NicIndex: 1, Rule: "ssh", Protocol: TCP, HostPort: NatPortBase},
+		{VM: "vm2", NicIndex: 1, Rule: "ssh", Protocol: TCP, HostPort: NatPortBase + 1},
+	}
+	if err := vb.writePortAllocations(allocations); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vb.ReleaseHostPorts(&VirtualMachine{Spec: VirtualMachineSpec{Name: "vm1"}}); err != nil {
+		t.Fatal(err)
+	}
+	read, err := vb.readPortAllocations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read, allocations[1:]) {
+		t.Errorf("expected %+v after release, got %+v", allocations[1:], read)
+	}
+}
+
+func TestAllocatePortsKeepsOtherRules(t *testing.T) {
+	nics := []NIC{{Index: 1, PortForwarding: []PortForwarding{
+		{NicIndex: 1, Name: "http", Protocol: TCP, HostPort: NatPortBase},
+		{NicIndex: 1, Name: "ssh", Protocol: TCP, HostPort: NatPortBase + 1},
+	}}}
+	rules := []PortForwarding{{NicIndex: 1, Name: "ssh", Protocol: TCP}, {NicIndex: 1, Name: "dns", Protocol: TCP}}
+
+	taken := map[string]bool{}
+	takeOtherRules(taken, nics, rules)
+	result, _, err := allocatePorts("vm1", rules, nil, taken, func(NetProtocol, string, int) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result[0].HostPort != NatPortBase+1 || result[1].HostPort != NatPortBase+2 {
+		t.Errorf("expected the port of the http rule of the vm to stay taken, got %+v", result)
+	}
+}
+
+func TestLockStateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "natports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	vb := NewVBox(Config{BasePath: dir})
+	unlock, err := vb.lockStateFile(portAllocationsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	locked := make(chan struct{})
+	go func() {
+		if unlock, err := vb.lockStateFile(portAllocationsFile); err == nil {
+			unlock()
+		}
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+		t.Fatal("expected the second lock to wait for the first one")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("expected the second lock once the first one was released")
+	}
+}
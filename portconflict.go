@@ -0,0 +1,306 @@
+package virtualbox
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// hostForward is a port forward rule as found on the host, Owner names the vm or nat network holding it
+type hostForward struct {
+	Owner string
+	Path  string
+	Rule  PortForwarding
+}
+
+func vmOwner(name string) string {
+	return "vm/" + name
+}
+
+func natNetOwner(name string) string {
+	return "natnetwork/" + name
+}
+
+func vmForwards(name string, nics []NIC) []hostForward {
+	var forwards []hostForward
+	for _, nic := range nics {
+		for _, r := range nic.PortForwarding {
+			forwards = append(forwards, hostForward{
+				Owner: vmOwner(name),
+				Path:  fmt.Sprintf("%s/nic/%d/portforwarding/%s", vmOwner(name), nic.Index, r.Name),
+				Rule:  r,
+			})
+		}
+	}
+	return forwards
+}
+
+func natNetForwards(nat NatNetwork) []hostForward {
+	var forwards []hostForward
+	for _, rules := range []struct {
+		path  string
+		rules []PortForwarding
+	}{
+		{"portforward4", nat.PortForward4},
+		{"portforward6", nat.PortForward6},
+	} {
+		for _, r := range rules.rules {
+			forwards = append(forwards, hostForward{
+				Owner: natNetOwner(nat.NetName),
+				Path:  fmt.Sprintf("%s/%s/%s", natNetOwner(nat.NetName), rules.path, r.Name),
+				Rule:  r,
+			})
+		}
+	}
+	return forwards
+}
+
+// hostForwards returns the port forwards of every vm and nat network of the host, except for the owner given
+func (vb *VBox) hostForwards(ctx context.Context, except string) ([]hostForward, error) {
+	var forwards []hostForward
+
+	vms, err := vb.listVMs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for uuid, name := range vms {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if vmOwner(name) == except {
+			continue
+		}
+		machine, err := vb.VMInfo(uuid)
+		if err != nil {
+			// vms that vanished in between hold no ports
+			continue
+		}
+		forwards = append(forwards, vmForwards(name, machine.Spec.NICs)...)
+	}
+
+	nats, err := vb.ListNatNets()
+	if err != nil {
+		return nil, err
+	}
+	for _, nat := range nats {
+		if natNetOwner(nat.NetName) != except {
+			forwards = append(forwards, natNetForwards(nat)...)
+		}
+	}
+	return forwards, nil
+}
+
+// wildcardIP tells whether the host ip listens on every address, the empty one of either family
+func wildcardIP(ip string) bool {
+	if ip == "" {
+		return true
+	}
+	parsed := net.ParseIP(ip)
+	return parsed != nil && parsed.IsUnspecified()
+}
+
+func ipFamily(ip string) string {
+	parsed := net.ParseIP(ip)
+	switch {
+	case ip == "" || parsed == nil:
+		return ""
+	case parsed.To4() != nil:
+		return "ipv4"
+	}
+	return "ipv6"
+}
+
+func sameIP(a, b string) bool {
+	if a == "" || b == "" {
+		return a == b
+	}
+	pa, pb := net.ParseIP(a), net.ParseIP(b)
+	if pa == nil || pb == nil {
+		return a == b
+	}
+	return pa.Equal(pb)
+}
+
+// overlap tells how two rules on the same protocol and host port collide: duplicate when they listen on the same
+// address, shadowed when one listens on every address of the family of the other
+func overlap(a, b PortForwarding) string {
+	protocol := func(p NetProtocol) NetProtocol {
+		if p == "" {
+			return TCP
+		}
+		return p
+	}
+	if protocol(a.Protocol) != protocol(b.Protocol) || a.HostPort != b.HostPort || a.HostPort == 0 {
+		return ""
+	}
+	if sameIP(a.HostIP, b.HostIP) {
+		return "duplicate"
+	}
+	fa, fb := ipFamily(a.HostIP), ipFamily(b.HostIP)
+	if (wildcardIP(a.HostIP) || wildcardIP(b.HostIP)) && (fa == "" || fb == "" || fa == fb) {
+		return "shadowed"
+	}
+	return ""
+}
+
+func validRuleName(name string) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("rule has no name")
+	case strings.ContainsAny(name, ",:[]\"\n"):
+		return fmt.Errorf("rule name %q may not contain any of , : [ ] or quotes", name)
+	}
+	return nil
+}
+
+func validPort(what string, port int, allowZero bool) error {
+	if (port == 0 && allowZero) || (port > 0 && port <= 65535) {
+		return nil
+	}
+	return fmt.Errorf("%s port %d is out of range", what, port)
+}
+
+// checkPortForwards validates the proposed rules against each other and against the existing ones. Rules without
+// a host port are left to AllocateHostPorts. With free set, proposed ports no existing rule forwards must not be
+// bound on the host either
+func checkPortForwards(proposed, existing []hostForward, free func(NetProtocol, string, int) bool) ValidationErrors {
+	verrs := ValidationErrors{}
+
+	names := map[string]bool{}
+	for _, f := range proposed {
+		if err := validRuleName(f.Rule.Name); err != nil {
+			verrs.Add(f.Path, err)
+		}
+		// names are unique per nic or nat network, which is what the path up to the name tells apart
+		scope := strings.TrimSuffix(f.Path, f.Rule.Name)
+		if names[scope+"\x00"+f.Rule.Name] {
+			verrs.Add(f.Path, fmt.Errorf("rule name %s is used more than once", f.Rule.Name))
+		}
+		names[scope+"\x00"+f.Rule.Name] = true
+
+		if err := validPort("host", f.Rule.HostPort, true); err != nil {
+			verrs.Add(f.Path, err)
+		}
+		if err := validPort("guest", f.Rule.GuestPort, false); err != nil {
+			verrs.Add(f.Path, err)
+		}
+	}
+
+	for i, f := range proposed {
+		forwarded := false
+		for _, other := range proposed[:i] {
+			if kind := overlap(f.Rule, other.Rule); kind != "" {
+				verrs.Add(f.Path, fmt.Errorf("%s %s:%d/%s of %s", kind, f.Rule.HostIP, f.Rule.HostPort, f.Rule.Protocol, other.Path))
+			}
+		}
+		for _, other := range existing {
+			if kind := overlap(f.Rule, other.Rule); kind != "" {
+				forwarded = true
+				verrs.Add(f.Path, fmt.Errorf("%s %s:%d/%s of %s", kind, f.Rule.HostIP, f.Rule.HostPort, f.Rule.Protocol, other.Path))
+			}
+		}
+
+		if free != nil && !forwarded && f.Rule.HostPort != 0 && !free(f.Rule.Protocol, f.Rule.HostIP, f.Rule.HostPort) {
+			verrs.Add(f.Path, fmt.Errorf("host port %s:%d/%s is already bound by another process", f.Rule.HostIP, f.Rule.HostPort, f.Rule.Protocol))
+		}
+	}
+	return verrs
+}
+
+func validationResult(verrs ValidationErrors) error {
+	if len(verrs.Errors()) == 0 {
+		return nil
+	}
+	return verrs
+}
+
+// CheckPortForwards reports the port forwards of the vms and nat networks of the host that collide with each
+// other or have invalid names or ports, as ValidationErrors. Ports are not probed on the host, since running vms
+// bind their own
+func (vb *VBox) CheckPortForwards(ctx context.Context) error {
+	forwards, err := vb.hostForwards(ctx, "")
+	if err != nil {
+		return err
+	}
+	return validationResult(checkPortForwards(forwards, nil, nil))
+}
+
+// splitForwards separates the forwards of the owner from those of everyone else
+func splitForwards(forwards []hostForward, owner string) (own, others []hostForward) {
+	for _, f := range forwards {
+		if f.Owner == owner {
+			own = append(own, f)
+		} else {
+			others = append(others, f)
+		}
+	}
+	return own, others
+}
+
+// probeExcept wraps free so that the ports the owner forwards already count as free, when it is running the owner
+// binds them itself
+func probeExcept(free func(NetProtocol, string, int) bool, own []hostForward) func(NetProtocol, string, int) bool {
+	return func(protocol NetProtocol, ip string, port int) bool {
+		for _, f := range own {
+			if overlap(PortForwarding{Protocol: protocol, HostIP: ip, HostPort: port}, f.Rule) != "" {
+				return true
+			}
+		}
+		return free(protocol, ip, port)
+	}
+}
+
+// sameForwards tells whether both lists hold the same rules under the same paths
+func sameForwards(a, b []hostForward) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	rules := map[string]PortForwarding{}
+	for _, f := range a {
+		rules[f.Path] = f.Rule
+	}
+	for _, f := range b {
+		if r, ok := rules[f.Path]; !ok || !sameRule(r, f.Rule) {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidateVMPortForwards checks the port forwards of the nics of the vm spec against those of the other vms and
+// nat networks and the ports bound on the host. Its own registered rules are left out, they get replaced, and
+// their ports are not probed. A vm that already has exactly the rules of the spec is not checked again, which
+// saves Define going through every vm of the host each time
+func (vb *VBox) ValidateVMPortForwards(ctx context.Context, vm *VirtualMachine) error {
+	proposed := vmForwards(vm.Spec.Name, vm.Spec.NICs)
+	if len(proposed) == 0 {
+		return nil
+	}
+	if machine, err := vb.VMInfo(vm.UUIDOrName()); err == nil && sameForwards(proposed, vmForwards(vm.Spec.Name, machine.Spec.NICs)) {
+		return nil
+	}
+
+	forwards, err := vb.hostForwards(ctx, "")
+	if err != nil {
+		return err
+	}
+	own, existing := splitForwards(forwards, vmOwner(vm.Spec.Name))
+	return validationResult(checkPortForwards(proposed, existing, probeExcept(hostPortFree, own)))
+}
+
+// ValidateNatNetPortForwards checks the port forwards of the nat network against those of the vms and other nat
+// networks and the ports bound on the host, except for those the nat network forwards already
+func (vb *VBox) ValidateNatNetPortForwards(ctx context.Context, nat *NatNetwork) error {
+	proposed := natNetForwards(*nat)
+	if len(proposed) == 0 {
+		return nil
+	}
+
+	forwards, err := vb.hostForwards(ctx, "")
+	if err != nil {
+		return err
+	}
+	own, existing := splitForwards(forwards, natNetOwner(nat.NetName))
+	return validationResult(checkPortForwards(proposed, existing, probeExcept(hostPortFree, own)))
+}
@@ -0,0 +1,115 @@
+package virtualbox
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestOverlap(t *testing.T) {
+	for _, c := range []struct {
+		a, b     PortForwarding
+		expected string
+	}{
+		{PortForwarding{Protocol: TCP, HostPort: 2222}, PortForwarding{Protocol: TCP, HostPort: 2222}, "duplicate"},
+		{PortForwarding{Protocol: TCP, HostPort: 2222}, PortForwarding{Protocol: UDP, HostPort: 2222}, ""},
+		{PortForwarding{Protocol: TCP, HostIP: "127.0.0.1", HostPort: 2222}, PortForwarding{Protocol: TCP, HostIP: "127.0.0.1", HostPort: 2222}, "duplicate"},
+		{PortForwarding{Protocol: TCP, HostIP: "127.0.0.1", HostPort: 2222}, PortForwarding{Protocol: TCP, HostIP: "127.0.0.2", HostPort: 2222}, ""},
+		{PortForwarding{Protocol: TCP, HostIP: "0.0.0.0", HostPort: 2222}, PortForwarding{Protocol: TCP, HostIP: "127.0.0.1", HostPort: 2222}, "shadowed"},
+		{PortForwarding{Protocol: TCP, HostPort: 2222}, PortForwarding{Protocol: TCP, HostIP: "::1", HostPort: 2222}, "shadowed"},
+		{PortForwarding{Protocol: TCP, HostIP: "::", HostPort: 2222}, PortForwarding{Protocol: TCP, HostIP: "127.0.0.1", HostPort: 2222}, ""},
+		{PortForwarding{Protocol: TCP}, PortForwarding{Protocol: TCP}, ""},
+	} {
+		if kind := overlap(c.a, c.b); kind != c.expected {
+			t.Errorf("expected %+v and %+v to be %q, got %q", c.a, c.b, c.expected, kind)
+		}
+	}
+}
+
+func TestCheckPortForwards(t *testing.T) {
+	existing := append(vmForwards("vm2", []NIC{{Index: 1, PortForwarding: []PortForwarding{
+		{Name: "ssh", Protocol: TCP, HostPort: 2222, GuestPort: 22},
+	}}}), natNetForwards(NatNetwork{NetName: "natnet1", PortForward4: []PortForwarding{
+		{Name: "web", Protocol: TCP, HostIP: "0.0.0.0", HostPort: 8080, GuestIP: "10.0.2.15", GuestPort: 80},
+	}})...)
+
+	proposed := vmForwards("vm1", []NIC{
+		{Index: 1, PortForwarding: []PortForwarding{
+			{Name: "ssh", Protocol: TCP, HostPort: 2222, GuestPort: 22},
+			{Name: "web", Protocol: TCP, HostIP: "127.0.0.1", HostPort: 8080, GuestPort: 80},
+			{Name: "bad,name", Protocol: TCP, HostPort: 9000, GuestPort: 90},
+			{Name: "ssh", Protocol: TCP, HostPort: 70000, GuestPort: 22},
+		}},
+		{Index: 2, PortForwarding: []PortForwarding{
+			{Name: "ssh", Protocol: TCP, GuestPort: 22},
+			{Name: "dns", Protocol: UDP, HostPort: 5353, GuestPort: 53},
+			{Name: "metrics", Protocol: TCP, HostPort: 9100, GuestPort: 9100},
+		}},
+	})
+
+	bound := map[int]bool{5353: true, 2222: true}
+	verrs := checkPortForwards(proposed, existing, func(protocol NetProtocol, ip string, port int) bool { return !bound[port] })
+
+	expected := []string{
+		"vm/vm1/nic/1/portforwarding/bad,name: rule name",
+		"vm/vm1/nic/1/portforwarding/ssh: rule name ssh is used more than once",
+		"vm/vm1/nic/1/portforwarding/ssh: host port 70000 is out of range",
+		"vm/vm1/nic/1/portforwarding/ssh: duplicate :2222/tcp of vm/vm2/nic/1/portforwarding/ssh",
+		"vm/vm1/nic/1/portforwarding/web: shadowed 127.0.0.1:8080/tcp of natnetwork/natnet1/portforward4/web",
+		"vm/vm1/nic/2/portforwarding/dns: host port :5353/udp is already bound by another process",
+	}
+	errs := verrs.Errors()
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %d errors, got %d:\n%v", len(expected), len(errs), verrs)
+	}
+	for i, e := range expected {
+		if !strings.HasPrefix(errs[i].Error(), e) {
+			t.Errorf("expected error %d to start with %q, got %q", i, e, errs[i].Error())
+		}
+	}
+
+	if err := validationResult(checkPortForwards(existing, nil, nil)); err != nil {
+		t.Errorf("expected no conflicts, got %v", err)
+	}
+}
+
+func TestValidateVMPortForwardsOwnPorts(t *testing.T) {
+	// the running vm binds the port of its ssh rule
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+
+	info := strings.Replace(showVmInfoOutput, "tcpWndRcv=\"64\"\n",
+		fmt.Sprintf("tcpWndRcv=\"64\"\nForwarding(0)=\"ssh,tcp,127.0.0.1,%d,,22\"\n", port), 1)
+	var commands []string
+	vb := &VBox{run: func(ctx context.Context, args ...string) (string, error) {
+		commands = append(commands, args[0]+" "+args[1])
+		switch {
+		case args[0] == "showvminfo":
+			return info, nil
+		case args[0] == "list":
+			return "\"testvm1\" {6aa44e71-71c6-4e68-a61f-f69e133ecffa}\n", nil
+		}
+		return "", nil
+	}}
+
+	ssh := PortForwarding{Name: "ssh", Protocol: TCP, HostIP: "127.0.0.1", HostPort: port, GuestPort: 22}
+	vm := &VirtualMachine{Spec: VirtualMachineSpec{Name: "testvm1", NICs: []NIC{{Index: 1, PortForwarding: []PortForwarding{ssh}}}}}
+	if err := vb.ValidateVMPortForwards(context.Background(), vm); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(strings.Join(commands, ","), "list") {
+		t.Errorf("expected unchanged rules to skip the host wide scan, got %v", commands)
+	}
+
+	web := PortForwarding{Name: "web", Protocol: TCP, HostIP: "127.0.0.1", HostPort: port + 1, GuestPort: 80}
+	vm.Spec.NICs[0].PortForwarding = []PortForwarding{ssh, web}
+	if err := vb.ValidateVMPortForwards(context.Background(), vm); err != nil && strings.Contains(err.Error(), "/ssh:") {
+		t.Errorf("expected the port of the own ssh rule not to be probed, got %v", err)
+	}
+}
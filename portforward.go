@@ -0,0 +1,124 @@
+package virtualbox
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// ruleArg formats the rule the way --natpf and natpf expect it: name,protocol,hostip,hostport,guestip,guestport
+func ruleArg(rule PortForwarding) string {
+	return fmt.Sprintf("%v,%v,%v,%v,%v,%v", rule.Name, string(rule.Protocol), rule.HostIP, rule.HostPort, rule.GuestIP, rule.GuestPort)
+}
+
+// natpfCommands returns the VBoxManage invocations removing and adding the rules. A running vm takes one
+// controlvm natpf call per rule, a powered off one a single modifyvm. Removals go first, so that a changed rule
+// can be put back under the same name
+func natpfCommands(vm *VirtualMachine, running bool, add, remove []PortForwarding) [][]string {
+	if len(add) == 0 && len(remove) == 0 {
+		return nil
+	}
+
+	if running {
+		var cmds [][]string
+		for _, rule := range remove {
+			cmds = append(cmds, []string{"controlvm", vm.UUIDOrName(), fmt.Sprintf("natpf%d", rule.NicIndex), "delete", rule.Name})
+		}
+		for _, rule := range add {
+			cmds = append(cmds, []string{"controlvm", vm.UUIDOrName(), fmt.Sprintf("natpf%d", rule.NicIndex), ruleArg(rule)})
+		}
+		return cmds
+	}
+
+	args := []string{"modifyvm", vm.UUIDOrName()}
+	for _, rule := range remove {
+		args = append(args, fmt.Sprintf("--natpf%d", rule.NicIndex), "delete", rule.Name)
+	}
+	for _, rule := range add {
+		args = append(args, fmt.Sprintf("--natpf%d", rule.NicIndex), ruleArg(rule))
+	}
+	return [][]string{args}
+}
+
+// changePortForwards removes and adds the rules with controlvm while the vm runs and with modifyvm otherwise.
+// Rules to add without a host port get one from AllocateHostPorts
+func (vb *VBox) changePortForwards(ctx context.Context, vm *VirtualMachine, add, remove []PortForwarding) error {
+	state, err := vb.State(vm)
+	if err != nil {
+		return err
+	}
+
+	add, err = vb.AllocateHostPorts(ctx, vm, add)
+	if err != nil {
+		return err
+	}
+
+	for _, args := range natpfCommands(vm, isRunning(state), add, remove) {
+		if _, err := vb.manageWithContext(ctx, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func ruleKey(rule PortForwarding) string {
+	return fmt.Sprintf("%d/%s", rule.NicIndex, rule.Name)
+}
+
+func sameRule(a, b PortForwarding) bool {
+	return a.Protocol == b.Protocol && a.HostIP == b.HostIP && a.HostPort == b.HostPort &&
+		a.GuestIP == b.GuestIP && a.GuestPort == b.GuestPort
+}
+
+// diffPortForwards returns the rules to add and remove to get from current to desired. Rules are matched by nic
+// and name, a rule changed in any other way is removed and added again
+func diffPortForwards(current, desired []PortForwarding) (add, remove []PortForwarding) {
+	have := map[string]PortForwarding{}
+	for _, rule := range current {
+		have[ruleKey(rule)] = rule
+	}
+	want := map[string]bool{}
+	for _, rule := range desired {
+		want[ruleKey(rule)] = true
+		c, ok := have[ruleKey(rule)]
+		if ok && sameRule(c, rule) {
+			continue
+		}
+		if ok {
+			remove = append(remove, c)
+		}
+		add = append(add, rule)
+	}
+	for _, rule := range current {
+		if !want[ruleKey(rule)] {
+			remove = append(remove, rule)
+		}
+	}
+
+	sort.SliceStable(remove, func(i, j int) bool { return ruleKey(remove[i]) < ruleKey(remove[j]) })
+	return add, remove
+}
+
+// SyncPortForwards makes the port forwards of the nat nics of the vm match desired, which holds the rules of all
+// its nics. Only the rules that changed are touched, so connections through the others survive on a running vm.
+// Rules without a host port keep the one allocated to them before
+func (vb *VBox) SyncPortForwards(ctx context.Context, vm *VirtualMachine, desired []PortForwarding) error {
+	machine, err := vb.VMInfo(vm.UUIDOrName())
+	if err != nil {
+		return err
+	}
+
+	var current []PortForwarding
+	for _, nic := range machine.Spec.NICs {
+		current = append(current, nic.PortForwarding...)
+	}
+
+	// rules left to allocation compare by the port they were given
+	desired, err = vb.AllocateHostPorts(ctx, machine, desired)
+	if err != nil {
+		return err
+	}
+
+	add, remove := diffPortForwards(current, desired)
+	return vb.changePortForwards(ctx, machine, add, remove)
+}
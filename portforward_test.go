@@ -0,0 +1,82 @@
+package virtualbox
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestNatpfCommands(t *testing.T) {
+	vm := &VirtualMachine{UUID: "6aa44e71-71c6-4e68-a61f-f69e133ecffa"}
+	ssh := PortForwarding{NicIndex: 1, Name: "ssh", Protocol: TCP, HostPort: 2222, GuestPort: 22}
+	web := PortForwarding{NicIndex: 2, Name: "web", Protocol: TCP, HostIP: "127.0.0.1", HostPort: 8080, GuestPort: 80}
+
+	expected := [][]string{
+		{"controlvm", vm.UUID, "natpf2", "delete", "web"},
+		{"controlvm", vm.UUID, "natpf1", "ssh,tcp,,2222,,22"},
+	}
+	if cmds := natpfCommands(vm, true, []PortForwarding{ssh}, []PortForwarding{web}); !reflect.DeepEqual(cmds, expected) {
+		t.Errorf("expected %v, got %v", expected, cmds)
+	}
+
+	expected = [][]string{
+		{"modifyvm", vm.UUID, "--natpf2", "delete", "web", "--natpf1", "ssh,tcp,,2222,,22", "--natpf2", "web,tcp,127.0.0.1,8080,,80"},
+	}
+	if cmds := natpfCommands(vm, false, []PortForwarding{ssh, web}, []PortForwarding{web}); !reflect.DeepEqual(cmds, expected) {
+		t.Errorf("expected %v, got %v", expected, cmds)
+	}
+
+	if cmds := natpfCommands(vm, false, nil, nil); cmds != nil {
+		t.Errorf("expected nothing to run, got %v", cmds)
+	}
+}
+
+func TestDiffPortForwards(t *testing.T) {
+	ssh := PortForwarding{Index: 0, NicIndex: 1, Name: "ssh", Protocol: TCP, HostPort: 2222, GuestPort: 22}
+	web := PortForwarding{Index: 1, NicIndex: 1, Name: "web", Protocol: TCP, HostPort: 8080, GuestPort: 80}
+	dns := PortForwarding{Index: 2, NicIndex: 1, Name: "dns", Protocol: UDP, HostPort: 5353, GuestPort: 53}
+
+	movedWeb := web
+	movedWeb.HostPort = 8081
+	movedWeb.Index = 0
+	metrics := PortForwarding{NicIndex: 2, Name: "metrics", Protocol: TCP, HostPort: 9100, GuestPort: 9100}
+
+	add, remove := diffPortForwards([]PortForwarding{ssh, web, dns}, []PortForwarding{ssh, movedWeb, metrics})
+	if expected := []PortForwarding{movedWeb, metrics}; !reflect.DeepEqual(add, expected) {
+		t.Errorf("expected to add %+v, got %+v", expected, add)
+	}
+	if expected := []PortForwarding{dns, web}; !reflect.DeepEqual(remove, expected) {
+		t.Errorf("expected to remove %+v, got %+v", expected, remove)
+	}
+
+	if add, remove := diffPortForwards([]PortForwarding{ssh}, []PortForwarding{ssh}); add != nil || remove != nil {
+		t.Errorf("expected no changes, got %+v %+v", add, remove)
+	}
+}
+
+func TestVMInfoGetRulesByNICIndex(t *testing.T) {
+	out := `name="vm01"
+nic1="none"
+nic2="nat"
+nictype2="82540EM"
+Forwarding(0)="ssh,tcp,,2222,,22"
+Forwarding(1)="dns,udp,127.0.0.1,5353,,53"
+nic3="nat"
+Forwarding(0)="http,tcp,,8080,,80"
+nic4="none"
+`
+	vb := &VBox{run: func(ctx context.Context, args ...string) (string, error) { return out, nil }}
+	vm := &VirtualMachine{Spec: VirtualMachineSpec{Name: "vm01", NICs: []NIC{{Index: 2}, {Index: 3}}}}
+
+	machine, err := vb.VMInfoGetRules(vm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nics := machine.Spec.NICs
+	if len(nics[0].PortForwarding) != 2 || nics[0].PortForwarding[0].Name != "ssh" || nics[0].PortForwarding[1].NicIndex != 2 {
+		t.Errorf("unexpected rules of nic 2 %+v", nics[0].PortForwarding)
+	}
+	if len(nics[1].PortForwarding) != 1 || nics[1].PortForwarding[0].Name != "http" || nics[1].PortForwarding[0].NicIndex != 3 {
+		t.Errorf("unexpected rules of nic 3 %+v", nics[1].PortForwarding)
+	}
+}
@@ -0,0 +1,125 @@
+package virtualbox
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// GuestIPProperty is set by the guest additions once the first nic has an address
+const GuestIPProperty = "/VirtualBox/GuestInfo/Net/0/V4/IP"
+
+// ResetOptions tune ResetToSnapshot
+type ResetOptions struct {
+	// Start boots the vm headless once restored. Online snapshots are always resumed as they carry a running state
+	Start bool
+	// WaitReady blocks until the started vm is running and, when ReadyProperty is set, the guest has reported it
+	WaitReady bool
+	// ReadyProperty is a guest property the guest sets once it is usable, for e.g GuestIPProperty
+	ReadyProperty string
+	// PollInterval is the time between state checks, a second unless positive
+	PollInterval time.Duration
+}
+
+// stopCommandFor returns the command that brings a vm in the given state to a state a snapshot can be restored in
+func stopCommandFor(state VirtualMachineState) string {
+	switch state {
+	case Running, Paused, Stuck:
+		return "poweroff"
+	case Saved:
+		return "discardstate"
+	}
+	return ""
+}
+
+// settledStates are the states a vm can rest in, anything else is a transition we have to wait out
+var settledStates = []VirtualMachineState{Poweroff, Running, Paused, Saved, Aborted, Stuck}
+
+// ResetToSnapshot powers off the vm whatever state it is in, restores the snapshot and optionally starts it again.
+// The snapshot is looked up by uuid, path or name, see FindSnapshot. Cancelling the context kills the VBoxManage
+// call in progress
+func (vb *VBox) ResetToSnapshot(ctx context.Context, vm *VirtualMachine, snapshot string, opts ResetOptions) (*VirtualMachine, error) {
+	interval := pollInterval(opts.PollInterval)
+
+	target, err := vb.findSnapshot(ctx, vm, snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := vb.WaitForState(ctx, vm, interval, settledStates...)
+	if err != nil {
+		return nil, OperationError{Path: "vm/state", Op: "wait", Err: err}
+	}
+
+	switch stopCommandFor(state) {
+	case "poweroff":
+		if _, err := vb.manageWithContext(ctx, "controlvm", vm.UUIDOrName(), "poweroff"); err != nil {
+			return nil, OperationError{Path: "vm/state", Op: "poweroff", Err: err}
+		}
+		if _, err := vb.WaitForState(ctx, vm, interval, Poweroff, Aborted); err != nil {
+			return nil, OperationError{Path: "vm/state", Op: "wait", Err: err}
+		}
+	case "discardstate":
+		if _, err := vb.manageWithContext(ctx, "discardstate", vm.UUIDOrName()); err != nil {
+			return nil, OperationError{Path: "vm/state", Op: "discardstate", Err: err}
+		}
+	}
+
+	if _, err := vb.manageWithContext(ctx, "snapshot", vm.UUIDOrName(), "restore", target.UUIDOrName()); err != nil {
+		return nil, OperationError{Path: fmt.Sprintf("snapshot/%s", target.UUIDOrName()), Op: "restore", Err: err}
+	}
+
+	// restoring an online snapshot leaves the vm saved, starting it resumes where the snapshot was taken
+	state, err = vb.state(ctx, vm)
+	if err != nil {
+		return nil, err
+	}
+	online := target.Online || state == Saved
+
+	if opts.Start || online {
+		if _, err := vb.manageWithContext(ctx, "startvm", vm.UUIDOrName(), "--type", "headless"); err != nil {
+			return nil, OperationError{Path: "vm/state", Op: "start", Err: err}
+		}
+
+		if opts.WaitReady {
+			if err := vb.waitReady(ctx, vm, interval, opts.ReadyProperty); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return vb.VMInfo(vm.UUIDOrName())
+}
+
+func (vb *VBox) waitReady(ctx context.Context, vm *VirtualMachine, interval time.Duration, property string) error {
+	state, err := vb.WaitForState(ctx, vm, interval, Running, Poweroff, Aborted)
+	if err != nil {
+		return OperationError{Path: "vm/state", Op: "wait", Err: err}
+	}
+	if state != Running {
+		return OperationError{Path: "vm/state", Op: "wait", Err: fmt.Errorf("vm stopped while starting, state %s", state)}
+	}
+
+	if property == "" {
+		return nil
+	}
+
+	for {
+		val, err := vb.guestProperty(ctx, vm, property)
+		if err != nil {
+			return OperationError{Path: "vm/guestproperty", Op: "get", Err: err}
+		}
+		if val != "" {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return OperationError{Path: "vm/guestproperty", Op: "wait", Err: ctx.Err()}
+		case <-time.After(interval):
+		}
+	}
+}
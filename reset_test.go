@@ -0,0 +1,147 @@
+package virtualbox
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStopCommandFor(t *testing.T) {
+	expected := map[VirtualMachineState]string{
+		Running:  "poweroff",
+		Paused:   "poweroff",
+		Stuck:    "poweroff",
+		Saved:    "discardstate",
+		Aborted:  "",
+		Poweroff: "",
+	}
+
+	for state, cmd := range expected {
+		if got := stopCommandFor(state); got != cmd {
+			t.Errorf("expected %q for state %s, got %q", cmd, state, got)
+		}
+	}
+}
+
+// fakeResetVM scripts VBoxManage for testvm1 of showVmInfoOutput, moving it between states as commands come in
+type fakeResetVM struct {
+	state VirtualMachineState
+	// online makes restoring leave the vm saved, like an online snapshot does
+	online bool
+	// hang blocks the command starting with it until the context is done
+	hang     string
+	commands []string
+}
+
+func (f *fakeResetVM) run(ctx context.Context, args ...string) (string, error) {
+	cmd := strings.Join(args, " ")
+	f.commands = append(f.commands, cmd)
+	if f.hang != "" && strings.HasPrefix(cmd, f.hang) {
+		<-ctx.Done()
+		return "", ctx.Err()
+	}
+
+	switch {
+	case args[0] == "showvminfo":
+		out := strings.Replace(showVmInfoOutput, `VMState="poweroff"`, `VMState="`+string(f.state)+`"`, 1)
+		return out + "SnapshotName=\"base\"\nSnapshotUUID=\"11111111-0000-0000-0000-000000000001\"\n", nil
+	case cmd == "controlvm testvm1 poweroff", cmd == "discardstate testvm1":
+		f.state = Poweroff
+	case strings.HasPrefix(cmd, "snapshot testvm1 restore"):
+		f.state = Poweroff
+		if f.online {
+			f.state = Saved
+		}
+	case strings.HasPrefix(cmd, "startvm"):
+		f.state = Running
+	case strings.HasPrefix(cmd, "guestproperty get"):
+		return "Value: 10.0.2.15\n", nil
+	}
+	return "", nil
+}
+
+// changes returns the commands that are not state queries
+func (f *fakeResetVM) changes() []string {
+	var changes []string
+	for _, c := range f.commands {
+		if !strings.HasPrefix(c, "showvminfo") {
+			changes = append(changes, c)
+		}
+	}
+	return changes
+}
+
+func TestResetToSnapshot(t *testing.T) {
+	vm := &VirtualMachine{Spec: VirtualMachineSpec{Name: "testvm1"}}
+	opts := ResetOptions{PollInterval: time.Millisecond}
+
+	for _, tc := range []struct {
+		name     string
+		fake     fakeResetVM
+		opts     ResetOptions
+		expected []string
+	}{
+		{
+			name:     "running",
+			fake:     fakeResetVM{state: Running},
+			opts:     opts,
+			expected: []string{"controlvm testvm1 poweroff", "snapshot testvm1 restore 11111111-0000-0000-0000-000000000001"},
+		},
+		{
+			name:     "saved",
+			fake:     fakeResetVM{state: Saved},
+			opts:     opts,
+			expected: []string{"discardstate testvm1", "snapshot testvm1 restore 11111111-0000-0000-0000-000000000001"},
+		},
+		{
+			name: "online snapshot",
+			fake: fakeResetVM{state: Poweroff, online: true},
+			opts: opts,
+			expected: []string{"snapshot testvm1 restore 11111111-0000-0000-0000-000000000001",
+				"startvm testvm1 --type headless"},
+		},
+		{
+			name: "start and wait",
+			fake: fakeResetVM{state: Aborted},
+			opts: ResetOptions{Start: true, WaitReady: true, ReadyProperty: GuestIPProperty, PollInterval: time.Millisecond},
+			expected: []string{"snapshot testvm1 restore 11111111-0000-0000-0000-000000000001",
+				"startvm testvm1 --type headless", "guestproperty get testvm1 " + GuestIPProperty},
+		},
+	} {
+		fake := tc.fake
+		vb := &VBox{run: fake.run}
+		machine, err := vb.ResetToSnapshot(context.Background(), vm, "base", tc.opts)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if machine.Spec.Name != "testvm1" {
+			t.Errorf("%s: unexpected vm %+v", tc.name, machine)
+		}
+		if changes := fake.changes(); !reflect.DeepEqual(changes, tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.expected, changes)
+		}
+	}
+}
+
+func TestResetToSnapshotCancel(t *testing.T) {
+	vm := &VirtualMachine{Spec: VirtualMachineSpec{Name: "testvm1"}}
+	fake := fakeResetVM{state: Running, hang: "controlvm testvm1 poweroff"}
+	vb := &VBox{run: fake.run}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := vb.ResetToSnapshot(ctx, vm, "base", ResetOptions{PollInterval: time.Millisecond})
+	operr, ok := err.(OperationError)
+	if !ok || operr.Op != "poweroff" || operr.Err != context.DeadlineExceeded {
+		t.Fatalf("expected the hung poweroff to be cancelled, got %v", err)
+	}
+	for _, c := range fake.changes() {
+		if strings.HasPrefix(c, "snapshot") {
+			t.Errorf("expected no restore after cancelling, got %s", c)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package virtualbox
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// snapshotLabelPrefix marks description lines that carry a label, for e.g label:job=nightly
+const snapshotLabelPrefix = "label:"
+
+// snapshotNameLayout is used to generate unique snapshot names out of a prefix
+const snapshotNameLayout = "20060102-150405"
+
+// Labels returns the labels stored in the snapshot description
+func (s *Snapshot) Labels() map[string]string {
+	labels := map[string]string{}
+	sc := bufio.NewScanner(strings.NewReader(s.Description))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if !strings.HasPrefix(line, snapshotLabelPrefix) {
+			continue
+		}
+		kv := strings.SplitN(strings.TrimPrefix(line, snapshotLabelPrefix), "=", 2)
+		if len(kv) == 2 {
+			labels[kv[0]] = kv[1]
+		} else {
+			labels[kv[0]] = ""
+		}
+	}
+	return labels
+}
+
+// SetLabels appends the labels to the snapshot description, one label per line
+func (s *Snapshot) SetLabels(labels map[string]string) {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	lines := []string{}
+	if s.Description != "" {
+		lines = append(lines, s.Description)
+	}
+	for _, k := range keys {
+		lines = append(lines, fmt.Sprintf("%s%s=%s", snapshotLabelPrefix, k, labels[k]))
+	}
+	s.Description = strings.Join(lines, "\n")
+}
+
+// hasLabels is true when the snapshot carries all of the given labels, an empty value matches any value
+func (s *Snapshot) hasLabels(selector map[string]string) bool {
+	labels := s.Labels()
+	for k, v := range selector {
+		lv, ok := labels[k]
+		if !ok || (v != "" && lv != v) {
+			return false
+		}
+	}
+	return true
+}
+
+// TakeLabeledSnapshot takes a snapshot named after prefix and the current time, with the labels stored in its description
+func (vb *VBox) TakeLabeledSnapshot(vm *VirtualMachine, prefix string, labels map[string]string, live bool) (*Snapshot, error) {
+	now := time.Now()
+	snapshot := Snapshot{
+		Name:    fmt.Sprintf("%s-%s", prefix, now.UTC().Format(snapshotNameLayout)),
+		Created: now,
+		Online:  live,
+	}
+	snapshot.SetLabels(labels)
+
+	uuid, err := vb.takeSnapshot(vm, snapshot, live)
+	if err != nil {
+		return nil, err
+	}
+	snapshot.UUID = uuid
+	return &snapshot, nil
+}
+
+// RetentionPolicy decides which snapshots of a vm survive a Prune. A snapshot is kept when any of the keep rules
+// selects it, when there are no keep rules at all nothing is deleted.
+type RetentionPolicy struct {
+	// KeepLast keeps the n most recent snapshots
+	KeepLast int
+	// KeepDaily keeps the most recent snapshot for each of the last n days that have snapshots
+	KeepDaily int
+	// KeepWeekly keeps the most recent snapshot for each of the last n weeks that have snapshots
+	KeepWeekly int
+	// MaxAge keeps every snapshot younger than the duration
+	MaxAge time.Duration
+	// ProtectedLabel snapshots carrying this label are never deleted
+	ProtectedLabel string
+	// Selector restricts the policy to snapshots carrying all of these labels, others are left alone
+	Selector map[string]string
+	// DryRun only reports the decisions without deleting anything
+	DryRun bool
+}
+
+func (p RetentionPolicy) hasKeepRules() bool {
+	return p.KeepLast > 0 || p.KeepDaily > 0 || p.KeepWeekly > 0 || p.MaxAge > 0
+}
+
+// RetentionDecision records what happened to a snapshot and why
+type RetentionDecision struct {
+	Snapshot Snapshot
+	Reason   string
+}
+
+type RetentionReport struct {
+	DryRun  bool
+	Kept    []RetentionDecision
+	Deleted []RetentionDecision
+}
+
+// planRetention returns the snapshots to keep and to delete, the latter ordered so that children go before their parents
+func planRetention(tree *SnapshotTree, policy RetentionPolicy, now time.Time) (keep, remove []RetentionDecision) {
+	reasons := map[*SnapshotTree]string{}
+	var candidates []*SnapshotTree
+
+	tree.Walk(func(node *SnapshotTree) bool {
+		switch {
+		case !node.hasLabels(policy.Selector):
+			reasons[node] = "not selected"
+		case policy.ProtectedLabel != "" && node.hasLabels(map[string]string{policy.ProtectedLabel: ""}):
+			reasons[node] = "protected"
+		case node.Current:
+			reasons[node] = "current"
+		case node.Created.IsZero():
+			reasons[node] = "unknown age"
+		case !policy.hasKeepRules():
+			reasons[node] = "no keep rules"
+		default:
+			candidates = append(candidates, node)
+		}
+		return true
+	})
+
+	// newest first
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Created.After(candidates[j].Created)
+	})
+
+	bucket := func(n int, reason string, key func(t time.Time) string) {
+		seen := map[string]bool{}
+		for _, c := range candidates {
+			if len(seen) >= n {
+				return
+			}
+			k := key(c.Created)
+			if seen[k] {
+				continue
+			}
+			seen[k] = true
+			if _, ok := reasons[c]; !ok {
+				reasons[c] = reason
+			}
+		}
+	}
+
+	for i, c := range candidates {
+		if i < policy.KeepLast {
+			reasons[c] = "last"
+		}
+	}
+	bucket(policy.KeepDaily, "daily", func(t time.Time) string {
+		return t.Local().Format("2006-01-02")
+	})
+	bucket(policy.KeepWeekly, "weekly", func(t time.Time) string {
+		y, w := t.Local().ISOWeek()
+		return fmt.Sprintf("%d-%d", y, w)
+	})
+	if policy.MaxAge > 0 {
+		for _, c := range candidates {
+			if _, ok := reasons[c]; !ok && now.Sub(c.Created) < policy.MaxAge {
+				reasons[c] = "max age"
+			}
+		}
+	}
+
+	// children first, a snapshot can only be deleted once it is down to a single child
+	children := map[*SnapshotTree]int{}
+	var visit func(node *SnapshotTree)
+	visit = func(node *SnapshotTree) {
+		for _, c := range node.Children {
+			visit(c)
+		}
+		children[node] = len(node.Children)
+		for _, c := range node.Children {
+			if _, kept := reasons[c]; !kept {
+				children[node] += children[c] - 1
+			}
+		}
+
+		if reason, ok := reasons[node]; ok {
+			keep = append(keep, RetentionDecision{Snapshot: node.Snapshot, Reason: reason})
+		} else if children[node] > 1 {
+			reasons[node] = "multiple children"
+			keep = append(keep, RetentionDecision{Snapshot: node.Snapshot, Reason: "multiple children"})
+		} else {
+			remove = append(remove, RetentionDecision{Snapshot: node.Snapshot, Reason: "expired"})
+		}
+	}
+	if tree != nil {
+		visit(tree)
+	}
+	return keep, remove
+}
+
+// Prune deletes the snapshots of the vm that are not retained by the policy
+func (vb *VBox) Prune(ctx context.Context, vm *VirtualMachine, policy RetentionPolicy) (*RetentionReport, error) {
+	tree, err := vb.Snapshots(vm)
+	if err != nil {
+		return nil, err
+	}
+
+	keep, remove := planRetention(tree, policy, time.Now())
+	report := &RetentionReport{DryRun: policy.DryRun, Kept: keep}
+	if policy.DryRun {
+		report.Deleted = remove
+		return report, nil
+	}
+
+	for _, d := range remove {
+		select {
+		case <-ctx.Done():
+			return report, ctx.Err()
+		default:
+		}
+
+		if err := vb.DeleteSnapshot(vm, d.Snapshot); err != nil {
+			return report, OperationError{Path: fmt.Sprintf("snapshot/%s", d.Snapshot.UUIDOrName()), Op: "delete", Err: err}
+		}
+		report.Deleted = append(report.Deleted, d)
+	}
+	return report, nil
+}
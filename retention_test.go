@@ -0,0 +1,125 @@
+package virtualbox
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func retentionTree(now time.Time) *SnapshotTree {
+	// base -> day-10 -> day-3 -> day-2 -> day-1 -> day-0 (current)
+	//                         \-> pinned (protected)
+	root := &SnapshotTree{Snapshot: Snapshot{UUID: "base", Name: "base", Created: now.Add(-30 * 24 * time.Hour)}}
+	root.SetLabels(map[string]string{"job": "manual"})
+
+	parent := root
+	for _, days := range []int{10, 3, 2, 1, 0} {
+		node := &SnapshotTree{Snapshot: Snapshot{
+			UUID:    fmt.Sprintf("day-%d", days),
+			Name:    "nightly",
+			Created: now.Add(-time.Duration(days)*24*time.Hour - time.Minute),
+		}, Parent: parent}
+		node.SetLabels(map[string]string{"job": "nightly"})
+		parent.Children = append(parent.Children, node)
+		parent = node
+	}
+	parent.Current = true
+
+	day3 := root.FindByUUID("day-3")
+	pinned := &SnapshotTree{Snapshot: Snapshot{UUID: "pinned", Name: "pinned", Created: now.Add(-20 * 24 * time.Hour)}, Parent: day3}
+	pinned.SetLabels(map[string]string{"job": "nightly", "protected": "yes"})
+	day3.Children = append(day3.Children, pinned)
+
+	return root
+}
+
+func decisionUUIDs(decisions []RetentionDecision) map[string]string {
+	m := map[string]string{}
+	for _, d := range decisions {
+		m[d.Snapshot.UUID] = d.Reason
+	}
+	return m
+}
+
+func TestSnapshotLabels(t *testing.T) {
+	s := Snapshot{Description: "taken by ci"}
+	s.SetLabels(map[string]string{"job": "nightly", "protected": ""})
+
+	if s.Description != "taken by ci\nlabel:job=nightly\nlabel:protected=" {
+		t.Errorf("unexpected description %q", s.Description)
+	}
+
+	labels := s.Labels()
+	if len(labels) != 2 || labels["job"] != "nightly" {
+		t.Errorf("unexpected labels %v", labels)
+	}
+
+	if !s.hasLabels(map[string]string{"job": "nightly"}) || s.hasLabels(map[string]string{"job": "weekly"}) {
+		t.Errorf("label selection did not match as expected")
+	}
+}
+
+func TestPlanRetentionKeepLast(t *testing.T) {
+	now := time.Now()
+	policy := RetentionPolicy{
+		KeepLast:       2,
+		ProtectedLabel: "protected",
+		Selector:       map[string]string{"job": "nightly"},
+	}
+
+	keep, remove := planRetention(retentionTree(now), policy, now)
+
+	kept := decisionUUIDs(keep)
+	expected := map[string]string{
+		"base":   "not selected",
+		"day-0":  "current",
+		"day-1":  "last",
+		"day-2":  "last",
+		"day-3":  "multiple children",
+		"pinned": "protected",
+	}
+	for uuid, reason := range expected {
+		if kept[uuid] != reason {
+			t.Errorf("expected %s to be kept for %q, got %q", uuid, reason, kept[uuid])
+		}
+	}
+
+	deleted := decisionUUIDs(remove)
+	if len(deleted) != 1 || deleted["day-10"] == "" {
+		t.Errorf("expected only day-10 to be deleted, got %v", deleted)
+	}
+}
+
+func TestPlanRetentionMaxAge(t *testing.T) {
+	now := time.Now()
+	policy := RetentionPolicy{
+		MaxAge:         48 * time.Hour,
+		ProtectedLabel: "protected",
+	}
+
+	_, remove := planRetention(retentionTree(now), policy, now)
+
+	deleted := decisionUUIDs(remove)
+	for _, uuid := range []string{"base", "day-10", "day-2"} {
+		if _, ok := deleted[uuid]; !ok {
+			t.Errorf("expected %s to be deleted, got %v", uuid, deleted)
+		}
+	}
+	// day-3 is old enough, but once day-2 is gone it would be left with two children
+	if len(deleted) != 3 {
+		t.Errorf("expected 3 deletions, got %v", deleted)
+	}
+
+	// children must be deleted before their parents
+	if remove[len(remove)-1].Snapshot.UUID != "base" {
+		t.Errorf("expected the root to be deleted last, got %v", remove)
+	}
+}
+
+func TestPlanRetentionNoRules(t *testing.T) {
+	now := time.Now()
+	_, remove := planRetention(retentionTree(now), RetentionPolicy{}, now)
+	if len(remove) != 0 {
+		t.Errorf("expected nothing to be deleted without keep rules, got %v", remove)
+	}
+}
@@ -0,0 +1,507 @@
+package virtualbox
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// settingsFile maps the parts of the .vbox machine settings file that are not exposed by showvminfo
+type settingsFile struct {
+	XMLName xml.Name        `xml:"VirtualBox"`
+	Machine settingsMachine `xml:"Machine"`
+}
+
+type settingsMachine struct {
+	UUID            string                `xml:"uuid,attr"`
+	Name            string                `xml:"name,attr"`
+	OSType          string                `xml:"OSType,attr"`
+	CurrentSnapshot string                `xml:"currentSnapshot,attr"`
+	MediaRegistry   settingsMediaRegistry `xml:"MediaRegistry"`
+	Snapshot        *settingsSnapshot     `xml:"Snapshot"`
+	settingsConfig
+}
+
+type settingsSnapshot struct {
+	UUID      string             `xml:"uuid,attr"`
+	Name      string             `xml:"name,attr"`
+	TimeStamp string             `xml:"timeStamp,attr"`
+	StateFile string             `xml:"stateFile,attr"`
+	Children  []settingsSnapshot `xml:"Snapshots>Snapshot"`
+	settingsConfig
+}
+
+// settingsConfig is the machine configuration, stored once for the current state and once per snapshot.
+// Older settings versions keep the storage controllers next to the hardware, newer ones inside it
+type settingsConfig struct {
+	Hardware           settingsHardware            `xml:"Hardware"`
+	StorageControllers []settingsStorageController `xml:"StorageControllers>StorageController"`
+}
+
+type settingsHardware struct {
+	CPU struct {
+		Count int `xml:"count,attr"`
+	} `xml:"CPU"`
+	Memory struct {
+		RAMSize int `xml:"RAMSize,attr"`
+	} `xml:"Memory"`
+	Boot []struct {
+		Position int    `xml:"position,attr"`
+		Device   string `xml:"device,attr"`
+	} `xml:"Boot>Order"`
+	Adapters        []settingsAdapter `xml:"Network>Adapter"`
+	BandwidthGroups []struct {
+		Name           string `xml:"name,attr"`
+		Type           string `xml:"type,attr"`
+		MaxBytesPerSec int64  `xml:"maxBytesPerSec,attr"`
+		MaxMbPerSec    int64  `xml:"maxMbPerSec,attr"`
+	} `xml:"IO>BandwidthGroups>BandwidthGroup"`
+	StorageControllers []settingsStorageController `xml:"StorageControllers>StorageController"`
+}
+
+type settingsAdapter struct {
+	Slot        int            `xml:"slot,attr"`
+	Enabled     bool           `xml:"enabled,attr"`
+	MACAddress  string         `xml:"MACAddress,attr"`
+	Cable       string         `xml:"cable,attr"`
+	Type        string         `xml:"type,attr"`
+	Speed       int            `xml:"speed,attr"`
+	BootPrio    int            `xml:"bootPriority,attr"`
+	Bandwidth   string         `xml:"bandwidthGroup,attr"`
+	NAT         *settingsNAT   `xml:"NAT"`
+	HostOnly    *settingsNamed `xml:"HostOnlyInterface"`
+	HostOnlyNet *settingsNamed `xml:"HostOnlyNetwork"`
+	Internal    *settingsNamed `xml:"InternalNetwork"`
+	Bridged     *settingsNamed `xml:"BridgedInterface"`
+	NATNetwork  *settingsNamed `xml:"NATNetwork"`
+	Generic     *settingsNamed `xml:"GenericInterface"`
+}
+
+// settingsNAT is the NAT engine of an adapter, attributes left at their default are not written
+type settingsNAT struct {
+	Network string `xml:"network,attr"`
+	HostIP  string `xml:"hostip,attr"`
+	MTU     int    `xml:"mtu,attr"`
+	SockSnd int    `xml:"socksnd,attr"`
+	SockRcv int    `xml:"sockrcv,attr"`
+	TCPSnd  int    `xml:"tcpsnd,attr"`
+	TCPRcv  int    `xml:"tcprcv,attr"`
+	DNS     *struct {
+		PassDomain      string `xml:"pass-domain,attr"`
+		UseProxy        string `xml:"use-proxy,attr"`
+		UseHostResolver string `xml:"use-host-resolver,attr"`
+	} `xml:"DNS"`
+	Alias *struct {
+		Logging      bool `xml:"logging,attr"`
+		ProxyOnly    bool `xml:"proxy-only,attr"`
+		UseSamePorts bool `xml:"use-same-ports,attr"`
+	} `xml:"Alias"`
+	TFTP *struct {
+		Prefix     string `xml:"prefix,attr"`
+		BootFile   string `xml:"boot-file,attr"`
+		NextServer string `xml:"next-server,attr"`
+	} `xml:"TFTP"`
+	Forwarding []struct {
+		Name      string `xml:"name,attr"`
+		Proto     int    `xml:"proto,attr"`
+		HostIP    string `xml:"hostip,attr"`
+		HostPort  int    `xml:"hostport,attr"`
+		GuestIP   string `xml:"guestip,attr"`
+		GuestPort int    `xml:"guestport,attr"`
+	} `xml:"Forwarding"`
+}
+
+func settingsOnOff(v string) string {
+	switch v {
+	case "true":
+		return "on"
+	case "false":
+		return "off"
+	}
+	return ""
+}
+
+func (n *settingsNAT) engine() NATEngine {
+	e := NATEngine{
+		Network:          n.Network,
+		BindIP:           n.HostIP,
+		MTU:              n.MTU,
+		SocketSend:       n.SockSnd,
+		SocketReceive:    n.SockRcv,
+		TCPWindowSend:    n.TCPSnd,
+		TCPWindowReceive: n.TCPRcv,
+	}
+	if n.DNS != nil {
+		e.DNSPassDomain = settingsOnOff(n.DNS.PassDomain)
+		e.DNSProxy = settingsOnOff(n.DNS.UseProxy)
+		e.DNSHostResolver = settingsOnOff(n.DNS.UseHostResolver)
+	}
+	if n.Alias != nil {
+		e.AliasMode = []NATAliasMode{}
+		for _, m := range []struct {
+			set  bool
+			mode NATAliasMode
+		}{
+			{n.Alias.Logging, NATAliasLog},
+			{n.Alias.ProxyOnly, NATAliasProxyOnly},
+			{n.Alias.UseSamePorts, NATAliasSamePorts},
+		} {
+			if m.set {
+				e.AliasMode = append(e.AliasMode, m.mode)
+			}
+		}
+	}
+	if n.TFTP != nil {
+		e.TFTPPrefix, e.TFTPFile, e.TFTPServer = n.TFTP.Prefix, n.TFTP.BootFile, n.TFTP.NextServer
+	}
+	return e
+}
+
+type settingsNamed struct {
+	Name   string `xml:"name,attr"`
+	Driver string `xml:"driver,attr"`
+}
+
+type settingsStorageController struct {
+	Name           string                   `xml:"name,attr"`
+	Type           string                   `xml:"type,attr"`
+	PortCount      int                      `xml:"PortCount,attr"`
+	Bootable       bool                     `xml:"Bootable,attr"`
+	UseHostIOCache string                   `xml:"useHostIOCache,attr"`
+	Devices        []settingsAttachedDevice `xml:"AttachedDevice"`
+}
+
+type settingsAttachedDevice struct {
+	Type           string `xml:"type,attr"`
+	Port           int    `xml:"port,attr"`
+	Device         int    `xml:"device,attr"`
+	NonRotational  bool   `xml:"nonrotational,attr"`
+	Discard        bool   `xml:"discard,attr"`
+	HotPluggable   bool   `xml:"hotpluggable,attr"`
+	BandwidthGroup string `xml:"bandwidthGroup,attr"`
+	Image          *struct {
+		UUID string `xml:"uuid,attr"`
+	} `xml:"Image"`
+}
+
+type settingsMediaRegistry struct {
+	HardDisks []settingsMedium `xml:"HardDisks>HardDisk"`
+	DVDImages []settingsMedium `xml:"DVDImages>Image"`
+	Floppies  []settingsMedium `xml:"FloppyImages>Image"`
+}
+
+type settingsMedium struct {
+	UUID        string           `xml:"uuid,attr"`
+	Location    string           `xml:"location,attr"`
+	Format      string           `xml:"format,attr"`
+	Type        string           `xml:"type,attr"`
+	Description string           `xml:"Description"`
+	Children    []settingsMedium `xml:"HardDisk"`
+}
+
+func readSettingsFile(path string) (*settingsFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var settings settingsFile
+	if err := xml.NewDecoder(f).Decode(&settings); err != nil {
+		return nil, err
+	}
+	return &settings, nil
+}
+
+// settingsUUID strips the braces the settings file puts around uuids
+func settingsUUID(uuid string) string {
+	return strings.Trim(uuid, "{}")
+}
+
+// readSnapshotSettings fills in creation time and online flag of the snapshots in tree from the settings file at path
+func (vb *VBox) readSnapshotSettings(path string, tree *SnapshotTree) error {
+	settings, err := readSettingsFile(path)
+	if err != nil {
+		return err
+	}
+	applySnapshotSettings(settings.Machine.Snapshot, tree)
+	return nil
+}
+
+func applySnapshotSettings(s *settingsSnapshot, tree *SnapshotTree) {
+	if s == nil {
+		return
+	}
+	if node := tree.FindByUUID(settingsUUID(s.UUID)); node != nil {
+		if t, err := time.Parse(time.RFC3339, s.TimeStamp); err == nil {
+			node.Created = t
+		}
+		node.Online = s.StateFile != ""
+	}
+	for i := range s.Children {
+		applySnapshotSettings(&s.Children[i], tree)
+	}
+}
+
+// settingsMediumRef is a medium of the registry together with the base medium of its differencing chain
+type settingsMediumRef struct {
+	medium *settingsMedium
+	base   *settingsMedium
+	dir    string
+}
+
+// location resolves the location of m, relative locations are relative to the settings file
+func (r settingsMediumRef) location(m *settingsMedium) string {
+	if m.Location != "" && !filepath.IsAbs(m.Location) {
+		return filepath.Join(r.dir, m.Location)
+	}
+	return m.Location
+}
+
+// index maps uuids to media of the registry
+func (r *settingsMediaRegistry) index(dir string) map[string]settingsMediumRef {
+	refs := map[string]settingsMediumRef{}
+	var add func(m *settingsMedium, base *settingsMedium)
+	add = func(m *settingsMedium, base *settingsMedium) {
+		if base == nil {
+			base = m
+		}
+		refs[settingsUUID(m.UUID)] = settingsMediumRef{medium: m, base: base, dir: dir}
+		for i := range m.Children {
+			add(&m.Children[i], base)
+		}
+	}
+	for _, media := range [][]settingsMedium{r.HardDisks, r.DVDImages, r.Floppies} {
+		for i := range media {
+			add(&media[i], nil)
+		}
+	}
+	return refs
+}
+
+var settingsBootDevices = map[string]BootDevice{
+	"None":     BOOT_none,
+	"Floppy":   BootDevice("floppy"),
+	"DVD":      BootDevice("dvd"),
+	"HardDisk": BOOT_disk,
+	"Network":  BOOT_net,
+}
+
+var settingsDiskTypes = map[string]DiskType{
+	"HardDisk": HDDrive,
+	"DVD":      DVDDrive,
+	"Floppy":   FDDrive,
+}
+
+func (sc *settingsStorageController) hostIOCache() string {
+	return settingsOnOff(sc.UseHostIOCache)
+}
+
+// applySettings fills in what showvminfo does not report from the current configuration: the host i/o cache of
+// the controllers, the attachment options of the disks, the NAT engines and the bandwidth groups. Controllers are matched by name,
+// disks by slot and nics by index
+func (m *settingsMachine) applySettings(path string, spec *VirtualMachineSpec) {
+	current := m.spec(m.MediaRegistry.index(filepath.Dir(path)))
+	controllers, disks := spec.StorageControllers, spec.Disks
+
+	for i := range controllers {
+		for _, sc := range current.StorageControllers {
+			if controllers[i].Name == sc.Name {
+				controllers[i].HostIOCache = sc.HostIOCache
+			}
+		}
+	}
+
+	for i := range disks {
+		for _, d := range current.Disks {
+			if diskSlot(disks[i]) != diskSlot(d) {
+				continue
+			}
+			disks[i].NonRotational = d.NonRotational
+			disks[i].AutoDiscard = d.AutoDiscard
+			disks[i].Controller.HotPluggable = d.Controller.HotPluggable
+			disks[i].BandwidthGroup = d.BandwidthGroup
+			if disks[i].MediumType == "" {
+				disks[i].MediumType = d.MediumType
+			}
+			if disks[i].Comment == "" {
+				disks[i].Comment = d.Comment
+			}
+		}
+	}
+
+	for i := range spec.NICs {
+		for _, nic := range current.NICs {
+			if spec.NICs[i].Index == nic.Index {
+				spec.NICs[i].BandwidthGroup = nic.BandwidthGroup
+				spec.NICs[i].NATEngine = nic.NATEngine
+			}
+		}
+	}
+	spec.BandwidthGroups = current.BandwidthGroups
+}
+
+// spec converts the configuration into a spec, disks are reported by the base medium of their differencing chain
+// so that the images snapshots put on top of them do not show up as configuration changes
+func (c *settingsConfig) spec(media map[string]settingsMediumRef) VirtualMachineSpec {
+	var spec VirtualMachineSpec
+	spec.CPU.Count = c.Hardware.CPU.Count
+	if spec.CPU.Count == 0 {
+		spec.CPU.Count = 1
+	}
+	spec.Memory.SizeMB = c.Hardware.Memory.RAMSize
+
+	boot := c.Hardware.Boot
+	sort.Slice(boot, func(i, j int) bool { return boot[i].Position < boot[j].Position })
+	for _, b := range boot {
+		if d, ok := settingsBootDevices[b.Device]; ok {
+			spec.Boot = append(spec.Boot, d)
+		}
+	}
+
+	for _, a := range c.Hardware.Adapters {
+		if !a.Enabled {
+			continue
+		}
+		nic := NIC{
+			Index:          a.Slot + 1,
+			Type:           NICType(a.Type),
+			MAC:            a.MACAddress,
+			CableConnected: a.Cable != "false",
+			Speedkbps:      a.Speed,
+			BootPrio:       a.BootPrio,
+			BandwidthGroup: a.Bandwidth,
+		}
+		switch {
+		case a.HostOnly != nil:
+			nic.Mode, nic.NetworkName = NWMode_hostonly, a.HostOnly.Name
+		case a.HostOnlyNet != nil:
+			nic.Mode, nic.NetworkName = NWMode_hostonlynet, a.HostOnlyNet.Name
+		case a.Internal != nil:
+			nic.Mode, nic.NetworkName = NWMode_intnet, a.Internal.Name
+		case a.Bridged != nil:
+			nic.Mode, nic.NetworkName = NWMode_bridged, a.Bridged.Name
+		case a.NATNetwork != nil:
+			nic.Mode, nic.NetworkName = NWMode_natnetwork, a.NATNetwork.Name
+		case a.Generic != nil:
+			nic.Mode, nic.NetworkName = NWMode_generic, a.Generic.Driver
+		case a.NAT != nil:
+			nic.Mode = NWMode_nat
+		default:
+			nic.Mode = NWMode_null
+		}
+		if a.NAT != nil {
+			nic.NATEngine = a.NAT.engine()
+			for i, f := range a.NAT.Forwarding {
+				protocol := TCP
+				if f.Proto == 0 {
+					protocol = UDP
+				}
+				nic.PortForwarding = append(nic.PortForwarding, PortForwarding{
+					Index:     i,
+					NicIndex:  nic.Index,
+					Name:      f.Name,
+					Protocol:  protocol,
+					HostIP:    f.HostIP,
+					HostPort:  f.HostPort,
+					GuestIP:   f.GuestIP,
+					GuestPort: f.GuestPort,
+				})
+			}
+		}
+		spec.NICs = append(spec.NICs, nic)
+	}
+
+	for _, g := range c.Hardware.BandwidthGroups {
+		limit := g.MaxBytesPerSec
+		if limit == 0 {
+			// older settings versions store whole megabytes
+			limit = g.MaxMbPerSec * 1024 * 1024
+		}
+		spec.BandwidthGroups = append(spec.BandwidthGroups, BandwidthGroup{
+			Name:           g.Name,
+			Type:           BandwidthGroupType(strings.ToLower(g.Type)),
+			MaxBytesPerSec: limit,
+		})
+	}
+
+	for _, sc := range append(c.StorageControllers, c.Hardware.StorageControllers...) {
+		chipset := StorageControllerChipset(sc.Type)
+		ctl := StorageController{
+			Name:        sc.Name,
+			Type:        chipset.Type(),
+			Chipset:     chipset.normalize(),
+			PortCount:   sc.PortCount,
+			Bootable:    "off",
+			HostIOCache: sc.hostIOCache(),
+		}
+		if sc.Bootable {
+			ctl.Bootable = "on"
+		}
+		spec.StorageControllers = append(spec.StorageControllers, ctl)
+
+		for _, d := range sc.Devices {
+			disk := Disk{
+				Type:           settingsDiskTypes[d.Type],
+				NonRotational:  d.NonRotational,
+				AutoDiscard:    d.Discard,
+				BandwidthGroup: d.BandwidthGroup,
+				Controller: StorageControllerAttachment{
+					Type:         ctl.Type,
+					Port:         d.Port,
+					Device:       d.Device,
+					Name:         ctl.Name,
+					HotPluggable: d.HotPluggable,
+				},
+			}
+			if d.Image != nil {
+				disk.UUID = settingsUUID(d.Image.UUID)
+				if ref, ok := media[disk.UUID]; ok {
+					disk.MediumType = MediumType(strings.ToLower(ref.base.Type))
+					disk.Comment = ref.base.Description
+					disk.UUID = settingsUUID(ref.base.UUID)
+					disk.Path = ref.location(ref.base)
+					disk.Format = DiskFormat(ref.base.Format)
+				}
+			}
+			spec.Disks = append(spec.Disks, disk)
+		}
+	}
+	return spec
+}
+
+// machineSpec returns the current configuration of the machine, or the one stored with the snapshot when uuid is set
+func (s *settingsFile) machineSpec(path, snapshotUUID string) (*VirtualMachineSpec, error) {
+	config := &s.Machine.settingsConfig
+	if snapshotUUID != "" {
+		snapshot := s.Machine.Snapshot.find(snapshotUUID)
+		if snapshot == nil {
+			return nil, NotFoundError(fmt.Sprintf("snapshot %s not found in %s", snapshotUUID, path))
+		}
+		config = &snapshot.settingsConfig
+	}
+
+	spec := config.spec(s.Machine.MediaRegistry.index(filepath.Dir(path)))
+	spec.Name = s.Machine.Name
+	spec.OSType = OSType{ID: s.Machine.OSType}
+	return &spec, nil
+}
+
+func (s *settingsSnapshot) find(uuid string) *settingsSnapshot {
+	if s == nil {
+		return nil
+	}
+	if settingsUUID(s.UUID) == uuid {
+		return s
+	}
+	for i := range s.Children {
+		if found := s.Children[i].find(uuid); found != nil {
+			return found
+		}
+	}
+	return nil
+}
@@ -0,0 +1,284 @@
+package virtualbox
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+var reSnapshotTaken = regexp.MustCompile(`UUID: ([0-9a-fA-F-]+)`)
+
+// SnapshotTree is a node in the snapshot hierarchy of a VM. VirtualBox keeps a single root snapshot,
+// every other snapshot descends from it.
+type SnapshotTree struct {
+	Snapshot
+	// Current is set on the snapshot the VM state is currently based on
+	Current  bool
+	Parent   *SnapshotTree
+	Children []*SnapshotTree
+}
+
+// Walk visits the tree depth first, parents before children, until fn returns false
+func (t *SnapshotTree) Walk(fn func(node *SnapshotTree) bool) bool {
+	if t == nil {
+		return true
+	}
+	if !fn(t) {
+		return false
+	}
+	for _, c := range t.Children {
+		if !c.Walk(fn) {
+			return false
+		}
+	}
+	return true
+}
+
+// Flatten returns all snapshots of the tree in depth first order
+func (t *SnapshotTree) Flatten() []Snapshot {
+	snapshots := []Snapshot{}
+	t.Walk(func(node *SnapshotTree) bool {
+		snapshots = append(snapshots, node.Snapshot)
+		return true
+	})
+	return snapshots
+}
+
+// FindCurrent returns the node flagged as the current snapshot, if any
+func (t *SnapshotTree) FindCurrent() *SnapshotTree {
+	var current *SnapshotTree
+	t.Walk(func(node *SnapshotTree) bool {
+		if node.Current {
+			current = node
+		}
+		return current == nil
+	})
+	return current
+}
+
+// FindByUUID returns the snapshot with the given uuid or nil
+func (t *SnapshotTree) FindByUUID(uuid string) *SnapshotTree {
+	var found *SnapshotTree
+	t.Walk(func(node *SnapshotTree) bool {
+		if node.UUID == uuid {
+			found = node
+		}
+		return found == nil
+	})
+	return found
+}
+
+// FindByName returns every snapshot with the given name, names are not unique in VirtualBox
+func (t *SnapshotTree) FindByName(name string) []*SnapshotTree {
+	var found []*SnapshotTree
+	t.Walk(func(node *SnapshotTree) bool {
+		if node.Name == name {
+			found = append(found, node)
+		}
+		return true
+	})
+	return found
+}
+
+// FindByPath resolves a path of snapshot names separated by '/' starting at the root, for e.g base/nightly/fix.
+// Where siblings share a name the first one wins, use FindByUUID to disambiguate
+func (t *SnapshotTree) FindByPath(path string) *SnapshotTree {
+	if t == nil {
+		return nil
+	}
+	elems := strings.Split(strings.Trim(path, "/"), "/")
+	if elems[0] != t.Name {
+		return nil
+	}
+
+	node := t
+	for _, name := range elems[1:] {
+		var next *SnapshotTree
+		for _, c := range node.Children {
+			if c.Name == name {
+				next = c
+				break
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		node = next
+	}
+	return node
+}
+
+// Path returns the names from the root to this snapshot separated by '/'
+func (t *SnapshotTree) Path() string {
+	var elems []string
+	for node := t; node != nil; node = node.Parent {
+		elems = append([]string{node.Name}, elems...)
+	}
+	return strings.Join(elems, "/")
+}
+
+// parseSnapshotTree builds the tree out of the machine readable SnapshotName, SnapshotName-1, SnapshotName-1-2 ... keys,
+// where each -N suffix selects the Nth child of the previous node. Returns nil when the VM has no snapshots
+func parseSnapshotTree(m map[string]interface{}) *SnapshotTree {
+	currentUUID := stringValue(m, "CurrentSnapshotUUID")
+	// older versions report neither uuid, only the key of the current snapshot, for e.g SnapshotName-1-1
+	currentNode := stringValue(m, "CurrentSnapshotNode")
+
+	var build func(suffix string, parent *SnapshotTree) *SnapshotTree
+	build = func(suffix string, parent *SnapshotTree) *SnapshotTree {
+		name, ok := m["SnapshotName"+suffix].(string)
+		if !ok {
+			return nil
+		}
+		node := &SnapshotTree{
+			Snapshot: Snapshot{
+				Name:        name,
+				UUID:        stringValue(m, "SnapshotUUID"+suffix),
+				Description: stringValue(m, "SnapshotDescription"+suffix),
+			},
+			Parent: parent,
+		}
+		if parent != nil {
+			node.ParentUUID = parent.UUID
+		}
+		if currentUUID != "" {
+			node.Current = node.UUID == currentUUID
+		} else {
+			node.Current = currentNode == "SnapshotName"+suffix
+		}
+
+		for i := 1; ; i++ {
+			child := build(fmt.Sprintf("%s-%d", suffix, i), node)
+			if child == nil {
+				break
+			}
+			node.Children = append(node.Children, child)
+		}
+		return node
+	}
+
+	return build("", nil)
+}
+
+// Snapshots returns the snapshot hierarchy of the vm or nil if it has no snapshots
+func (vb *VBox) Snapshots(vm *VirtualMachine) (*SnapshotTree, error) {
+	return vb.snapshots(context.Background(), vm)
+}
+
+func (vb *VBox) snapshots(ctx context.Context, vm *VirtualMachine) (*SnapshotTree, error) {
+	out, err := vb.manageWithContext(ctx, "showvminfo", vm.UUIDOrName(), "--machinereadable")
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, ErrMachineNotExist
+	}
+
+	m := parseMachineReadable(out)
+	tree := parseSnapshotTree(m)
+	if tree == nil {
+		return nil, nil
+	}
+
+	path := stringValue(m, "CfgFile")
+	if err := vb.readSnapshotSettings(path, tree); err != nil {
+		glog.V(6).Infof("unable to read snapshot details from %s: %v", path, err)
+	}
+	return tree, nil
+}
+
+// FindSnapshot looks up a snapshot by its uuid, path or name in that order
+func (vb *VBox) FindSnapshot(vm *VirtualMachine, uuidOrPath string) (*SnapshotTree, error) {
+	return vb.findSnapshot(context.Background(), vm, uuidOrPath)
+}
+
+func (vb *VBox) findSnapshot(ctx context.Context, vm *VirtualMachine, uuidOrPath string) (*SnapshotTree, error) {
+	tree, err := vb.snapshots(ctx, vm)
+	if err != nil {
+		return nil, err
+	}
+
+	if node := tree.FindByUUID(uuidOrPath); node != nil {
+		return node, nil
+	}
+	if node := tree.FindByPath(uuidOrPath); node != nil {
+		return node, nil
+	}
+	switch nodes := tree.FindByName(uuidOrPath); len(nodes) {
+	case 0:
+		return nil, NotFoundError(fmt.Sprintf("snapshot %s not found", uuidOrPath))
+	case 1:
+		return nodes[0], nil
+	default:
+		return nil, fmt.Errorf("snapshot name %s is ambiguous, %d snapshots share it", uuidOrPath, len(nodes))
+	}
+}
+
+// TakeSnapshot takes a snapshot of the vm, with live the vm keeps running while the snapshot is taken
+func (vb *VBox) TakeSnapshot(vm *VirtualMachine, snapshot Snapshot, live bool) error {
+	_, err := vb.takeSnapshot(vm, snapshot, live)
+	return err
+}
+
+// takeSnapshot returns the uuid VirtualBox assigned to the new snapshot
+func (vb *VBox) takeSnapshot(vm *VirtualMachine, snapshot Snapshot, live bool) (string, error) {
+	args := []string{"snapshot", vm.UUIDOrName(), "take", snapshot.Name}
+	if snapshot.Description != "" {
+		param := fmt.Sprintf("--description=%s", snapshot.Description)
+		args = append(args, param)
+	}
+
+	if live {
+		args = append(args, "--live")
+	}
+
+	out, err := vb.manage(args...)
+	if err != nil {
+		return "", err
+	}
+
+	if matches := reSnapshotTaken.FindStringSubmatch(out); len(matches) == 2 {
+		return matches[1], nil
+	}
+	return "", nil
+}
+
+// DeleteSnapshot deletes the snapshot identified by its uuid, or its name when the uuid is not set
+func (vb *VBox) DeleteSnapshot(vm *VirtualMachine, snapshot Snapshot) error {
+	_, err := vb.manage("snapshot", vm.UUIDOrName(), "delete", snapshot.UUIDOrName())
+	return err
+}
+
+// RestoreSnapshot restores the snapshot identified by its uuid, or its name when the uuid is not set
+func (vb *VBox) RestoreSnapshot(vm *VirtualMachine, snapshot Snapshot) error {
+	_, err := vb.manage("snapshot", vm.UUIDOrName(), "restore", snapshot.UUIDOrName())
+	return err
+}
+
+func (vb *VBox) EditSnapshot(vm *VirtualMachine, prevSnapshot Snapshot, newSh Snapshot) error {
+	args := []string{"snapshot", vm.UUIDOrName(), "edit", prevSnapshot.UUIDOrName()}
+
+	if newSh.Description != "" && newSh.Description != prevSnapshot.Description {
+		param := fmt.Sprintf("--description=%s", newSh.Description)
+		args = append(args, param)
+	}
+
+	if newSh.Name != "" && newSh.Name != prevSnapshot.Name {
+		args = append(args, "--name", newSh.Name)
+	}
+
+	_, err := vb.manage(args...)
+	return err
+}
+
+// ListOfSnapshots returns the raw output of snapshot list, see Snapshots for the parsed hierarchy
+func (vb *VBox) ListOfSnapshots(vm *VirtualMachine) (string, error) {
+	return vb.manage("snapshot", vm.UUIDOrName(), "list")
+}
+
+func (vb *VBox) showSnapshotInfo(vm *VirtualMachine, snapshot Snapshot) (string, error) {
+	return vb.manage("snapshot", vm.UUIDOrName(), "showvminfo", snapshot.UUIDOrName())
+}
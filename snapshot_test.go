@@ -0,0 +1,141 @@
+package virtualbox
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var snapshotVMInfoOutput = `
+name="testvm1"
+UUID="6aa44e71-71c6-4e68-a61f-f69e133ecffa"
+SnapshotName="base"
+SnapshotUUID="11111111-0000-0000-0000-000000000001"
+SnapshotDescription="golden image"
+SnapshotName-1="nightly"
+SnapshotUUID-1="11111111-0000-0000-0000-000000000002"
+SnapshotName-1-1="fix"
+SnapshotUUID-1-1="11111111-0000-0000-0000-000000000003"
+SnapshotName-2="nightly"
+SnapshotUUID-2="11111111-0000-0000-0000-000000000004"
+CurrentSnapshotName="fix"
+CurrentSnapshotUUID="11111111-0000-0000-0000-000000000003"
+CurrentSnapshotNode="SnapshotName-1-1"
+`
+
+var snapshotSettings = `<?xml version="1.0"?>
+<VirtualBox xmlns="http://www.virtualbox.org/" version="1.16-linux">
+  <Machine uuid="{6aa44e71-71c6-4e68-a61f-f69e133ecffa}" name="testvm1" currentSnapshot="{11111111-0000-0000-0000-000000000003}">
+    <Snapshot uuid="{11111111-0000-0000-0000-000000000001}" name="base" timeStamp="2017-12-10T01:18:02Z">
+      <Description>golden image</Description>
+      <Snapshots>
+        <Snapshot uuid="{11111111-0000-0000-0000-000000000002}" name="nightly" timeStamp="2017-12-11T01:18:02Z">
+          <Snapshots>
+            <Snapshot uuid="{11111111-0000-0000-0000-000000000003}" name="fix" timeStamp="2017-12-12T01:18:02Z" stateFile="Snapshots/{1}.sav"/>
+          </Snapshots>
+        </Snapshot>
+        <Snapshot uuid="{11111111-0000-0000-0000-000000000004}" name="nightly" timeStamp="2017-12-13T01:18:02Z"/>
+      </Snapshots>
+    </Snapshot>
+  </Machine>
+</VirtualBox>
+`
+
+func TestParseSnapshotTree(t *testing.T) {
+	tree := parseSnapshotTree(parseMachineReadable(snapshotVMInfoOutput))
+	if tree == nil {
+		t.Fatalf("expected a snapshot tree, got none")
+	}
+
+	if tree.Name != "base" || tree.Description != "golden image" || len(tree.Children) != 2 {
+		t.Errorf("unexpected root %+v", tree)
+	}
+
+	if got := len(tree.Flatten()); got != 4 {
+		t.Errorf("expected 4 snapshots, got %d", got)
+	}
+
+	current := tree.FindCurrent()
+	if current == nil || current.UUID != "11111111-0000-0000-0000-000000000003" {
+		t.Fatalf("expected fix to be current, got %+v", current)
+	}
+	if current.Path() != "base/nightly/fix" {
+		t.Errorf("expected path base/nightly/fix, got %s", current.Path())
+	}
+	if current.ParentUUID != "11111111-0000-0000-0000-000000000002" {
+		t.Errorf("expected parent uuid to be set, got %s", current.ParentUUID)
+	}
+
+	if nodes := tree.FindByName("nightly"); len(nodes) != 2 {
+		t.Errorf("expected 2 snapshots named nightly, got %d", len(nodes))
+	}
+
+	if node := tree.FindByUUID("11111111-0000-0000-0000-000000000004"); node == nil || len(node.Children) != 0 {
+		t.Errorf("expected to find the second nightly by uuid, got %+v", node)
+	}
+
+	if node := tree.FindByPath("base/nightly/fix"); node != current {
+		t.Errorf("expected path lookup to find the current snapshot, got %+v", node)
+	}
+
+	if node := tree.FindByPath("base/missing"); node != nil {
+		t.Errorf("expected no snapshot, got %+v", node)
+	}
+}
+
+func TestParseSnapshotTreeWithoutUUIDs(t *testing.T) {
+	out := `
+SnapshotName="base"
+SnapshotName-1="nightly"
+SnapshotName-1-1="fix"
+SnapshotName-2="nightly"
+CurrentSnapshotName="nightly"
+CurrentSnapshotNode="SnapshotName-2"
+`
+	tree := parseSnapshotTree(parseMachineReadable(out))
+	current := tree.FindCurrent()
+	if current == nil || current.Path() != "base/nightly" || len(current.Children) != 0 {
+		t.Fatalf("expected the second nightly to be current, got %+v", current)
+	}
+	if tree.Children[0].Current || tree.Children[0].Children[0].Current {
+		t.Errorf("expected a single current snapshot")
+	}
+}
+
+func TestParseSnapshotTreeNoSnapshots(t *testing.T) {
+	if tree := parseSnapshotTree(parseMachineReadable(showVmInfoOutput)); tree != nil {
+		t.Errorf("expected no snapshot tree, got %+v", tree)
+	}
+}
+
+func TestReadSnapshotSettings(t *testing.T) {
+	dirName, err := ioutil.TempDir("", "vbm")
+	if err != nil {
+		t.Fatalf("Tempdir creation failed %v", err)
+	}
+	defer os.RemoveAll(dirName)
+
+	path := filepath.Join(dirName, "testvm1.vbox")
+	if err := ioutil.WriteFile(path, []byte(snapshotSettings), 0644); err != nil {
+		t.Fatalf("writing settings failed %v", err)
+	}
+
+	var vb VBox
+	tree := parseSnapshotTree(parseMachineReadable(snapshotVMInfoOutput))
+	if err := vb.readSnapshotSettings(path, tree); err != nil {
+		t.Fatalf("reading settings failed %v", err)
+	}
+
+	fix := tree.FindByUUID("11111111-0000-0000-0000-000000000003")
+	if !fix.Online {
+		t.Errorf("expected snapshot with a state file to be online")
+	}
+	if expected := time.Date(2017, 12, 12, 1, 18, 2, 0, time.UTC); !fix.Created.Equal(expected) {
+		t.Errorf("expected created %v, got %v", expected, fix.Created)
+	}
+	if tree.Online {
+		t.Errorf("expected root snapshot to be offline")
+	}
+}
@@ -0,0 +1,253 @@
+package virtualbox
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SpecSection groups the differences reported by DiffSnapshots
+type SpecSection string
+
+const (
+	HardwareSection = SpecSection("hardware")
+	NetworkSection  = SpecSection("network")
+	StorageSection  = SpecSection("storage")
+)
+
+// SpecDiff is a single setting that differs between two specs, Old or New is empty when the setting only exists on one side
+type SpecDiff struct {
+	Section SpecSection
+	// Path identifies the setting, for e.g memory, nic/1/mode or disk/SATA1/0/0
+	Path string
+	Old  string
+	New  string
+}
+
+func (d SpecDiff) String() string {
+	return fmt.Sprintf("%s %s: %q -> %q", d.Section, d.Path, d.Old, d.New)
+}
+
+// settingsPath returns the settings file of the vm as reported by VirtualBox
+func (vb *VBox) settingsPath(ctx context.Context, vm *VirtualMachine) (string, error) {
+	out, err := vb.manageWithContext(ctx, "showvminfo", vm.UUIDOrName(), "--machinereadable")
+	if err != nil && ctx.Err() != nil {
+		return "", ctx.Err()
+	}
+	if err != nil {
+		return "", ErrMachineNotExist
+	}
+	return stringValue(parseMachineReadable(out), "CfgFile"), nil
+}
+
+// readVMSettings reads the settings file of the vm, unless the context is done by the time its path is known
+func (vb *VBox) readVMSettings(ctx context.Context, vm *VirtualMachine) (string, *settingsFile, error) {
+	path, err := vb.settingsPath(ctx, vm)
+	if err != nil {
+		return "", nil, err
+	}
+	if ctx.Err() != nil {
+		return "", nil, ctx.Err()
+	}
+
+	settings, err := readSettingsFile(path)
+	if err != nil {
+		return "", nil, OperationError{Path: path, Op: "READ", Err: err}
+	}
+	return path, settings, nil
+}
+
+// SnapshotSpec returns the configuration stored with a snapshot, looked up by uuid, path or name as in FindSnapshot.
+// The configuration is read from the settings file since VirtualBox only prints it as free form text.
+// Disks are reported by the base medium of their chain, not by the differencing image the snapshot uses
+func (vb *VBox) SnapshotSpec(ctx context.Context, vm *VirtualMachine, snapshot string) (*VirtualMachineSpec, error) {
+	node, err := vb.findSnapshot(ctx, vm, snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	path, settings, err := vb.readVMSettings(ctx, vm)
+	if err != nil {
+		return nil, err
+	}
+
+	spec, err := settings.machineSpec(path, node.UUID)
+	if err != nil {
+		return nil, err
+	}
+	spec.Snapshots = []Snapshot{node.Snapshot}
+	spec.CurrentSnapshot = node.Snapshot
+	return spec, nil
+}
+
+// DiffSnapshotToCurrent reports what changed in the vm since the snapshot was taken
+func (vb *VBox) DiffSnapshotToCurrent(ctx context.Context, vm *VirtualMachine, snapshot string) ([]SpecDiff, error) {
+	old, err := vb.SnapshotSpec(ctx, vm, snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	// read the current state from the same source so both sides are described the same way
+	path, settings, err := vb.readVMSettings(ctx, vm)
+	if err != nil {
+		return nil, err
+	}
+	current, err := settings.machineSpec(path, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return DiffSnapshots(*old, *current), nil
+}
+
+// DiffSnapshots compares the hardware, network and storage configuration of two specs.
+// NICs are matched by index, storage controllers by name and disks by their controller slot
+func DiffSnapshots(a, b VirtualMachineSpec) []SpecDiff {
+	var diffs []SpecDiff
+	add := func(section SpecSection, path, old, new string) {
+		if old != new {
+			diffs = append(diffs, SpecDiff{Section: section, Path: path, Old: old, New: new})
+		}
+	}
+
+	add(HardwareSection, "ostype", a.OSType.ID, b.OSType.ID)
+	add(HardwareSection, "cpus", strconv.Itoa(a.CPU.Count), strconv.Itoa(b.CPU.Count))
+	add(HardwareSection, "memory", strconv.Itoa(a.Memory.SizeMB), strconv.Itoa(b.Memory.SizeMB))
+	add(HardwareSection, "boot", bootOrder(a.Boot), bootOrder(b.Boot))
+
+	var keys []string
+	nicsA, nicsB := map[string]NIC{}, map[string]NIC{}
+	for _, n := range a.NICs {
+		nicsA[strconv.Itoa(n.Index)] = n
+		keys = append(keys, strconv.Itoa(n.Index))
+	}
+	for _, n := range b.NICs {
+		nicsB[strconv.Itoa(n.Index)] = n
+		keys = append(keys, strconv.Itoa(n.Index))
+	}
+	for _, k := range sortedUnique(keys) {
+		na, okA := nicsA[k]
+		nb, okB := nicsB[k]
+		prefix := "nic/" + k
+		if !okA || !okB {
+			add(NetworkSection, prefix, describeNIC(na, okA), describeNIC(nb, okB))
+			continue
+		}
+		add(NetworkSection, prefix+"/mode", string(na.Mode), string(nb.Mode))
+		add(NetworkSection, prefix+"/network", na.NetworkName, nb.NetworkName)
+		add(NetworkSection, prefix+"/type", string(na.Type), string(nb.Type))
+		add(NetworkSection, prefix+"/mac", na.MAC, nb.MAC)
+		add(NetworkSection, prefix+"/cableconnected", strconv.FormatBool(na.CableConnected), strconv.FormatBool(nb.CableConnected))
+		add(NetworkSection, prefix+"/portforwarding", describeRules(na.PortForwarding), describeRules(nb.PortForwarding))
+	}
+
+	keys = nil
+	ctlsA, ctlsB := map[string]StorageController{}, map[string]StorageController{}
+	for _, c := range a.StorageControllers {
+		ctlsA[c.Name] = c
+		keys = append(keys, c.Name)
+	}
+	for _, c := range b.StorageControllers {
+		ctlsB[c.Name] = c
+		keys = append(keys, c.Name)
+	}
+	for _, k := range sortedUnique(keys) {
+		ca, okA := ctlsA[k]
+		cb, okB := ctlsB[k]
+		prefix := "storagecontroller/" + k
+		if !okA || !okB {
+			add(StorageSection, prefix, describeController(ca, okA), describeController(cb, okB))
+			continue
+		}
+		add(StorageSection, prefix+"/type", string(ca.Type), string(cb.Type))
+		add(StorageSection, prefix+"/portcount", strconv.Itoa(ca.PortCount), strconv.Itoa(cb.PortCount))
+		add(StorageSection, prefix+"/bootable", ca.Bootable, cb.Bootable)
+	}
+
+	keys = nil
+	disksA, disksB := map[string]Disk{}, map[string]Disk{}
+	for _, d := range a.Disks {
+		disksA[diskSlot(d)] = d
+		keys = append(keys, diskSlot(d))
+	}
+	for _, d := range b.Disks {
+		disksB[diskSlot(d)] = d
+		keys = append(keys, diskSlot(d))
+	}
+	for _, k := range sortedUnique(keys) {
+		da, okA := disksA[k]
+		db, okB := disksB[k]
+		prefix := "disk/" + k
+		if !okA || !okB {
+			add(StorageSection, prefix, describeDisk(da, okA), describeDisk(db, okB))
+			continue
+		}
+		add(StorageSection, prefix+"/type", string(da.Type), string(db.Type))
+		add(StorageSection, prefix+"/medium", da.UUIDorPath(), db.UUIDorPath())
+		add(StorageSection, prefix+"/nonrotational", strconv.FormatBool(da.NonRotational), strconv.FormatBool(db.NonRotational))
+		add(StorageSection, prefix+"/discard", strconv.FormatBool(da.AutoDiscard), strconv.FormatBool(db.AutoDiscard))
+	}
+
+	return diffs
+}
+
+func sortedUnique(keys []string) []string {
+	seen := map[string]bool{}
+	unique := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if !seen[k] {
+			seen[k] = true
+			unique = append(unique, k)
+		}
+	}
+	sort.Strings(unique)
+	return unique
+}
+
+func diskSlot(d Disk) string {
+	return fmt.Sprintf("%s/%d/%d", d.Controller.Name, d.Controller.Port, d.Controller.Device)
+}
+
+func bootOrder(devices []BootDevice) string {
+	elems := make([]string, len(devices))
+	for i, d := range devices {
+		elems[i] = string(d)
+	}
+	return strings.Join(elems, ",")
+}
+
+func describeNIC(n NIC, ok bool) string {
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("%s %s", n.Mode, n.NetworkName)
+}
+
+func describeController(c StorageController, ok bool) string {
+	if !ok {
+		return ""
+	}
+	desc := fmt.Sprintf("%s %s ports=%d", c.Type, c.Chipset, c.PortCount)
+	if c.HostIOCache != "" {
+		desc += " hostiocache=" + c.HostIOCache
+	}
+	return desc
+}
+
+func describeDisk(d Disk, ok bool) string {
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("%s %s", d.Type, d.UUIDorPath())
+}
+
+func describeRules(rules []PortForwarding) string {
+	elems := make([]string, len(rules))
+	for i, r := range rules {
+		elems[i] = fmt.Sprintf("%s,%s,%s,%d,%s,%d", r.Name, r.Protocol, r.HostIP, r.HostPort, r.GuestIP, r.GuestPort)
+	}
+	sort.Strings(elems)
+	return strings.Join(elems, ";")
+}
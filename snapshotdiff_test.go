@@ -0,0 +1,190 @@
+package virtualbox
+
+import (
+	"context"
+	"encoding/xml"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var snapshotDiffSettings = `<?xml version="1.0"?>
+<VirtualBox xmlns="http://www.virtualbox.org/" version="1.16-linux">
+  <Machine uuid="{6aa44e71-71c6-4e68-a61f-f69e133ecffa}" name="testvm1" OSType="Linux_64" currentSnapshot="{11111111-0000-0000-0000-000000000001}">
+    <MediaRegistry>
+      <HardDisks>
+        <HardDisk uuid="{38f0cf9d-6c60-4f59-ba0b-cd1dfb5329d6}" location="disk1.vdi" format="VDI" type="Normal">
+          <HardDisk uuid="{22222222-0000-0000-0000-000000000001}" location="Snapshots/{22222222-0000-0000-0000-000000000001}.vdi" format="VDI"/>
+        </HardDisk>
+        <HardDisk uuid="{38f0cf9d-6c60-4f59-ba0b-cd1dfb5329d7}" location="/data/disk2.vdi" format="VDI" type="Normal"/>
+      </HardDisks>
+    </MediaRegistry>
+    <Snapshot uuid="{11111111-0000-0000-0000-000000000001}" name="base" timeStamp="2017-12-10T01:18:02Z">
+      <Hardware>
+        <CPU count="2"/>
+        <Memory RAMSize="1000"/>
+        <Boot>
+          <Order position="1" device="HardDisk"/>
+          <Order position="2" device="None"/>
+        </Boot>
+        <Network>
+          <Adapter slot="0" enabled="true" MACAddress="080027220665" type="82540EM">
+            <NAT/>
+          </Adapter>
+        </Network>
+      </Hardware>
+      <StorageControllers>
+        <StorageController name="SATA1" type="AHCI" PortCount="30" Bootable="true">
+          <AttachedDevice type="HardDisk" port="0" device="0">
+            <Image uuid="{38f0cf9d-6c60-4f59-ba0b-cd1dfb5329d6}"/>
+          </AttachedDevice>
+        </StorageController>
+      </StorageControllers>
+    </Snapshot>
+    <Hardware>
+      <CPU count="4"/>
+      <Memory RAMSize="1000"/>
+      <Boot>
+        <Order position="1" device="HardDisk"/>
+        <Order position="2" device="None"/>
+      </Boot>
+      <Network>
+        <Adapter slot="0" enabled="true" MACAddress="080027220665" type="82540EM">
+          <NAT>
+            <Forwarding name="ssh" proto="1" hostport="2222" guestport="22"/>
+          </NAT>
+        </Adapter>
+        <Adapter slot="1" enabled="true" MACAddress="080027220666" type="virtio">
+          <HostOnlyInterface name="vboxnet0"/>
+        </Adapter>
+        <Adapter slot="2" enabled="false" type="82540EM"/>
+      </Network>
+    </Hardware>
+    <StorageControllers>
+      <StorageController name="SATA1" type="AHCI" PortCount="30" Bootable="true">
+        <AttachedDevice type="HardDisk" port="0" device="0">
+          <Image uuid="{22222222-0000-0000-0000-000000000001}"/>
+        </AttachedDevice>
+        <AttachedDevice type="HardDisk" port="1" device="0" nonrotational="true">
+          <Image uuid="{38f0cf9d-6c60-4f59-ba0b-cd1dfb5329d7}"/>
+        </AttachedDevice>
+      </StorageController>
+    </StorageControllers>
+  </Machine>
+</VirtualBox>
+`
+
+func TestSettingsMachineSpec(t *testing.T) {
+	var settings settingsFile
+	if err := xml.Unmarshal([]byte(snapshotDiffSettings), &settings); err != nil {
+		t.Fatalf("unmarshal failed %v", err)
+	}
+
+	current, err := settings.machineSpec("/vms/testvm1/testvm1.vbox", "")
+	if err != nil {
+		t.Fatalf("reading current spec failed %v", err)
+	}
+
+	if current.CPU.Count != 4 || current.Memory.SizeMB != 1000 || current.OSType.ID != "Linux_64" {
+		t.Errorf("unexpected hardware %+v", current)
+	}
+	if len(current.NICs) != 2 || current.NICs[1].Mode != NWMode_hostonly || current.NICs[1].NetworkName != "vboxnet0" {
+		t.Errorf("unexpected nics %+v", current.NICs)
+	}
+	if len(current.StorageControllers) != 1 || current.StorageControllers[0].Type != SATA {
+		t.Errorf("unexpected storage controllers %+v", current.StorageControllers)
+	}
+	if len(current.Disks) != 2 {
+		t.Fatalf("expected 2 disks, got %+v", current.Disks)
+	}
+	// the differencing image resolves to its base
+	if d := current.Disks[0]; d.UUID != "38f0cf9d-6c60-4f59-ba0b-cd1dfb5329d6" || d.Path != "/vms/testvm1/disk1.vdi" {
+		t.Errorf("expected base medium, got %+v", d)
+	}
+	if !current.Disks[1].NonRotational {
+		t.Errorf("expected second disk to be non rotational")
+	}
+
+	if _, err := settings.machineSpec("/vms/testvm1/testvm1.vbox", "missing"); err == nil {
+		t.Errorf("expected an error for an unknown snapshot")
+	}
+}
+
+func TestDiffSnapshots(t *testing.T) {
+	var settings settingsFile
+	if err := xml.Unmarshal([]byte(snapshotDiffSettings), &settings); err != nil {
+		t.Fatalf("unmarshal failed %v", err)
+	}
+
+	base, err := settings.machineSpec("/vms/testvm1/testvm1.vbox", "11111111-0000-0000-0000-000000000001")
+	if err != nil {
+		t.Fatalf("reading snapshot spec failed %v", err)
+	}
+	current, err := settings.machineSpec("/vms/testvm1/testvm1.vbox", "")
+	if err != nil {
+		t.Fatalf("reading current spec failed %v", err)
+	}
+
+	diffs := DiffSnapshots(*base, *current)
+
+	expected := map[string]SpecSection{
+		"cpus":                 HardwareSection,
+		"nic/1/portforwarding": NetworkSection,
+		"nic/2":                NetworkSection,
+		"disk/SATA1/1/0":       StorageSection,
+	}
+	if len(diffs) != len(expected) {
+		t.Errorf("expected %d differences, got %v", len(expected), diffs)
+	}
+	for _, d := range diffs {
+		if section, ok := expected[d.Path]; !ok || section != d.Section {
+			t.Errorf("unexpected difference %s", d)
+		}
+	}
+
+	if diffs := DiffSnapshots(*current, *current); len(diffs) != 0 {
+		t.Errorf("expected no differences, got %v", diffs)
+	}
+}
+
+func TestDiffSnapshotToCurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vbm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "testvm1.vbox")
+	if err := ioutil.WriteFile(path, []byte(snapshotDiffSettings), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	calls := 0
+	vb := &VBox{run: func(ctx context.Context, args ...string) (string, error) {
+		calls++
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return "CfgFile=\"" + path + "\"\nSnapshotName=\"base\"\nSnapshotUUID=\"11111111-0000-0000-0000-000000000001\"\n", nil
+	}}
+	vm := &VirtualMachine{Spec: VirtualMachineSpec{Name: "testvm1"}}
+
+	diffs, err := vb.DiffSnapshotToCurrent(context.Background(), vm, "base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) == 0 {
+		t.Errorf("expected the current spec to differ from the snapshot")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	calls = 0
+	if _, err := vb.DiffSnapshotToCurrent(ctx, vm, "base"); err != context.Canceled {
+		t.Errorf("expected the cancelled context to stop the diff, got %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("expected to stop at the first VBoxManage call, got %d calls", calls)
+	}
+}
@@ -0,0 +1,330 @@
+package virtualbox
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// chipsetTypes maps every chipset, as printed by showvminfo or stored in the settings file, to its bus
+var chipsetTypes = map[StorageControllerChipset]StorageControllerType{
+	PIIX3:        IDE,
+	PIIX4:        IDE,
+	ICH6:         IDE,
+	IntelAhci:    SATA,
+	"AHCI":       SATA,
+	LsiLogic:     SCSI,
+	BusLogic:     SCSI,
+	LsiLogicSas:  SAS,
+	NVMe:         NVME,
+	VirtIO:       VirtioSCSI,
+	"VirtioSCSI": VirtioSCSI,
+	USBChipset:   USB,
+	I82078:       Floppy,
+}
+
+// Type returns the bus the chipset belongs to
+func (c StorageControllerChipset) Type() StorageControllerType {
+	if t, ok := chipsetTypes[c]; ok {
+		return t
+	}
+	return StorageControllerType(c)
+}
+
+// normalize maps the names used in settings files and showvminfo onto the chipset constants
+func (c StorageControllerChipset) normalize() StorageControllerChipset {
+	switch c {
+	case "AHCI":
+		return IntelAhci
+	case "VirtioSCSI":
+		return VirtIO
+	}
+	return c
+}
+
+// ForAdd returns the bus name storagectl --add expects
+func (t StorageControllerType) ForAdd() string {
+	switch t {
+	case IDE:
+		return "ide"
+	case SATA:
+		return "sata"
+	case SCSI:
+		return "scsi"
+	case SAS:
+		return "sas"
+	case NVME:
+		return "pcie"
+	case VirtioSCSI:
+		return "virtio-scsi"
+	case USB:
+		return "usb"
+	case Floppy:
+		return "floppy"
+	}
+	return ""
+}
+
+// MaxPorts is the largest port count the bus supports, 0 when the type is unknown and the count is not limited
+func (t StorageControllerType) MaxPorts() int {
+	switch t {
+	case IDE:
+		return 2
+	case SATA:
+		return 30
+	case SCSI:
+		return 16
+	case SAS, NVME:
+		return 255
+	case VirtioSCSI:
+		return 256
+	case USB:
+		return 8
+	case Floppy:
+		return 1
+	}
+	return 0
+}
+
+// DevicesPerPort is the number of devices each port takes, master and slave on IDE, two drives on floppy
+func (t StorageControllerType) DevicesPerPort() int {
+	if t == IDE || t == Floppy {
+		return 2
+	}
+	return 1
+}
+
+// defaultPorts is the port count VirtualBox gives a new controller of the type
+func (t StorageControllerType) defaultPorts() int {
+	switch t {
+	case SATA:
+		return 30
+	case SCSI:
+		return 16
+	case SAS, USB:
+		return 8
+	case IDE:
+		return 2
+	}
+	return 1
+}
+
+// portOrder returns the ports in the order drives of the given type fill them. On IDE hard disks go to the primary
+// channel and removable drives to the secondary one, as VirtualBox does itself. Controllers of an unknown type
+// offer the first n ports
+func (t StorageControllerType) portOrder(d DiskType, n int) []int {
+	if t == IDE && d != HDDrive {
+		return []int{1, 0}
+	}
+	if max := t.MaxPorts(); max > 0 {
+		n = max
+	}
+	ports := make([]int, n)
+	for i := range ports {
+		ports[i] = i
+	}
+	return ports
+}
+
+func sameMedium(a, b Disk) bool {
+	return (a.UUID != "" && a.UUID == b.UUID) || (a.Path != "" && a.Path == b.Path)
+}
+
+// assignStorageSlots places the disks on the ports of their controllers. Pinned slots are kept, disks the vm
+// already has attached keep their slot and the rest take the next free one, hard disks ahead of removable drives.
+// existing holds the current attachments of the vm, if it exists. Controllers grow their PortCount as needed
+func assignStorageSlots(controllers []StorageController, disks []Disk, existing []Disk, verr *ValidationErrors) {
+	ctls := map[string]*StorageController{}
+	for i := range controllers {
+		ctls[controllers[i].Name] = &controllers[i]
+	}
+
+	// slots in use, by whom
+	used := map[string]string{}
+	for _, e := range existing {
+		owned := false
+		for _, d := range disks {
+			owned = owned || sameMedium(d, e)
+		}
+		if !owned {
+			used[diskSlot(e)] = "attached " + e.UUIDorPath()
+		}
+	}
+
+	// inRange reports slots outside the limits of the controller
+	inRange := func(i int, ctl *StorageController) bool {
+		d := disks[i]
+		path := fmt.Sprintf("disk/%d", i)
+		if max := ctl.Type.MaxPorts(); d.Controller.Port < 0 || (max > 0 && d.Controller.Port >= max) {
+			verr.Add(path, fmt.Errorf("port %d is out of range, %s controllers have %d ports", d.Controller.Port, ctl.Type, ctl.Type.MaxPorts()))
+			return false
+		}
+		if d.Controller.Device < 0 || d.Controller.Device >= ctl.Type.DevicesPerPort() {
+			verr.Add(path, fmt.Errorf("device %d is out of range, %s controllers have %d devices per port", d.Controller.Device, ctl.Type, ctl.Type.DevicesPerPort()))
+			return false
+		}
+		return true
+	}
+
+	var reused, pending []int
+	for i := range disks {
+		d := &disks[i]
+		ctl, ok := ctls[d.Controller.Name]
+		if !ok {
+			verr.Add(fmt.Sprintf("disk/%d", i), fmt.Errorf("storagecontroller ref %s did not resolve", d.Controller.Name))
+			continue
+		}
+		d.Controller.Type = ctl.Type
+
+		if d.Controller.Pinned || d.Controller.Port != 0 || d.Controller.Device != 0 {
+			if !inRange(i, ctl) {
+				continue
+			}
+			if owner, ok := used[diskSlot(*d)]; ok {
+				verr.Add(fmt.Sprintf("disk/%d", i), fmt.Errorf("port %d device %d of %s is already used by %s", d.Controller.Port, d.Controller.Device, ctl.Name, owner))
+				continue
+			}
+			used[diskSlot(*d)] = d.UUIDorPath()
+			continue
+		}
+
+		found := false
+		for _, e := range existing {
+			if sameMedium(*d, e) && e.Controller.Name == ctl.Name {
+				d.Controller.Port, d.Controller.Device = e.Controller.Port, e.Controller.Device
+				found = true
+				break
+			}
+		}
+		if found {
+			reused = append(reused, i)
+		} else {
+			pending = append(pending, i)
+		}
+	}
+
+	// a disk whose old slot got pinned by another one moves like a new disk
+	for _, i := range reused {
+		if _, ok := used[diskSlot(disks[i])]; ok {
+			pending = append(pending, i)
+			continue
+		}
+		used[diskSlot(disks[i])] = disks[i].UUIDorPath()
+	}
+
+	sort.SliceStable(pending, func(a, b int) bool {
+		return disks[pending[a]].Type == HDDrive && disks[pending[b]].Type != HDDrive
+	})
+	for _, i := range pending {
+		d := &disks[i]
+		ctl := ctls[d.Controller.Name]
+
+		placed := false
+		for _, port := range ctl.Type.portOrder(d.Type, len(disks)+len(existing)) {
+			for device := 0; device < ctl.Type.DevicesPerPort() && !placed; device++ {
+				d.Controller.Port, d.Controller.Device = port, device
+				if _, ok := used[diskSlot(*d)]; !ok {
+					used[diskSlot(*d)] = d.UUIDorPath()
+					placed = true
+				}
+			}
+			if placed {
+				break
+			}
+		}
+		if !placed {
+			verr.Add(fmt.Sprintf("disk/%d", i), fmt.Errorf("no free port left on %s, %s controllers have %d ports", ctl.Name, ctl.Type, ctl.Type.MaxPorts()))
+		}
+	}
+
+	// grow the controllers to fit the highest port in use
+	for i := range disks {
+		ctl, ok := ctls[disks[i].Controller.Name]
+		if !ok || ctl.Type == IDE || ctl.Type == Floppy {
+			continue
+		}
+		ports := ctl.PortCount
+		if ports == 0 {
+			ports = ctl.Type.defaultPorts()
+		}
+		if need := disks[i].Controller.Port + 1; need > ports {
+			ctl.PortCount = need
+		}
+	}
+}
+
+// storageControllerArgs builds the storagectl options shared by adding and modifying a controller
+func storageControllerArgs(ctr StorageController) ([]string, error) {
+	var args []string
+	if ctr.Chipset != "" {
+		if t := ctr.Chipset.Type(); ctr.Type != "" && t != ctr.Type {
+			return nil, fmt.Errorf("chipset %s is a %s controller, not %s", ctr.Chipset, t, ctr.Type)
+		}
+		args = append(args, "--controller", string(ctr.Chipset))
+	}
+	if ctr.PortCount > 0 {
+		t := ctr.Type
+		if t == "" {
+			t = ctr.Chipset.Type()
+		}
+		if max := t.MaxPorts(); max > 0 && ctr.PortCount > max {
+			return nil, fmt.Errorf("%s controllers support up to %d ports, got %d", t, max, ctr.PortCount)
+		}
+		args = append(args, "--portcount", strconv.Itoa(ctr.PortCount))
+	}
+	if ctr.HostIOCache != "" {
+		args = append(args, "--hostiocache", ctr.HostIOCache)
+	}
+	if ctr.Bootable != "" {
+		args = append(args, "--bootable", ctr.Bootable)
+	}
+	return args, nil
+}
+
+func (vb *VBox) AddStorageController(vm *VirtualMachine, ctr StorageController) error {
+	bus := ctr.Type.ForAdd()
+	if bus == "" {
+		return fmt.Errorf("unknown storage controller type %q", ctr.Type)
+	}
+	opts, err := storageControllerArgs(ctr)
+	if err != nil {
+		return err
+	}
+
+	args := append([]string{"storagectl", vm.UUIDOrName(), "--name", ctr.Name, "--add", bus}, opts...)
+	if _, err := vb.manage(args...); err != nil {
+		if isAlreadyExistErrorMessage(err.Error()) {
+			return AlreadyExists(ctr.Name)
+		}
+		return err
+	}
+	return nil
+}
+
+// ModifyStorageController applies the chipset, port count, host i/o cache and bootable flag of ctr to the existing
+// controller of the same name, fields left empty are not changed
+func (vb *VBox) ModifyStorageController(vm *VirtualMachine, ctr StorageController) error {
+	opts, err := storageControllerArgs(ctr)
+	if err != nil {
+		return err
+	}
+	if len(opts) == 0 {
+		return fmt.Errorf("no storage controller settings to change")
+	}
+
+	_, err = vb.manage(append([]string{"storagectl", vm.UUIDOrName(), "--name", ctr.Name}, opts...)...)
+	return err
+}
+
+// RenameStorageController renames the controller, the media attached to it stay attached
+func (vb *VBox) RenameStorageController(vm *VirtualMachine, name, newName string) error {
+	_, err := vb.manage("storagectl", vm.UUIDOrName(), "--name", name, "--rename", newName)
+	return err
+}
+
+// RemoveStorageController removes the controller together with the attachments of its media, the media themselves
+// stay registered
+func (vb *VBox) RemoveStorageController(vm *VirtualMachine, name string) error {
+	_, err := vb.manage("storagectl", vm.UUIDOrName(), "--name", name, "--remove")
+	return err
+}
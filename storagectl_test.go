@@ -0,0 +1,279 @@
+package virtualbox
+
+import (
+	"context"
+	"encoding/xml"
+	"reflect"
+	"testing"
+)
+
+func TestChipsetType(t *testing.T) {
+	for chipset, expected := range map[StorageControllerChipset]StorageControllerType{
+		PIIX4:        IDE,
+		IntelAhci:    SATA,
+		"AHCI":       SATA,
+		BusLogic:     SCSI,
+		LsiLogicSas:  SAS,
+		NVMe:         NVME,
+		"VirtioSCSI": VirtioSCSI,
+		USBChipset:   USB,
+		I82078:       Floppy,
+	} {
+		if typ := chipset.Type(); typ != expected {
+			t.Errorf("expected %s to be %s, got %s", chipset, expected, typ)
+		}
+		if expected.ForAdd() == "" {
+			t.Errorf("expected a bus name for %s", expected)
+		}
+	}
+
+	if SCSCI != SCSI {
+		t.Errorf("expected the old SCSCI name to refer to SCSI")
+	}
+}
+
+func TestStorageControllerArgs(t *testing.T) {
+	args, err := storageControllerArgs(StorageController{
+		Name:        "SCSI1",
+		Type:        SCSI,
+		Chipset:     BusLogic,
+		PortCount:   8,
+		HostIOCache: "on",
+		Bootable:    "off",
+	})
+	expected := []string{"--controller", "BusLogic", "--portcount", "8", "--hostiocache", "on", "--bootable", "off"}
+	if err != nil || !reflect.DeepEqual(args, expected) {
+		t.Errorf("expected %v, got %v %v", expected, args, err)
+	}
+
+	if _, err := storageControllerArgs(StorageController{Type: SATA, Chipset: PIIX4}); err == nil {
+		t.Errorf("expected an error for an IDE chipset on a SATA controller")
+	}
+	if _, err := storageControllerArgs(StorageController{Type: IDE, PortCount: 4}); err == nil {
+		t.Errorf("expected an error for too many IDE ports")
+	}
+}
+
+func TestSettingsStorageControllers(t *testing.T) {
+	var settings settingsFile
+	if err := xml.Unmarshal([]byte(`<VirtualBox>
+  <Machine uuid="{6aa44e71-71c6-4e68-a61f-f69e133ecffa}" name="testvm1">
+    <StorageControllers>
+      <StorageController name="SATA1" type="AHCI" PortCount="4" useHostIOCache="false" Bootable="true"/>
+      <StorageController name="SCSI1" type="LsiLogic" PortCount="16" useHostIOCache="true" Bootable="false"/>
+    </StorageControllers>
+  </Machine>
+</VirtualBox>`), &settings); err != nil {
+		t.Fatalf("unmarshal failed %v", err)
+	}
+
+	spec, err := settings.machineSpec("/vms/testvm1/testvm1.vbox", "")
+	if err != nil {
+		t.Fatalf("reading spec failed %v", err)
+	}
+	expected := []StorageController{
+		{Name: "SATA1", Type: SATA, Chipset: IntelAhci, PortCount: 4, Bootable: "on", HostIOCache: "off"},
+		{Name: "SCSI1", Type: SCSI, Chipset: LsiLogic, PortCount: 16, Bootable: "off", HostIOCache: "on"},
+	}
+	if !reflect.DeepEqual(spec.StorageControllers, expected) {
+		t.Errorf("expected %+v, got %+v", expected, spec.StorageControllers)
+	}
+
+	controllers := []StorageController{{Name: "SCSI1"}, {Name: "IDE1"}}
+	settings.Machine.applySettings("/vms/testvm1/testvm1.vbox", &VirtualMachineSpec{StorageControllers: controllers})
+	if controllers[0].HostIOCache != "on" || controllers[1].HostIOCache != "" {
+		t.Errorf("unexpected host i/o cache %+v", controllers)
+	}
+}
+
+func TestAssignStorageSlots(t *testing.T) {
+	controllers := []StorageController{
+		{Name: "IDE1", Type: IDE},
+		{Name: "SATA1", Type: SATA, PortCount: 2},
+		{Name: "NVME1", Type: NVME},
+	}
+	disks := []Disk{
+		{Path: "/vms/vm01/install.iso", Type: DVDDrive, Controller: StorageControllerAttachment{Name: "IDE1"}},
+		{Path: "/vms/vm01/ide.vdi", Type: HDDrive, Controller: StorageControllerAttachment{Name: "IDE1"}},
+		{Path: "/vms/vm01/disk1.vdi", Type: HDDrive, Controller: StorageControllerAttachment{Name: "SATA1"}},
+		{Path: "/vms/vm01/disk2.vdi", Type: HDDrive, Controller: StorageControllerAttachment{Name: "SATA1", Pinned: true}},
+		{Path: "/vms/vm01/disk3.vdi", Type: HDDrive, Controller: StorageControllerAttachment{Name: "SATA1"}},
+		{Path: "/vms/vm01/nvme1.vdi", Type: HDDrive, Controller: StorageControllerAttachment{Name: "NVME1"}},
+		{Path: "/vms/vm01/nvme2.vdi", Type: HDDrive, Controller: StorageControllerAttachment{Name: "NVME1"}},
+	}
+	existing := []Disk{
+		// disk1 is already attached and stays where it is
+		{Path: "/vms/vm01/disk1.vdi", Controller: StorageControllerAttachment{Name: "SATA1", Port: 3}},
+		// a medium attached outside of the spec keeps its port
+		{Path: "/vms/other.vdi", Controller: StorageControllerAttachment{Name: "SATA1", Port: 1}},
+	}
+
+	verr := ValidationErrors{}
+	assignStorageSlots(controllers, disks, existing, &verr)
+	if len(verr.Errors()) != 0 {
+		t.Fatalf("unexpected validation errors %v", verr)
+	}
+
+	expected := []string{"IDE1/1/0", "IDE1/0/0", "SATA1/3/0", "SATA1/0/0", "SATA1/2/0", "NVME1/0/0", "NVME1/1/0"}
+	for i, slot := range expected {
+		if diskSlot(disks[i]) != slot {
+			t.Errorf("expected disk %d at %s, got %s", i, slot, diskSlot(disks[i]))
+		}
+	}
+	if controllers[1].PortCount != 4 || controllers[2].PortCount != 2 {
+		t.Errorf("expected controllers to grow, got %+v", controllers)
+	}
+}
+
+func TestAssignStorageSlotsConflicts(t *testing.T) {
+	controllers := []StorageController{{Name: "IDE1", Type: IDE}, {Name: "SATA1", Type: SATA}}
+	disks := []Disk{
+		{Path: "/a.vdi", Controller: StorageControllerAttachment{Name: "SATA1", Port: 4}},
+		{Path: "/b.vdi", Controller: StorageControllerAttachment{Name: "SATA1", Port: 4}},
+		{Path: "/c.vdi", Controller: StorageControllerAttachment{Name: "IDE1", Port: 2}},
+		{Path: "/d.vdi", Controller: StorageControllerAttachment{Name: "SCSI1"}},
+	}
+
+	verr := ValidationErrors{}
+	assignStorageSlots(controllers, disks, nil, &verr)
+
+	paths := map[string]bool{}
+	for _, e := range verr.Errors() {
+		paths[e.Path] = true
+	}
+	if len(verr.Errors()) != 3 || !paths["disk/1"] || !paths["disk/2"] || !paths["disk/3"] {
+		t.Errorf("expected conflicts for disks 1 to 3, got %v", verr)
+	}
+}
+
+func TestAttachmentArgs(t *testing.T) {
+	disk := &Disk{
+		NonRotational:  true,
+		AutoDiscard:    true,
+		MediumType:     WritethroughMedium,
+		Comment:        "scratch disk",
+		SetUUID:        "38f0cf9d-6c60-4f59-ba0b-cd1dfb5329d6",
+		BandwidthGroup: "slowdisk",
+		Controller:     StorageControllerAttachment{HotPluggable: true},
+	}
+	expected := []string{
+		"--nonrotational", "on",
+		"--discard", "on",
+		"--hotpluggable", "on",
+		"--mtype", "writethrough",
+		"--comment", "scratch disk",
+		"--setuuid", "38f0cf9d-6c60-4f59-ba0b-cd1dfb5329d6",
+		"--bandwidthgroup", "slowdisk",
+	}
+	if args := attachmentArgs(disk); !reflect.DeepEqual(args, expected) {
+		t.Errorf("expected %v, got %v", expected, args)
+	}
+	if args := attachmentArgs(&Disk{}); len(args) != 0 {
+		t.Errorf("expected no options, got %v", args)
+	}
+}
+
+func TestApplyStorageSettings(t *testing.T) {
+	var settings settingsFile
+	if err := xml.Unmarshal([]byte(`<VirtualBox>
+  <Machine uuid="{6aa44e71-71c6-4e68-a61f-f69e133ecffa}" name="testvm1">
+    <MediaRegistry>
+      <HardDisks>
+        <HardDisk uuid="{38f0cf9d-6c60-4f59-ba0b-cd1dfb5329d6}" location="disk1.vdi" format="VDI" type="Writethrough">
+          <Description>scratch disk</Description>
+        </HardDisk>
+      </HardDisks>
+    </MediaRegistry>
+    <StorageControllers>
+      <StorageController name="SATA1" type="AHCI" PortCount="4" useHostIOCache="false" Bootable="true">
+        <AttachedDevice type="HardDisk" port="1" device="0" nonrotational="true" discard="true" hotpluggable="true" bandwidthGroup="slowdisk">
+          <Image uuid="{38f0cf9d-6c60-4f59-ba0b-cd1dfb5329d6}"/>
+        </AttachedDevice>
+      </StorageController>
+    </StorageControllers>
+  </Machine>
+</VirtualBox>`), &settings); err != nil {
+		t.Fatalf("unmarshal failed %v", err)
+	}
+
+	disks := []Disk{
+		{Path: "/vms/testvm1/disk1.vdi", Controller: StorageControllerAttachment{Name: "SATA1", Port: 1}},
+		{Path: "/vms/testvm1/disk2.vdi", Controller: StorageControllerAttachment{Name: "SATA1", Port: 2}},
+	}
+	settings.Machine.applySettings("/vms/testvm1/testvm1.vbox", &VirtualMachineSpec{Disks: disks})
+
+	d := disks[0]
+	if !d.NonRotational || !d.AutoDiscard || !d.Controller.HotPluggable || d.BandwidthGroup != "slowdisk" {
+		t.Errorf("expected attachment options to be read back, got %+v", d)
+	}
+	if d.MediumType != WritethroughMedium || d.Comment != "scratch disk" {
+		t.Errorf("expected medium type and comment to be read back, got %+v", d)
+	}
+	if disks[1].NonRotational || disks[1].BandwidthGroup != "" {
+		t.Errorf("expected the other slot to be untouched, got %+v", disks[1])
+	}
+}
+
+func TestAssignStorageSlotsUnknownType(t *testing.T) {
+	controllers := []StorageController{{Name: "ctl1"}}
+	disks := []Disk{
+		{Path: "/a.vdi", Type: HDDrive, Controller: StorageControllerAttachment{Name: "ctl1", Port: 3, Pinned: true}},
+		{Path: "/b.vdi", Type: HDDrive, Controller: StorageControllerAttachment{Name: "ctl1"}},
+	}
+
+	verr := ValidationErrors{}
+	assignStorageSlots(controllers, disks, nil, &verr)
+	if len(verr.Errors()) != 0 {
+		t.Fatalf("expected controllers of an unknown type to have no port limit, got %v", verr)
+	}
+	if diskSlot(disks[0]) != "ctl1/3/0" || diskSlot(disks[1]) != "ctl1/0/0" {
+		t.Errorf("unexpected slots %s and %s", diskSlot(disks[0]), diskSlot(disks[1]))
+	}
+}
+
+func TestEnsureDefaultsStorage(t *testing.T) {
+	vb := &VBox{run: func(ctx context.Context, args ...string) (string, error) { return "", nil }}
+	vm := &VirtualMachine{Spec: VirtualMachineSpec{Disks: []Disk{
+		{Path: "/vms/vm01/disk1.vdi", Type: HDDrive},
+		{Type: DVDDrive},
+	}}}
+
+	if _, err := vb.EnsureDefaults(vm); err != nil {
+		t.Fatal(err)
+	}
+	if len(vm.Spec.StorageControllers) != 1 || vm.Spec.StorageControllers[0].Type != SATA {
+		t.Errorf("expected the dvd drive to share the default sata controller, got %+v", vm.Spec.StorageControllers)
+	}
+	if diskSlot(vm.Spec.Disks[0]) != "SATA1/0/0" || diskSlot(vm.Spec.Disks[1]) != "SATA1/1/0" {
+		t.Errorf("unexpected slots %s and %s", diskSlot(vm.Spec.Disks[0]), diskSlot(vm.Spec.Disks[1]))
+	}
+
+	vm.Spec.StorageControllers = append(vm.Spec.StorageControllers, StorageController{Name: "SATA1", Type: SATA})
+	if _, err := vb.EnsureDefaults(vm); !IsValidationErrors(err) {
+		t.Errorf("expected a duplicate controller name to fail validation, got %v", err)
+	}
+}
+
+func TestEnsureDefaultsVMInfoError(t *testing.T) {
+	vm := &VirtualMachine{Spec: VirtualMachineSpec{Name: "vm01", Disks: []Disk{{Path: "/vms/vm01/disk1.vdi"}}}}
+
+	missing := &VBox{run: func(ctx context.Context, args ...string) (string, error) {
+		if args[0] == "showvminfo" {
+			return "", VBoxError("VBoxManage: error: Could not find a registered machine named 'vm01'")
+		}
+		return "", nil
+	}}
+	if _, err := missing.EnsureDefaults(vm); err != nil {
+		t.Errorf("expected a new vm to get its defaults, got %v", err)
+	}
+
+	failing := &VBox{run: func(ctx context.Context, args ...string) (string, error) {
+		if args[0] == "showvminfo" {
+			return "", VBoxError("VBoxManage: error: The object is not ready")
+		}
+		return "", nil
+	}}
+	if _, err := failing.EnsureDefaults(vm); err == nil || err == ErrMachineNotExist {
+		t.Errorf("expected the VBoxManage error to be returned, got %v", err)
+	}
+}
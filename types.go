@@ -1,12 +1,38 @@
 package virtualbox
 
+import "time"
+
 type StorageControllerType string
 
 const (
-	IDE   = StorageControllerType("IDE")
-	SATA  = StorageControllerType("SATA")
-	SCSCI = StorageControllerType("SCSCI")
-	NVME  = StorageControllerType("NVME")
+	IDE        = StorageControllerType("IDE")
+	SATA       = StorageControllerType("SATA")
+	SCSI       = StorageControllerType("SCSI")
+	SAS        = StorageControllerType("SAS")
+	NVME       = StorageControllerType("NVME")
+	VirtioSCSI = StorageControllerType("VirtioSCSI")
+	USB        = StorageControllerType("USB")
+	Floppy     = StorageControllerType("Floppy")
+
+	// Deprecated: SCSCI is the old misspelled name of SCSI
+	SCSCI = SCSI
+)
+
+// StorageControllerChipset is the controller emulated on the bus of a StorageControllerType
+type StorageControllerChipset string
+
+const (
+	PIIX3       = StorageControllerChipset("PIIX3")
+	PIIX4       = StorageControllerChipset("PIIX4")
+	ICH6        = StorageControllerChipset("ICH6")
+	IntelAhci   = StorageControllerChipset("IntelAhci")
+	LsiLogic    = StorageControllerChipset("LsiLogic")
+	BusLogic    = StorageControllerChipset("BusLogic")
+	LsiLogicSas = StorageControllerChipset("LsiLogicSas")
+	NVMe        = StorageControllerChipset("NVMe")
+	VirtIO      = StorageControllerChipset("VirtIO")
+	USBChipset  = StorageControllerChipset("USB")
+	I82078      = StorageControllerChipset("I82078")
 )
 
 type DiskType string
@@ -17,6 +43,19 @@ const (
 	FDDrive  = DiskType("fdd")
 )
 
+// ForList returns the name of the media list for the drive type, as in list hdds
+func (d DiskType) ForList() string {
+	switch d {
+	case DVDDrive:
+		return "dvds"
+	case HDDrive:
+		return "hdds"
+	case FDDrive:
+		return "floppies"
+	}
+	return ""
+}
+
 func (d DiskType) ForShowMedium() string {
 	switch d {
 	case DVDDrive:
@@ -37,6 +76,7 @@ const (
 	Paused   = VirtualMachineState("paused")
 	Saved    = VirtualMachineState("saved")
 	Aborted  = VirtualMachineState("aborted")
+	Stuck    = VirtualMachineState("gurumeditation")
 )
 
 type Disk struct {
@@ -49,6 +89,23 @@ type Disk struct {
 	Type          DiskType
 	NonRotational bool
 	AutoDiscard   bool
+	// MediumType controls how the medium behaves when attached and snapshotted, as reported by DiskInfo
+	MediumType MediumType
+	// ParentUUID is set for differencing images and refers to the medium they are based on
+	ParentUUID string
+	// State is the registry state of the medium, for e.g created or inaccessible
+	State MediumState
+	// AttachedVMs holds the uuids of the vms using this medium, as reported by DiskInfo
+	AttachedVMs []string
+	// Comment is the description stored with the medium
+	Comment string
+	// SetUUID gives the medium a new uuid when it is attached, so copies of one image can be registered side by side
+	SetUUID string
+	// BandwidthGroup is the name of the vm bandwidth group limiting the i/o of the attachment
+	BandwidthGroup string
+	// Encrypted and EncryptionKeyID are reported by DiskInfo, running vms need the password of that id
+	Encrypted       bool
+	EncryptionKeyID string
 }
 
 type StorageControllerAttachment struct {
@@ -58,19 +115,39 @@ type StorageControllerAttachment struct {
 	Device int
 	// Name of the storage controller target for this attachment
 	Name string
+	// HotPluggable ports accept and release disks while the vm is running
+	HotPluggable bool
+	// Pinned keeps Port and Device as given, otherwise EnsureDefaults only keeps them when they are not zero
+	Pinned bool
 }
 
 type StorageController struct {
-	Name      string
-	Type      StorageControllerType
-	Instance  int
-	PortCount int
-	Bootable  string //on, off
+	Name string
+	Type StorageControllerType
+	// Chipset picks the emulated controller, VirtualBox uses the default of the type when empty
+	Chipset     StorageControllerChipset
+	Instance    int
+	PortCount   int
+	Bootable    string //on, off
+	HostIOCache string //on, off
 }
 
 type Snapshot struct {
+	UUID        string
 	Name        string
 	Description string
+	ParentUUID  string
+	// Created is read from the vm settings file and is zero when it cannot be determined
+	Created time.Time
+	// Online is set for snapshots taken of a running vm, restoring them brings back the saved state
+	Online bool
+}
+
+func (s *Snapshot) UUIDOrName() string {
+	if s.UUID == "" {
+		return s.Name
+	}
+	return s.UUID
 }
 
 type CPU struct {
@@ -92,6 +169,8 @@ const (
 	NWMode_intnet     = NetworkMode("intnet")
 	NWMode_hostonly   = NetworkMode("hostonly")
 	NWMode_generic    = NetworkMode("generic")
+	// NWMode_hostonlynet attaches to a host-only network of VirtualBox 7 and later, see HostOnlyNet
+	NWMode_hostonlynet = NetworkMode("hostonlynet")
 )
 
 type NICType string
@@ -117,6 +196,10 @@ type NIC struct {
 	PromiscuousMode string
 	MAC             string //auto assigns mac automatically
 	PortForwarding  []PortForwarding
+	// BandwidthGroup is the name of the vm bandwidth group limiting the traffic of the nic
+	BandwidthGroup string
+	// NATEngine configures nat mode nics
+	NATEngine NATEngine
 }
 
 type NetProtocol string
@@ -138,13 +221,18 @@ type PortForwarding struct {
 }
 
 type Network struct {
-	GUID       string
-	Name       string
-	IPNet      string
-	IPMask     string
-	Mode       NetworkMode
-	DeviceName string
-	HWAddress  string
+	GUID string
+	Name string
+	// IPNet is the address of the host on the network, either with IPMask or in CIDR notation
+	IPNet         string
+	IPMask        string
+	IPv6Address   string
+	IPv6PrefixLen int
+	Mode          NetworkMode
+	DeviceName    string
+	HWAddress     string
+	// DHCP is the dhcp server to pair the network with, if any
+	DHCP *DHCPServer
 }
 
 type BootDevice string
@@ -167,6 +255,7 @@ type VirtualMachineSpec struct {
 	CurrentSnapshot    Snapshot
 	DragAndDrop        string
 	Clipboard          string
+	BandwidthGroups    []BandwidthGroup
 }
 
 type VirtualMachine struct {
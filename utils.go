@@ -2,10 +2,30 @@ package virtualbox
 
 import (
 	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/golang/glog"
 )
 
+// defaultPollInterval is the time between two polls when the caller leaves it out
+const defaultPollInterval = time.Second
+
+// pollInterval returns the interval, or defaultPollInterval when it is not positive and polling would spin
+func pollInterval(interval time.Duration) time.Duration {
+	if interval <= 0 {
+		return defaultPollInterval
+	}
+	return interval
+}
+
 func parseKeyValues(text string, regexp *regexp.Regexp, callback func(key, val string) error) error {
 	return tryParseKeyValues(text, regexp, func(key, val string, ok bool) error {
 		if ok {
@@ -41,3 +61,92 @@ func tryParseKeyValues(stdOut string, regexp *regexp.Regexp, callback func(key,
 
 	return s.Err()
 }
+
+// parseMachineReadable converts the key="value" output of the --machinereadable flag into a map.
+// Quoted values are unquoted into strings and bare numbers become ints
+func parseMachineReadable(out string) map[string]interface{} {
+	m := map[string]interface{}{}
+	_ = parseKeyValues(out, reKeyEqVal, func(key, val string) error {
+		if strings.HasPrefix(key, "\"") {
+			if k, err := strconv.Unquote(key); err == nil {
+				key = k
+			} //else ignore; might need to warn in log
+		}
+		if strings.HasPrefix(val, "\"") {
+			if val, err := strconv.Unquote(val); err == nil {
+				m[key] = val
+			}
+		} else if i, err := strconv.Atoi(val); err == nil {
+			m[key] = i
+		} else { // we dont expect any actually
+			glog.V(6).Infof("ignoring parsing val %s for key %s", val, key)
+		}
+		return nil
+	})
+	return m
+}
+
+// stringValue returns the string stored under key or an empty string
+func stringValue(m map[string]interface{}, key string) string {
+	if v, ok := m[key].(string); ok {
+		return v
+	}
+	return ""
+}
+
+// readStateFile decodes the json state file of the given name in the base path into v, leaving v alone when
+// there is no such file yet
+func (vb *VBox) readStateFile(name string, v interface{}) error {
+	path := filepath.Join(vb.Config.BasePath, name)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("reading %s failed %v", path, err)
+	}
+	return nil
+}
+
+// writeStateFile replaces the json state file of the given name in the base path through a rename, so that a
+// crash never leaves half of it
+func (vb *VBox) writeStateFile(name string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(vb.Config.BasePath, os.ModePerm); err != nil {
+		return err
+	}
+
+	path := filepath.Join(vb.Config.BasePath, name)
+	if err := ioutil.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// lockStateFile takes an exclusive lock on the state file of the given name in the base path, blocking while
+// another process holds it, and returns the function that releases it. The lock is kept on a separate .lock file
+// as writeStateFile replaces the state file itself
+func (vb *VBox) lockStateFile(name string) (func(), error) {
+	if err := os.MkdirAll(vb.Config.BasePath, os.ModePerm); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(vb.Config.BasePath, name+".lock"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		unlockFile(f)
+		f.Close()
+	}, nil
+}
@@ -2,12 +2,15 @@ package virtualbox
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os/exec"
 	"os/user"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/golang/glog"
@@ -39,6 +42,13 @@ type Config struct {
 
 	// expected to be managed by this tool
 	Networks []Network
+
+	// SubnetPools are the ipv4 ranges AllocateSubnet hands out subnets from, DefaultSubnetPools when empty
+	SubnetPools []string
+
+	// VirtualBoxHome is where VirtualBox keeps the lease files of its dhcp servers, defaults to $VBOX_USER_HOME or
+	// the platform default of VirtualBox
+	VirtualBoxHome string
 }
 
 // VBox uses the VBoxManage command for its functionality
@@ -52,6 +62,11 @@ type VBox struct {
 	BridgedNws  map[string]*Network
 	InternalNws map[string]*Network
 	NatNws      map[string]*Network
+	// HostOnlyNets are the host-only networks of VirtualBox 7 and later
+	HostOnlyNets map[string]*Network
+
+	// run stands in for VBoxManage when set, tests use it to script its output
+	run func(ctx context.Context, args ...string) (string, error)
 }
 
 func NewVBox(config Config) *VBox {
@@ -59,11 +74,12 @@ func NewVBox(config Config) *VBox {
 		config.BasePath = DefaultVBBasePath
 	}
 	return &VBox{
-		Config:      config,
-		HostOnlyNws: make(map[string]*Network),
-		BridgedNws:  make(map[string]*Network),
-		InternalNws: make(map[string]*Network),
-		NatNws:      make(map[string]*Network),
+		Config:       config,
+		HostOnlyNws:  make(map[string]*Network),
+		BridgedNws:   make(map[string]*Network),
+		InternalNws:  make(map[string]*Network),
+		NatNws:       make(map[string]*Network),
+		HostOnlyNets: make(map[string]*Network),
 	}
 }
 
@@ -101,12 +117,60 @@ func (vb *VBox) getVMSettingsFile(vm *VirtualMachine) string {
 }
 
 func (vb *VBox) manage(args ...string) (string, error) {
+	return vb.manageWithContext(context.Background(), args...)
+}
+
+// manageWithContext runs VBoxManage, killing it when the context is done before it completes
+func (vb *VBox) manageWithContext(ctx context.Context, args ...string) (string, error) {
+	return vb.manageStreaming(ctx, nil, nil, args...)
+}
+
+// ProgressFunc is called with the percentage of a long running operation whenever it advances
+type ProgressFunc func(percent int)
+
+var reProgress = regexp.MustCompile(`(\d+)%`)
+
+// progressWriter collects stderr and reports the 0%...10%... progress VBoxManage prints there
+type progressWriter struct {
+	bytes.Buffer
+	progress ProgressFunc
+	scanned  int
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	n, err := w.Buffer.Write(p)
+	if w.progress == nil {
+		return n, err
+	}
+
+	// only scan up to the last complete percentage, a number may be split across writes
+	data := w.Bytes()
+	end := bytes.LastIndexByte(data, '%')
+	if end < w.scanned {
+		return n, err
+	}
+	for _, m := range reProgress.FindAllSubmatch(data[w.scanned:end+1], -1) {
+		if percent, perr := strconv.Atoi(string(m[1])); perr == nil {
+			w.progress(percent)
+		}
+	}
+	w.scanned = end + 1
+	return n, err
+}
+
+// manageStreaming runs VBoxManage with stdin connected to the given reader, reporting progress as it goes
+func (vb *VBox) manageStreaming(ctx context.Context, stdin io.Reader, progress ProgressFunc, args ...string) (string, error) {
+	if vb.run != nil {
+		return vb.run(ctx, args...)
+	}
+
 	vboxManage := vboxManagePath()
-	cmd := exec.Command(vboxManage, args...)
+	cmd := exec.CommandContext(ctx, vboxManage, args...)
 	glog.V(4).Infof("COMMAND: %v %v", vboxManage, strings.Join(args, " "))
 
 	var stdout bytes.Buffer
-	var stderr bytes.Buffer
+	stderr := progressWriter{progress: progress}
+	cmd.Stdin = stdin
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 
@@ -117,6 +181,9 @@ func (vb *VBox) manage(args ...string) (string, error) {
 		if ee, ok := err.(*exec.Error); ok && ee.Err == exec.ErrNotFound {
 			return "", errors.New("unable to find VBoxManage command in path")
 		}
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
 		return "", VBoxError(stderrStr)
 	}
 
@@ -139,35 +206,8 @@ func (vb *VBox) ListDHCPServers() (map[string]*DHCPServer, error) {
 	if err != nil {
 		return nil, err
 	}
-
-	m := make(map[string]*DHCPServer)
-
-	var dhcpServer *DHCPServer
-
-	err = parseKeyValues(listOutput, reColonLine, func(key, val string) error {
-		switch key {
-		case "NetworkName":
-			dhcpServer = &DHCPServer{}
-			m[val] = dhcpServer
-			dhcpServer.NetworkName = val
-		case "IP":
-			dhcpServer.IPAddress = val
-		case "upperIPAddress":
-			dhcpServer.UpperIPAddress = val
-		case "lowerIPAddress":
-			dhcpServer.LowerIPAddress = val
-		case "NetworkMask":
-			dhcpServer.NetworkMask = val
-		case "Enabled":
-			dhcpServer.Enabled = val == "Yes"
-		}
-		return nil
-	})
-	if err != nil {
-		return nil, err
-	}
-
-	return m, nil
+	servers, _ := parseDHCPServers(listOutput)
+	return servers, nil
 }
 
 func (vb *VBox) ListOSTypes() (map[string]*OSType, error) {
@@ -205,6 +245,6 @@ func (vb *VBox) ListOSTypes() (map[string]*OSType, error) {
 }
 
 func (vb *VBox) MarkHDImmutable(hdPath string) error {
-	vb.manage("modifyhd", hdPath, "--type", "immutable")
-	return nil
+	_, err := vb.manage("modifymedium", "disk", hdPath, "--type", string(ImmutableMedium))
+	return err
 }
@@ -2,6 +2,19 @@
 
 package virtualbox
 
+import (
+	"os"
+	"syscall"
+)
+
 func vboxManagePath() string {
 	return VBoxManage
 }
+
+func lockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+}
+
+func unlockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}